@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"CloudBox/controllers"
+	"CloudBox/models"
+)
+
+// result is what a command produced: data is printed as JSON with -json,
+// and print writes it for people otherwise.
+type result struct {
+    data  interface{}
+    print func()
+}
+
+// message is the result of a command with nothing more to report.
+func message(format string, args ...interface{}) result {
+    text := fmt.Sprintf(format, args...)
+    return result{
+        data:  map[string]string{"message": text},
+        print: func() { fmt.Println(text) },
+    }
+}
+
+// parseFlags parses a command's flags and checks how many arguments are
+// left, printing the command's usage line on a mistake.
+func parseFlags(fs *flag.FlagSet, args []string, usage string, min, max int) ([]string, error) {
+    fs.Usage = func() {
+        fmt.Fprintf(os.Stderr, "usage: cloudbox-admin %s\n", usage)
+        fs.PrintDefaults()
+    }
+    if err := fs.Parse(args); err != nil {
+        return nil, err
+    }
+    rest := fs.Args()
+    if len(rest) < min || len(rest) > max {
+        fs.Usage()
+        return nil, errors.New("wrong number of arguments")
+    }
+    return rest, nil
+}
+
+// userArg parses a command taking a single user and looks the user up.
+func userArg(h *controllers.Handler, name string, args []string) (*models.User, error) {
+    rest, err := parseFlags(flag.NewFlagSet(name, flag.ContinueOnError), args, name+" <user>", 1, 1)
+    if err != nil {
+        return nil, err
+    }
+    return h.FindUser(rest[0])
+}
+
+func readPassword() (string, error) {
+    if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+        fmt.Fprint(os.Stderr, "New password: ")
+    }
+    line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+    if err != nil && line == "" {
+        return "", errors.New("no password given on standard input")
+    }
+    return strings.TrimRight(line, "\r\n"), nil
+}
+
+// userInfo is what is shown of a user, leaving out the password hash.
+type userInfo struct {
+    ID            uint      `json:"id"`
+    Username      string    `json:"username"`
+    Email         string    `json:"email"`
+    CreatedAt     time.Time `json:"created_at"`
+    LastLogin     time.Time `json:"last_login"`
+    Disabled      bool      `json:"disabled"`
+    LoginAttempts int       `json:"login_attempts"`
+    LockedUntil   time.Time `json:"locked_until"`
+    QuotaBytes    int64     `json:"quota_bytes"`
+    UsedBytes     int64     `json:"used_bytes"`
+}
+
+func (u userInfo) status() string {
+    switch {
+    case u.Disabled:
+        return "disabled"
+    case u.LockedUntil.After(time.Now()):
+        return "locked"
+    }
+    return "active"
+}
+
+func formatTime(t time.Time) string {
+    if t.IsZero() {
+        return "never"
+    }
+    return t.Local().Format("2006-01-02 15:04")
+}
+
+func formatSize(n int64) string {
+    const unit = 1024
+    if n < unit {
+        return fmt.Sprintf("%d B", n)
+    }
+    div, exp := int64(unit), 0
+    for m := n / unit; m >= unit; m /= unit {
+        div *= unit
+        exp++
+    }
+    return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func cmdUsers(h *controllers.Handler, args []string) (result, error) {
+    if _, err := parseFlags(flag.NewFlagSet("users", flag.ContinueOnError), args, "users", 0, 0); err != nil {
+        return result{}, err
+    }
+    users, err := h.ListUsers()
+    if err != nil {
+        return result{}, err
+    }
+
+    infos := make([]userInfo, 0, len(users))
+    for _, u := range users {
+        infos = append(infos, userInfo{
+            ID: u.ID, Username: u.Username, Email: u.Email, CreatedAt: u.CreatedAt, LastLogin: u.LastLogin,
+            Disabled: u.Disabled, LoginAttempts: u.LoginAttempts, LockedUntil: u.LockedUntil,
+            QuotaBytes: u.QuotaBytes, UsedBytes: u.UsedBytes,
+        })
+    }
+    return result{data: infos, print: func() {
+        w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+        fmt.Fprintln(w, "ID\tUSERNAME\tEMAIL\tSTATUS\tUSED\tLAST LOGIN")
+        for _, u := range infos {
+            fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", u.ID, u.Username, u.Email, u.status(),
+                formatSize(u.UsedBytes), formatTime(u.LastLogin))
+        }
+        w.Flush()
+    }}, nil
+}
+
+func cmdCreateUser(h *controllers.Handler, args []string) (result, error) {
+    rest, err := parseFlags(flag.NewFlagSet("create-user", flag.ContinueOnError), args, "create-user <username> <email>", 2, 2)
+    if err != nil {
+        return result{}, err
+    }
+    // The same rules registration binds its input with
+    if len(rest[0]) < 3 || len(rest[0]) > 30 {
+        return result{}, errors.New("username must be between 3 and 30 characters")
+    }
+    if _, err := mail.ParseAddress(rest[1]); err != nil {
+        return result{}, fmt.Errorf("invalid email address %q", rest[1])
+    }
+    password, err := readPassword()
+    if err != nil {
+        return result{}, err
+    }
+    user, err := h.CreateAccount(rest[0], rest[1], password)
+    if err != nil {
+        return result{}, err
+    }
+    out := message("Created user %s with ID %d", user.Username, user.ID)
+    out.data = map[string]interface{}{"id": user.ID, "username": user.Username}
+    return out, nil
+}
+
+func cmdDisable(h *controllers.Handler, args []string) (result, error) {
+    user, err := userArg(h, "disable", args)
+    if err != nil {
+        return result{}, err
+    }
+    if err := h.SetUserDisabled(user, true); err != nil {
+        return result{}, err
+    }
+    return message("Disabled %s", user.Username), nil
+}
+
+func cmdEnable(h *controllers.Handler, args []string) (result, error) {
+    user, err := userArg(h, "enable", args)
+    if err != nil {
+        return result{}, err
+    }
+    if err := h.SetUserDisabled(user, false); err != nil {
+        return result{}, err
+    }
+    return message("Enabled %s", user.Username), nil
+}
+
+func cmdUnlock(h *controllers.Handler, args []string) (result, error) {
+    user, err := userArg(h, "unlock", args)
+    if err != nil {
+        return result{}, err
+    }
+    if err := h.UnlockUser(user); err != nil {
+        return result{}, err
+    }
+    return message("Unlocked %s", user.Username), nil
+}
+
+func cmdResetPassword(h *controllers.Handler, args []string) (result, error) {
+    user, err := userArg(h, "reset-password", args)
+    if err != nil {
+        return result{}, err
+    }
+    password, err := readPassword()
+    if err != nil {
+        return result{}, err
+    }
+    if err := h.SetPassword(user, password); err != nil {
+        return result{}, err
+    }
+    return message("Reset the password of %s", user.Username), nil
+}
+
+func cmdUsage(h *controllers.Handler, args []string) (result, error) {
+    fs := flag.NewFlagSet("usage", flag.ContinueOnError)
+    recompute := fs.Bool("recompute", false, "recompute the charged usage from the files first")
+    rest, err := parseFlags(fs, args, "usage [-recompute] [user]", 0, 1)
+    if err != nil {
+        return result{}, err
+    }
+
+    var users []models.User
+    if len(rest) == 1 {
+        user, err := h.FindUser(rest[0])
+        if err != nil {
+            return result{}, err
+        }
+        users = []models.User{*user}
+    } else if users, err = h.ListUsers(); err != nil {
+        return result{}, err
+    }
+
+    usages := make([]*controllers.UserUsage, 0, len(users))
+    for i := range users {
+        if *recompute {
+            if err := h.RecomputeUsage(users[i].ID); err != nil {
+                return result{}, err
+            }
+            if err := h.DB.First(&users[i], users[i].ID).Error; err != nil {
+                return result{}, err
+            }
+        }
+        usage, err := h.Usage(&users[i])
+        if err != nil {
+            return result{}, err
+        }
+        usages = append(usages, usage)
+    }
+
+    return result{data: usages, print: func() {
+        w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+        fmt.Fprintln(w, "USERNAME\tFOLDERS\tFILES\tSIZE\tTRASH\tSIZE\tVERSIONS\tSIZE\tUSED\tQUOTA\t")
+        for _, u := range usages {
+            fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%d\t%s\t%d\t%s\t%s\t%s\t\n", u.Username, u.Folders,
+                u.Files, formatSize(u.FileBytes), u.TrashFiles, formatSize(u.TrashBytes),
+                u.Versions, formatSize(u.VersionBytes), formatSize(u.UsedBytes), formatSize(u.QuotaBytes))
+        }
+        w.Flush()
+    }}, nil
+}
+
+func cmdTransfer(h *controllers.Handler, args []string) (result, error) {
+    rest, err := parseFlags(flag.NewFlagSet("transfer", flag.ContinueOnError), args, "transfer <from user> <to user>", 2, 2)
+    if err != nil {
+        return result{}, err
+    }
+    from, err := h.FindUser(rest[0])
+    if err != nil {
+        return result{}, err
+    }
+    to, err := h.FindUser(rest[1])
+    if err != nil {
+        return result{}, err
+    }
+
+    transferred, err := h.TransferFiles(from, to)
+    if err != nil {
+        return result{}, err
+    }
+    return result{data: transferred, print: func() {
+        fmt.Printf("Moved %d files and %d folders from %s into %s of %s\n",
+            transferred.Files, transferred.Folders, from.Username, transferred.Folder, to.Username)
+    }}, nil
+}
+
+func cmdDeleteUser(h *controllers.Handler, args []string) (result, error) {
+    fs := flag.NewFlagSet("delete-user", flag.ContinueOnError)
+    yes := fs.Bool("yes", false, "really delete, rather than only show what would go")
+    rest, err := parseFlags(fs, args, "delete-user [-yes] <user>", 1, 1)
+    if err != nil {
+        return result{}, err
+    }
+    user, err := h.FindUser(rest[0])
+    if err != nil {
+        return result{}, err
+    }
+
+    if !*yes {
+        usage, err := h.Usage(user)
+        if err != nil {
+            return result{}, err
+        }
+        return result{}, fmt.Errorf("%s has %d folders, %d files, %d in the trash and %d older versions; pass -yes to delete them all",
+            user.Username, usage.Folders, usage.Files, usage.TrashFiles, usage.Versions)
+    }
+
+    deleted, err := h.DeleteAccount(user)
+    if err != nil {
+        return result{}, err
+    }
+    return result{data: deleted, print: func() {
+        fmt.Printf("Deleted %s with %d files and %d folders\n", user.Username, deleted.Files, deleted.Folders)
+    }}, nil
+}
+
+func cmdPurge(h *controllers.Handler, args []string) (result, error) {
+    if len(args) == 0 {
+        return result{}, errors.New("usage: cloudbox-admin purge trash|uploads|changes")
+    }
+    switch args[0] {
+    case "trash":
+        fs := flag.NewFlagSet("purge trash", flag.ContinueOnError)
+        olderThan := fs.Duration("older-than", controllers.TrashRetention(), "purge files deleted longer ago than this")
+        if _, err := parseFlags(fs, args[1:], "purge trash [-older-than duration]", 0, 0); err != nil {
+            return result{}, err
+        }
+        purged, err := h.PurgeExpiredTrash(*olderThan)
+        if err != nil {
+            return result{}, err
+        }
+        out := message("Purged %d files from the trash", purged)
+        out.data = map[string]int{"purged": purged}
+        return out, nil
+
+    case "uploads":
+        if _, err := parseFlags(flag.NewFlagSet("purge uploads", flag.ContinueOnError), args[1:], "purge uploads", 0, 0); err != nil {
+            return result{}, err
+        }
+        removed, err := h.CleanupPendingUploads()
+        if err != nil {
+            return result{}, err
+        }
+        abandoned, err := h.CleanupStaleTusUploads()
+        if err != nil {
+            return result{}, err
+        }
+        sessions, err := h.CleanupStaleUploadSessions()
+        if err != nil {
+            return result{}, err
+        }
+        out := message("Removed %d unconfirmed and %d abandoned uploads, aborted %d idle upload sessions", removed, abandoned, sessions)
+        out.data = map[string]int{"purged": removed + abandoned + sessions}
+        return out, nil
+
+    case "changes":
+        fs := flag.NewFlagSet("purge changes", flag.ContinueOnError)
+        olderThan := fs.Duration("older-than", controllers.ChangeRetention(), "prune changes recorded longer ago than this")
+        if _, err := parseFlags(fs, args[1:], "purge changes [-older-than duration]", 0, 0); err != nil {
+            return result{}, err
+        }
+        pruned, err := h.PruneChanges(*olderThan)
+        if err != nil {
+            return result{}, err
+        }
+        out := message("Pruned %d changes from the journal", pruned)
+        out.data = map[string]int64{"purged": pruned}
+        return out, nil
+    }
+    return result{}, fmt.Errorf("unknown purge %q", args[0])
+}
+
+func cmdScan(h *controllers.Handler, args []string) (result, error) {
+    fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+    unscanned := fs.Bool("unscanned", false, "also scan files stored while scanning was off, quarantining them until then")
+    if _, err := parseFlags(fs, args, "scan [-unscanned]", 0, 0); err != nil {
+        return result{}, err
+    }
+    queued := int64(0)
+    if *unscanned {
+        var err error
+        if queued, err = h.QueueUnscannedContent(); err != nil {
+            return result{}, err
+        }
+    }
+    scanned, err := h.ScanPendingContent()
+    if err != nil {
+        return result{}, err
+    }
+    out := message("Scanned %d objects", scanned)
+    out.data = map[string]int64{"queued": queued, "scanned": int64(scanned)}
+    return out, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"CloudBox/controllers"
+	"CloudBox/initializers"
+	"CloudBox/utils"
+)
+
+func init() {
+	initializers.LoadEnvs()
+}
+
+const usage = `cloudbox-admin manages CloudBox users and storage directly through the
+database and the storage backend.
+
+Usage:
+    cloudbox-admin [-json] <command> [arguments]
+
+Commands:
+    users                                 list every user
+    create-user <username> <email>        create a user
+    disable <user>                        refuse all access, keeping the data
+    enable <user>                         undo disable
+    unlock <user>                         clear failed logins and any lockout
+    reset-password <user>                 set a new password and unlock
+    usage [-recompute] [user]             show storage usage, of everyone by default
+    transfer <from user> <to user>        give all of a user's files to another
+    delete-user [-yes] <user>             delete a user and everything they own
+    purge trash [-older-than duration]    remove expired files from the trash
+    purge uploads                         remove unconfirmed and abandoned uploads
+    purge changes [-older-than duration]  prune the change journal
+    scan [-unscanned]                     virus scan files waiting for a scan
+
+Users are given by username or ID. New passwords are read from standard
+input, one line, so they can be piped in. With -json, results are printed
+as JSON for scripting.
+`
+
+// commands maps each command to the function running it. They receive the
+// arguments after the command name and return what to print.
+var commands = map[string]func(h *controllers.Handler, args []string) (result, error){
+    "users":          cmdUsers,
+    "create-user":    cmdCreateUser,
+    "disable":        cmdDisable,
+    "enable":         cmdEnable,
+    "unlock":         cmdUnlock,
+    "reset-password": cmdResetPassword,
+    "usage":          cmdUsage,
+    "transfer":       cmdTransfer,
+    "delete-user":    cmdDeleteUser,
+    "purge":          cmdPurge,
+    "scan":           cmdScan,
+}
+
+func main() {
+    asJSON := flag.Bool("json", false, "print results as JSON")
+    flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+    flag.Parse()
+    if flag.NArg() == 0 {
+        flag.Usage()
+        os.Exit(2)
+    }
+    run, ok := commands[flag.Arg(0)]
+    if !ok {
+        fmt.Fprintf(os.Stderr, "cloudbox-admin: unknown command %q\n\n%s", flag.Arg(0), usage)
+        os.Exit(2)
+    }
+
+    db := utils.ConnectDB()
+    store, err := utils.NewStorage()
+    if err != nil {
+        log.Fatalf("Failed to initialise storage: %v", err)
+    }
+    h := controllers.NewHandler(db, store)
+
+    out, err := run(h, flag.Args()[1:])
+    if err != nil {
+        log.Fatalf("%s: %v", flag.Arg(0), err)
+    }
+    if *asJSON {
+        enc := json.NewEncoder(os.Stdout)
+        enc.SetIndent("", "  ")
+        enc.Encode(out.data)
+    } else {
+        out.print()
+    }
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+)
+
+// tokenMargin is how long before expiry an access token is refreshed, so
+// it cannot lapse in the middle of a request.
+const tokenMargin = 30 * time.Second
+
+var errNotLoggedIn = errors.New("not logged in, run cloudbox login first")
+
+// apiError is an error response from the server.
+type apiError struct {
+    status  int
+    message string
+}
+
+func (e *apiError) Error() string {
+    return fmt.Sprintf("%s (HTTP %d)", e.message, e.status)
+}
+
+func isStatus(err error, status int) bool {
+    var apiErr *apiError
+    return errors.As(err, &apiErr) && apiErr.status == status
+}
+
+type tokenResponse struct {
+    AccessToken  string    `json:"access_token"`
+    RefreshToken string    `json:"refresh_token"`
+    ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// client talks to the CloudBox API, refreshing its access token as it
+// goes and saving the new tokens for the next run.
+type client struct {
+    cfg  *config
+    http *http.Client
+}
+
+func newClient(cfg *config) *client {
+    return &client{cfg: cfg, http: &http.Client{}}
+}
+
+// url resolves path against the server, leaving absolute URLs alone.
+func (c *client) url(path string) string {
+    if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+        return path
+    }
+    return strings.TrimRight(c.cfg.Server, "/") + path
+}
+
+// responseError reads an error response, which the API sends as JSON with
+// an error field and the tus routes as plain text.
+func responseError(resp *http.Response) error {
+    raw, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+    var body struct {
+        Error string `json:"error"`
+    }
+    message := strings.TrimSpace(string(raw))
+    if json.Unmarshal(raw, &body) == nil && body.Error != "" {
+        message = body.Error
+    }
+    if message == "" {
+        message = http.StatusText(resp.StatusCode)
+    }
+    return &apiError{status: resp.StatusCode, message: message}
+}
+
+func (c *client) saveTokens(tokens tokenResponse) error {
+    c.cfg.AccessToken = tokens.AccessToken
+    c.cfg.RefreshToken = tokens.RefreshToken
+    c.cfg.ExpiresAt = tokens.ExpiresAt
+    return c.cfg.save()
+}
+
+// login exchanges a username and password for tokens and saves them.
+func (c *client) login(username, password string) error {
+    raw, _ := json.Marshal(map[string]string{"username": username, "password": password})
+    resp, err := c.http.Post(c.url("/auth/login"), "application/json", bytes.NewReader(raw))
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return responseError(resp)
+    }
+
+    var body struct {
+        Tokens tokenResponse `json:"tokens"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+        return err
+    }
+    c.cfg.Username = username
+    return c.saveTokens(body.Tokens)
+}
+
+// refresh trades the refresh token for new tokens.
+func (c *client) refresh() error {
+    if c.cfg.RefreshToken == "" {
+        return errNotLoggedIn
+    }
+    req, err := http.NewRequest(http.MethodPost, c.url("/auth/refresh"), nil)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Refresh-Token", c.cfg.RefreshToken)
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode == http.StatusUnauthorized {
+        return errors.New("session expired, run cloudbox login again")
+    }
+    if resp.StatusCode != http.StatusOK {
+        return responseError(resp)
+    }
+
+    var tokens tokenResponse
+    if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+        return err
+    }
+    return c.saveTokens(tokens)
+}
+
+// token returns an access token that will not expire for a while.
+func (c *client) token() (string, error) {
+    if c.cfg.AccessToken == "" {
+        return "", errNotLoggedIn
+    }
+    if time.Until(c.cfg.ExpiresAt) < tokenMargin {
+        if err := c.refresh(); err != nil {
+            return "", err
+        }
+    }
+    return c.cfg.AccessToken, nil
+}
+
+func (c *client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+    return http.NewRequest(method, c.url(path), body)
+}
+
+// do sends an authenticated request and turns error statuses into errors.
+// A request the server rejects as unauthenticated is retried once with
+// fresh tokens when its body can be replayed.
+func (c *client) do(req *http.Request) (*http.Response, error) {
+    token, err := c.token()
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Authorization", "Bearer "+token)
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode == http.StatusUnauthorized && (req.Body == nil || req.GetBody != nil) {
+        resp.Body.Close()
+        if err := c.refresh(); err != nil {
+            return nil, err
+        }
+        retry := req.Clone(req.Context())
+        if req.GetBody != nil {
+            if retry.Body, err = req.GetBody(); err != nil {
+                return nil, err
+            }
+        }
+        retry.Header.Set("Authorization", "Bearer "+c.cfg.AccessToken)
+        if resp, err = c.http.Do(retry); err != nil {
+            return nil, err
+        }
+    }
+
+    if resp.StatusCode >= 400 {
+        defer resp.Body.Close()
+        return nil, responseError(resp)
+    }
+    return resp, nil
+}
+
+// call sends in as JSON, when given, and decodes the response into out,
+// when given.
+func (c *client) call(method, path string, in, out interface{}) error {
+    var body io.Reader
+    if in != nil {
+        raw, err := json.Marshal(in)
+        if err != nil {
+            return err
+        }
+        body = bytes.NewReader(raw)
+    }
+    req, err := c.newRequest(method, path, body)
+    if err != nil {
+        return err
+    }
+    if in != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    resp, err := c.do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if out == nil {
+        return nil
+    }
+    return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// query builds a path with a query string.
+func query(path string, params url.Values) string {
+    if len(params) == 0 {
+        return path
+    }
+    return path + "?" + params.Encode()
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "flag"
+    "fmt"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "text/tabwriter"
+    "time"
+)
+
+// parseFlags parses a command's flags and checks how many arguments are
+// left, printing the command's usage line on a mistake.
+func parseFlags(fs *flag.FlagSet, args []string, usage string, min, max int) ([]string, error) {
+    fs.Usage = func() {
+        fmt.Fprintf(os.Stderr, "usage: cloudbox %s\n", usage)
+        fs.PrintDefaults()
+    }
+    if err := fs.Parse(args); err != nil {
+        return nil, err
+    }
+    rest := fs.Args()
+    if len(rest) < min || (max >= 0 && len(rest) > max) {
+        fs.Usage()
+        return nil, errors.New("wrong number of arguments")
+    }
+    return rest, nil
+}
+
+func readPassword() (string, error) {
+    if password := os.Getenv("CLOUDBOX_PASSWORD"); password != "" {
+        return password, nil
+    }
+    fmt.Fprint(os.Stderr, "Password: ")
+    line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+    if err != nil && line == "" {
+        return "", err
+    }
+    return strings.TrimRight(line, "\r\n"), nil
+}
+
+func cmdLogin(c *client, args []string) error {
+    fs := flag.NewFlagSet("login", flag.ContinueOnError)
+    server := fs.String("server", "", "URL of the CloudBox server")
+    rest, err := parseFlags(fs, args, "login [-server URL] <username>", 1, 1)
+    if err != nil {
+        return err
+    }
+    if *server != "" {
+        c.cfg.Server = strings.TrimRight(*server, "/")
+    }
+
+    password, err := readPassword()
+    if err != nil {
+        return err
+    }
+    if err := c.login(rest[0], password); err != nil {
+        return err
+    }
+    fmt.Printf("Logged in to %s as %s\n", c.cfg.Server, rest[0])
+    return nil
+}
+
+func cmdLogout(c *client, args []string) error {
+    if _, err := parseFlags(flag.NewFlagSet("logout", flag.ContinueOnError), args, "logout", 0, 0); err != nil {
+        return err
+    }
+    c.cfg.AccessToken, c.cfg.RefreshToken, c.cfg.ExpiresAt = "", "", time.Time{}
+    return c.cfg.save()
+}
+
+func cmdList(c *client, args []string) error {
+    fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+    long := fs.Bool("l", false, "show sizes, versions and dates")
+    rest, err := parseFlags(fs, args, "ls [-l] [remote folder]", 0, 1)
+    if err != nil {
+        return err
+    }
+    path := "/"
+    if len(rest) == 1 {
+        path = rest[0]
+    }
+
+    entry, err := c.lookup(path)
+    if err != nil {
+        return err
+    }
+    l := &listing{}
+    if entry.isDir() {
+        if l, err = c.listFolder(entry.folderID); err != nil {
+            return err
+        }
+    } else {
+        l.Files = []remoteFile{*entry.file}
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    for _, folder := range l.Folders {
+        if *long {
+            fmt.Fprintf(w, "-\t-\t%s\t%s/\n", folder.CreatedAt.Local().Format("2006-01-02 15:04"), folder.Name)
+        } else {
+            fmt.Fprintf(w, "%s/\n", folder.Name)
+        }
+    }
+    for _, file := range l.Files {
+        if *long {
+            fmt.Fprintf(w, "%s\tv%d\t%s\t%s\n", formatSize(file.FileSize), file.Version,
+                file.UploadDate.Local().Format("2006-01-02 15:04"), file.FileName)
+        } else {
+            fmt.Fprintln(w, file.FileName)
+        }
+    }
+    return w.Flush()
+}
+
+func cmdMkdir(c *client, args []string) error {
+    rest, err := parseFlags(flag.NewFlagSet("mkdir", flag.ContinueOnError), args, "mkdir <remote folder>", 1, 1)
+    if err != nil {
+        return err
+    }
+    _, err = c.mkdirAll(rest[0])
+    return err
+}
+
+func cmdUpload(c *client, args []string) error {
+    fs := flag.NewFlagSet("upload", flag.ContinueOnError)
+    to := fs.String("to", "/", "remote folder to upload into, created if missing")
+    rest, err := parseFlags(fs, args, "upload [-to remote folder] <local file>...", 1, -1)
+    if err != nil {
+        return err
+    }
+
+    folderID, err := c.mkdirAll(*to)
+    if err != nil {
+        return err
+    }
+    dir := joinRemote(splitRemote(*to)...)
+    for _, path := range rest {
+        file, err := c.upload(path, folderID, dir)
+        if err != nil {
+            return fmt.Errorf("%s: %w", path, err)
+        }
+        fmt.Printf("Uploaded %s to %s (version %d)\n", path, joinRemote(append(splitRemote(dir), file.FileName)...), file.Version)
+    }
+    return nil
+}
+
+func cmdDownload(c *client, args []string) error {
+    fs := flag.NewFlagSet("download", flag.ContinueOnError)
+    out := fs.String("o", "", "local file or directory to save to, the current directory by default")
+    rest, err := parseFlags(fs, args, "download [-o local path] <remote file>", 1, 1)
+    if err != nil {
+        return err
+    }
+
+    entry, err := c.lookup(rest[0])
+    if err != nil {
+        return err
+    }
+    if entry.isDir() {
+        return fmt.Errorf("%s is a folder", rest[0])
+    }
+    path := entry.file.FileName
+    if *out != "" {
+        path = *out
+        if info, err := os.Stat(path); err == nil && info.IsDir() {
+            path = filepath.Join(path, entry.file.FileName)
+        }
+    }
+    if err := c.download(entry.file, path); err != nil {
+        return err
+    }
+    fmt.Printf("Downloaded %s to %s\n", rest[0], path)
+    return nil
+}
+
+// remove deletes what entry names: a file goes to the trash, and a folder
+// is deleted with the files inside it going to the trash.
+func (c *client) remove(entry *remoteEntry) error {
+    switch {
+    case entry.file != nil:
+        return c.call(http.MethodDelete, filePath(entry.file.ID, ""), nil, nil)
+    case entry.folderID != nil:
+        return c.call(http.MethodDelete, folderPath(entry.folderID), nil, nil)
+    }
+    return errors.New("the root folder cannot be removed")
+}
+
+func cmdRemove(c *client, args []string) error {
+    rest, err := parseFlags(flag.NewFlagSet("rm", flag.ContinueOnError), args, "rm <remote path>...", 1, -1)
+    if err != nil {
+        return err
+    }
+    for _, path := range rest {
+        entry, err := c.lookup(path)
+        if err == nil {
+            err = c.remove(entry)
+        }
+        if err != nil {
+            return fmt.Errorf("%s: %w", path, err)
+        }
+    }
+    return nil
+}
+
+// cmdMove moves and renames files and folders. Moving onto an existing
+// folder moves into it, keeping the name.
+func cmdMove(c *client, args []string) error {
+    rest, err := parseFlags(flag.NewFlagSet("mv", flag.ContinueOnError), args, "mv <remote path> <remote destination>", 2, 2)
+    if err != nil {
+        return err
+    }
+    src, err := c.lookup(rest[0])
+    if err != nil {
+        return err
+    }
+    if src.isDir() && src.folderID == nil {
+        return errors.New("the root folder cannot be moved")
+    }
+
+    segments := splitRemote(rest[0])
+    name := segments[len(segments)-1]
+    var destID *uint
+    if dest, err := c.lookup(rest[1]); err == nil && dest.isDir() {
+        destID = dest.folderID
+    } else if err != nil && !errors.Is(err, errNotFound) {
+        return err
+    } else {
+        target := splitRemote(rest[1])
+        if len(target) == 0 {
+            return errors.New("invalid destination")
+        }
+        if destID, err = c.findFolder(joinRemote(target[:len(target)-1]...)); err != nil {
+            return err
+        }
+        name = target[len(target)-1]
+    }
+
+    if src.file != nil {
+        if !sameFolder(src.file.FolderID, destID) {
+            if err := c.call(http.MethodPost, filePath(src.file.ID, "/move"), map[string]interface{}{"folder_id": destID}, nil); err != nil {
+                return err
+            }
+        }
+        if name != src.file.FileName {
+            return c.call(http.MethodPatch, filePath(src.file.ID, ""), map[string]string{"file_name": name}, nil)
+        }
+        return nil
+    }
+
+    if err := c.call(http.MethodPost, folderPath(src.folderID)+"/move", map[string]interface{}{"folder_id": destID}, nil); err != nil {
+        return err
+    }
+    if name != segments[len(segments)-1] {
+        return c.call(http.MethodPatch, folderPath(src.folderID), map[string]string{"name": name}, nil)
+    }
+    return nil
+}
+
+type share struct {
+    ShareToken  string     `json:"share_token"`
+    ShareURL    string     `json:"share_url"`
+    ExpiresAt   time.Time  `json:"expires_at"`
+    AccessCount int        `json:"access_count"`
+    File        remoteFile `json:"File"`
+}
+
+func cmdShare(c *client, args []string) error {
+    if len(args) == 0 {
+        return errors.New("usage: cloudbox share create|list|revoke")
+    }
+    switch args[0] {
+    case "create":
+        fs := flag.NewFlagSet("share create", flag.ContinueOnError)
+        expires := fs.Int("expires", 0, "hours until the link expires, 0 for never")
+        rest, err := parseFlags(fs, args[1:], "share create [-expires hours] <remote file>", 1, 1)
+        if err != nil {
+            return err
+        }
+        entry, err := c.lookup(rest[0])
+        if err != nil {
+            return err
+        }
+        if entry.isDir() {
+            return fmt.Errorf("%s is a folder, only files can be shared", rest[0])
+        }
+        var created share
+        req := map[string]interface{}{"file_id": entry.file.ID, "expires_in": *expires}
+        if err := c.call(http.MethodPost, "/api/shares", req, &created); err != nil {
+            return err
+        }
+        fmt.Println(c.url(created.ShareURL))
+        return nil
+
+    case "list":
+        if _, err := parseFlags(flag.NewFlagSet("share list", flag.ContinueOnError), args[1:], "share list", 0, 0); err != nil {
+            return err
+        }
+        var shares []share
+        if err := c.call(http.MethodGet, "/api/shares", nil, &shares); err != nil {
+            return err
+        }
+        w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+        fmt.Fprintln(w, "TOKEN\tFILE\tEXPIRES\tACCESSES")
+        for _, s := range shares {
+            fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.ShareToken, s.File.FileName,
+                s.ExpiresAt.Local().Format("2006-01-02 15:04"), strconv.Itoa(s.AccessCount))
+        }
+        return w.Flush()
+
+    case "revoke":
+        rest, err := parseFlags(flag.NewFlagSet("share revoke", flag.ContinueOnError), args[1:], "share revoke <token>", 1, 1)
+        if err != nil {
+            return err
+        }
+        return c.call(http.MethodDelete, "/api/shares/"+rest[0], nil, nil)
+    }
+    return fmt.Errorf("unknown share command %q", args[0])
+}
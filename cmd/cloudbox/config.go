@@ -0,0 +1,89 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+const DefaultServer = "http://localhost:8080"
+
+// config is what the CLI keeps between runs: the server it talks to and
+// the tokens from the last login.
+type config struct {
+    Server       string    `json:"server"`
+    Username     string    `json:"username,omitempty"`
+    AccessToken  string    `json:"access_token,omitempty"`
+    RefreshToken string    `json:"refresh_token,omitempty"`
+    ExpiresAt    time.Time `json:"expires_at,omitempty"`
+}
+
+// configDir returns where the CLI keeps its files, CLOUDBOX_CONFIG_DIR
+// when set and a cloudbox folder in the user's config directory otherwise.
+func configDir() (string, error) {
+    if dir := os.Getenv("CLOUDBOX_CONFIG_DIR"); dir != "" {
+        return dir, nil
+    }
+    dir, err := os.UserConfigDir()
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, "cloudbox"), nil
+}
+
+// readJSON decodes the file name in the config directory into v, leaving
+// v alone when the file does not exist yet.
+func readJSON(name string, v interface{}) error {
+    dir, err := configDir()
+    if err != nil {
+        return err
+    }
+    raw, err := os.ReadFile(filepath.Join(dir, name))
+    if errors.Is(err, os.ErrNotExist) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(raw, v)
+}
+
+// writeJSON replaces the file name in the config directory with v. The
+// files hold tokens, so only the user can read them.
+func writeJSON(name string, v interface{}) error {
+    dir, err := configDir()
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(dir, 0o700); err != nil {
+        return err
+    }
+    raw, err := json.MarshalIndent(v, "", "  ")
+    if err != nil {
+        return err
+    }
+    tmp := filepath.Join(dir, name+".tmp")
+    if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+// loadConfig reads the saved config. CLOUDBOX_SERVER overrides the saved
+// server.
+func loadConfig() (*config, error) {
+    cfg := &config{Server: DefaultServer}
+    if err := readJSON("config.json", cfg); err != nil {
+        return nil, err
+    }
+    if server := os.Getenv("CLOUDBOX_SERVER"); server != "" {
+        cfg.Server = server
+    }
+    return cfg, nil
+}
+
+func (cfg *config) save() error {
+    return writeJSON("config.json", cfg)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "fmt"
+    "os"
+)
+
+const usage = `cloudbox is the command-line client for CloudBox.
+
+Usage:
+    cloudbox login [-server URL] <username>
+    cloudbox logout
+    cloudbox ls [-l] [remote folder]
+    cloudbox mkdir <remote folder>
+    cloudbox upload [-to remote folder] <local file>...
+    cloudbox download [-o local path] <remote file>
+    cloudbox rm <remote path>...
+    cloudbox mv <remote path> <remote destination>
+    cloudbox share create [-expires hours] <remote file>
+    cloudbox share list
+    cloudbox share revoke <token>
+    cloudbox sync [-dry-run] <local dir> <remote folder>
+
+Remote paths start at the root of your drive, such as /docs/report.pdf.
+The server defaults to ` + DefaultServer + ` and can be set with -server on login
+or the CLOUDBOX_SERVER environment variable. The password is read from
+CLOUDBOX_PASSWORD when set, and asked for otherwise.
+`
+
+// commands maps each command to the function running it. They receive the
+// arguments after the command name.
+var commands = map[string]func(c *client, args []string) error{
+    "login":    cmdLogin,
+    "logout":   cmdLogout,
+    "ls":       cmdList,
+    "mkdir":    cmdMkdir,
+    "upload":   cmdUpload,
+    "download": cmdDownload,
+    "rm":       cmdRemove,
+    "mv":       cmdMove,
+    "share":    cmdShare,
+    "sync":     cmdSync,
+}
+
+func main() {
+    if len(os.Args) < 2 || os.Args[1] == "-h" || os.Args[1] == "-help" || os.Args[1] == "help" {
+        fmt.Fprint(os.Stderr, usage)
+        os.Exit(2)
+    }
+    run, ok := commands[os.Args[1]]
+    if !ok {
+        fmt.Fprintf(os.Stderr, "cloudbox: unknown command %q\n\n%s", os.Args[1], usage)
+        os.Exit(2)
+    }
+
+    cfg, err := loadConfig()
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "cloudbox: failed to read config: %v\n", err)
+        os.Exit(1)
+    }
+    if err := run(newClient(cfg), os.Args[2:]); err != nil {
+        fmt.Fprintf(os.Stderr, "cloudbox %s: %v\n", os.Args[1], err)
+        os.Exit(1)
+    }
+}
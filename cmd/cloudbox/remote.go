@@ -0,0 +1,158 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+var errNotFound = errors.New("no such file or folder")
+
+type remoteFile struct {
+    ID          uint      `json:"ID"`
+    FolderID    *uint     `json:"folder_id"`
+    FileName    string    `json:"file_name"`
+    FileSize    int64     `json:"file_size"`
+    ContentType string    `json:"content_type"`
+    UploadDate  time.Time `json:"upload_date"`
+    Version     int       `json:"version"`
+    SHA256      string    `json:"sha256"`
+}
+
+type remoteFolder struct {
+    ID        uint      `json:"ID"`
+    CreatedAt time.Time `json:"CreatedAt"`
+    Name      string    `json:"name"`
+    ParentID  *uint     `json:"parent_id"`
+}
+
+// listing is the content of one remote folder, as ListFolder returns it.
+type listing struct {
+    FolderID *uint          `json:"folder_id"`
+    Path     string         `json:"path"`
+    Folders  []remoteFolder `json:"folders"`
+    Files    []remoteFile   `json:"files"`
+}
+
+// remoteEntry is what a remote path names: a folder, with a nil folderID
+// for the root, or a file.
+type remoteEntry struct {
+    folderID *uint
+    file     *remoteFile
+}
+
+func (e *remoteEntry) isDir() bool { return e.file == nil }
+
+// splitRemote breaks a remote path into its segments. Remote paths are
+// always taken from the root, with or without a leading slash.
+func splitRemote(path string) []string {
+    var segments []string
+    for _, segment := range strings.Split(path, "/") {
+        if segment != "" && segment != "." {
+            segments = append(segments, segment)
+        }
+    }
+    return segments
+}
+
+func joinRemote(segments ...string) string {
+    return "/" + strings.Join(segments, "/")
+}
+
+func folderPath(id *uint) string {
+    if id == nil {
+        return "/api/folders"
+    }
+    return "/api/folders/" + strconv.FormatUint(uint64(*id), 10)
+}
+
+func filePath(id uint, suffix string) string {
+    return "/api/files/" + strconv.FormatUint(uint64(id), 10) + suffix
+}
+
+func (c *client) listFolder(id *uint) (*listing, error) {
+    var l listing
+    if err := c.call(http.MethodGet, folderPath(id), nil, &l); err != nil {
+        return nil, err
+    }
+    return &l, nil
+}
+
+// childFolder returns the folder called name in l, if any.
+func (l *listing) childFolder(name string) *remoteFolder {
+    for i := range l.Folders {
+        if l.Folders[i].Name == name {
+            return &l.Folders[i]
+        }
+    }
+    return nil
+}
+
+func (l *listing) childFile(name string) *remoteFile {
+    for i := range l.Files {
+        if l.Files[i].FileName == name {
+            return &l.Files[i]
+        }
+    }
+    return nil
+}
+
+// lookup walks path from the root. A folder wins over a file of the same
+// name, as it does on the server's other interfaces.
+func (c *client) lookup(path string) (*remoteEntry, error) {
+    segments := splitRemote(path)
+    var folderID *uint
+    for i, name := range segments {
+        l, err := c.listFolder(folderID)
+        if err != nil {
+            return nil, err
+        }
+        if folder := l.childFolder(name); folder != nil {
+            folderID = &folder.ID
+            continue
+        }
+        if file := l.childFile(name); file != nil && i == len(segments)-1 {
+            return &remoteEntry{file: file}, nil
+        }
+        return nil, fmt.Errorf("%s: %w", path, errNotFound)
+    }
+    return &remoteEntry{folderID: folderID}, nil
+}
+
+// findFolder returns the ID of the folder path names.
+func (c *client) findFolder(path string) (*uint, error) {
+    entry, err := c.lookup(path)
+    if err != nil {
+        return nil, err
+    }
+    if !entry.isDir() {
+        return nil, fmt.Errorf("%s: not a folder", path)
+    }
+    return entry.folderID, nil
+}
+
+// mkdirAll returns the ID of the folder path names, creating it and any
+// missing parents.
+func (c *client) mkdirAll(path string) (*uint, error) {
+    var folderID *uint
+    for _, name := range splitRemote(path) {
+        l, err := c.listFolder(folderID)
+        if err != nil {
+            return nil, err
+        }
+        if folder := l.childFolder(name); folder != nil {
+            folderID = &folder.ID
+            continue
+        }
+        var created remoteFolder
+        req := map[string]interface{}{"name": name, "parent_id": folderID}
+        if err := c.call(http.MethodPost, "/api/folders", req, &created); err != nil {
+            return nil, err
+        }
+        folderID = &created.ID
+    }
+    return folderID, nil
+}
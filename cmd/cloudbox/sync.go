@@ -0,0 +1,478 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io/fs"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+// syncStateFile is kept at the top of a synced directory. It records what
+// both sides held after the last sync, which is how a sync tells a file
+// added on one side from one deleted on the other.
+const syncStateFile = ".cloudbox-sync.json"
+
+type syncedFile struct {
+    Size    int64     `json:"size"`
+    ModTime time.Time `json:"mod_time"`
+    SHA256  string    `json:"sha256"`
+    FileID  uint      `json:"file_id"`
+}
+
+type syncState struct {
+    Server string                `json:"server"`
+    Remote string                `json:"remote"`
+    Files  map[string]syncedFile `json:"files"`
+    Dirs   map[string]bool       `json:"dirs"`
+}
+
+type localFile struct {
+    path    string
+    size    int64
+    modTime time.Time
+    sha256  string // filled in on demand
+}
+
+func (f *localFile) hash() (string, error) {
+    if f.sha256 == "" {
+        sum, err := hashFile(f.path)
+        if err != nil {
+            return "", err
+        }
+        f.sha256 = sum
+    }
+    return f.sha256, nil
+}
+
+// syncer runs one two-way sync between a local directory and a remote
+// folder. Paths are relative to both, slash separated.
+type syncer struct {
+    c      *client
+    local  string
+    remote string
+    dryRun bool
+    state  *syncState
+
+    localFiles  map[string]*localFile
+    localDirs   map[string]bool
+    remoteFiles map[string]*remoteFile
+    remoteDirs  map[string]*uint
+}
+
+func loadSyncState(dir string) (*syncState, error) {
+    state := &syncState{}
+    raw, err := os.ReadFile(filepath.Join(dir, syncStateFile))
+    if err != nil && !errors.Is(err, os.ErrNotExist) {
+        return nil, err
+    }
+    if err == nil {
+        if err := json.Unmarshal(raw, state); err != nil {
+            return nil, fmt.Errorf("%s is corrupt: %w", syncStateFile, err)
+        }
+    }
+    if state.Files == nil {
+        state.Files = map[string]syncedFile{}
+    }
+    if state.Dirs == nil {
+        state.Dirs = map[string]bool{}
+    }
+    return state, nil
+}
+
+func (s *syncer) saveState() error {
+    if s.dryRun {
+        return nil
+    }
+    raw, err := json.MarshalIndent(s.state, "", "  ")
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(filepath.Join(s.local, syncStateFile), raw, 0o600)
+}
+
+func (s *syncer) scanLocal() error {
+    s.localFiles, s.localDirs = map[string]*localFile{}, map[string]bool{}
+    return filepath.WalkDir(s.local, func(p string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        rel, err := filepath.Rel(s.local, p)
+        if err != nil || rel == "." {
+            return err
+        }
+        rel = filepath.ToSlash(rel)
+        if d.IsDir() {
+            s.localDirs[rel] = true
+            return nil
+        }
+        // Skip our own bookkeeping and anything that is not a regular file
+        if rel == syncStateFile || strings.HasSuffix(rel, ".part") || !d.Type().IsRegular() {
+            return nil
+        }
+        info, err := d.Info()
+        if err != nil {
+            return err
+        }
+        s.localFiles[rel] = &localFile{path: p, size: info.Size(), modTime: info.ModTime()}
+        return nil
+    })
+}
+
+func (s *syncer) scanRemote(folderID *uint, prefix string) error {
+    l, err := s.c.listFolder(folderID)
+    if err != nil {
+        return err
+    }
+    for i := range l.Files {
+        s.remoteFiles[path.Join(prefix, l.Files[i].FileName)] = &l.Files[i]
+    }
+    for _, folder := range l.Folders {
+        rel := path.Join(prefix, folder.Name)
+        id := folder.ID
+        s.remoteDirs[rel] = &id
+        if err := s.scanRemote(&id, rel); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// remoteDir returns the ID of the remote folder for the relative directory
+// dir, creating it and its parents as needed.
+func (s *syncer) remoteDir(dir string) (*uint, error) {
+    if dir == "." || dir == "" {
+        return s.remoteDirs[""], nil
+    }
+    if id, ok := s.remoteDirs[dir]; ok {
+        return id, nil
+    }
+    parentID, err := s.remoteDir(path.Dir(dir))
+    if err != nil {
+        return nil, err
+    }
+    var created remoteFolder
+    req := map[string]interface{}{"name": path.Base(dir), "parent_id": parentID}
+    if err := s.c.call(http.MethodPost, "/api/folders", req, &created); err != nil {
+        return nil, err
+    }
+    s.remoteDirs[dir] = &created.ID
+    return &created.ID, nil
+}
+
+func (s *syncer) remotePath(rel string) string {
+    return joinRemote(append(splitRemote(s.remote), splitRemote(rel)...)...)
+}
+
+func (s *syncer) localPath(rel string) string {
+    return filepath.Join(s.local, filepath.FromSlash(rel))
+}
+
+// record notes that rel is the same on both sides.
+func (s *syncer) record(rel string, file *remoteFile) error {
+    info, err := os.Stat(s.localPath(rel))
+    if err != nil {
+        return err
+    }
+    s.state.Files[rel] = syncedFile{Size: info.Size(), ModTime: info.ModTime(), SHA256: file.SHA256, FileID: file.ID}
+    return nil
+}
+
+func (s *syncer) upload(rel string) error {
+    fmt.Printf("upload    %s\n", rel)
+    if s.dryRun {
+        return nil
+    }
+    folderID, err := s.remoteDir(path.Dir(rel))
+    if err != nil {
+        return err
+    }
+    file, err := s.c.upload(s.localPath(rel), folderID, s.remotePath(path.Dir(rel)))
+    if err != nil {
+        return err
+    }
+    return s.record(rel, file)
+}
+
+func (s *syncer) download(rel string, file *remoteFile) error {
+    fmt.Printf("download  %s\n", rel)
+    if s.dryRun {
+        return nil
+    }
+    local := s.localPath(rel)
+    if err := os.MkdirAll(filepath.Dir(local), 0o755); err != nil {
+        return err
+    }
+    if err := s.c.download(file, local); err != nil {
+        return err
+    }
+    return s.record(rel, file)
+}
+
+func (s *syncer) deleteLocal(rel string) error {
+    fmt.Printf("delete    %s (local)\n", rel)
+    delete(s.state.Files, rel)
+    if s.dryRun {
+        return nil
+    }
+    return os.Remove(s.localPath(rel))
+}
+
+func (s *syncer) deleteRemote(rel string, file *remoteFile) error {
+    fmt.Printf("delete    %s (remote)\n", rel)
+    delete(s.state.Files, rel)
+    if s.dryRun {
+        return nil
+    }
+    return s.c.call(http.MethodDelete, filePath(file.ID, ""), nil, nil)
+}
+
+// conflict keeps both versions of a file changed on both sides: the local
+// one is renamed to a conflict copy and uploaded, and the remote one is
+// downloaded in its place.
+func (s *syncer) conflict(rel string, file *remoteFile) error {
+    ext := path.Ext(rel)
+    copyRel := fmt.Sprintf("%s (conflict %s)%s", strings.TrimSuffix(rel, ext), time.Now().Format("2006-01-02 150405"), ext)
+    fmt.Printf("conflict  %s, local copy kept as %s\n", rel, path.Base(copyRel))
+    if s.dryRun {
+        return nil
+    }
+    if err := os.Rename(s.localPath(rel), s.localPath(copyRel)); err != nil {
+        return err
+    }
+    if err := s.upload(copyRel); err != nil {
+        return err
+    }
+    return s.download(rel, file)
+}
+
+// syncFile brings one path in line on both sides, comparing each side with
+// what the last sync left.
+func (s *syncer) syncFile(rel string) error {
+    local, remote := s.localFiles[rel], s.remoteFiles[rel]
+    last, known := s.state.Files[rel]
+
+    localChanged := false
+    if local != nil {
+        localChanged = !known
+        if known && (local.size != last.Size || !local.modTime.Equal(last.ModTime)) {
+            // Touched files whose content is the same are not changes
+            sum, err := local.hash()
+            if err != nil {
+                return err
+            }
+            localChanged = sum != last.SHA256
+        }
+    }
+    remoteChanged := remote != nil && (!known || remote.ID != last.FileID || remote.SHA256 != last.SHA256)
+
+    switch {
+    case local != nil && remote != nil:
+        if !localChanged && !remoteChanged {
+            return nil
+        }
+        if localChanged && remoteChanged {
+            // Both sides may have made the same change
+            sum, err := local.hash()
+            if err != nil {
+                return err
+            }
+            if sum == remote.SHA256 {
+                return s.record(rel, remote)
+            }
+            return s.conflict(rel, remote)
+        }
+        if localChanged {
+            return s.upload(rel)
+        }
+        return s.download(rel, remote)
+
+    case local != nil:
+        // New here, or changed here after being deleted there
+        if !known || localChanged {
+            return s.upload(rel)
+        }
+        return s.deleteLocal(rel)
+
+    case remote != nil:
+        if !known || remoteChanged {
+            return s.download(rel, remote)
+        }
+        return s.deleteRemote(rel, remote)
+    }
+
+    delete(s.state.Files, rel)
+    return nil
+}
+
+// syncDirs creates directories that exist on one side only, and removes
+// directories deleted on one side from the other when nothing is left in
+// them.
+func (s *syncer) syncDirs() error {
+    dirs := map[string]bool{}
+    for dir := range s.localDirs {
+        dirs[dir] = true
+    }
+    for dir := range s.remoteDirs {
+        if dir != "" {
+            dirs[dir] = true
+        }
+    }
+    for dir := range s.state.Dirs {
+        dirs[dir] = true
+    }
+    sorted := make([]string, 0, len(dirs))
+    for dir := range dirs {
+        sorted = append(sorted, dir)
+    }
+    // Deepest first, so children are removed before their parents
+    sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+
+    for _, dir := range sorted {
+        _, remote := s.remoteDirs[dir]
+        local, known := s.localDirs[dir], s.state.Dirs[dir]
+        delete(s.state.Dirs, dir)
+        switch {
+        case local && remote:
+            s.state.Dirs[dir] = true
+        case local && known:
+            // Deleted there, so removed here unless something was added
+            // to it since, in which case it is recreated there
+            if s.dryRun || os.Remove(s.localPath(dir)) == nil {
+                fmt.Printf("delete    %s/ (local)\n", dir)
+                continue
+            }
+            if _, err := s.remoteDir(dir); err != nil {
+                return err
+            }
+            s.state.Dirs[dir] = true
+        case remote && known:
+            l, err := s.c.listFolder(s.remoteDirs[dir])
+            if err != nil {
+                return err
+            }
+            if len(l.Files) == 0 && len(l.Folders) == 0 {
+                fmt.Printf("delete    %s/ (remote)\n", dir)
+                if s.dryRun {
+                    continue
+                }
+                if err := s.c.call(http.MethodDelete, folderPath(s.remoteDirs[dir]), nil, nil); err != nil {
+                    return err
+                }
+                continue
+            }
+            if !s.dryRun {
+                if err := os.MkdirAll(s.localPath(dir), 0o755); err != nil {
+                    return err
+                }
+            }
+            s.state.Dirs[dir] = true
+        case local:
+            if !s.dryRun {
+                if _, err := s.remoteDir(dir); err != nil {
+                    return err
+                }
+            }
+            s.state.Dirs[dir] = true
+        case remote:
+            if !s.dryRun {
+                if err := os.MkdirAll(s.localPath(dir), 0o755); err != nil {
+                    return err
+                }
+            }
+            s.state.Dirs[dir] = true
+        }
+    }
+    return nil
+}
+
+// cmdSync makes a local directory and a remote folder hold the same files.
+// Changes on either side since the last sync are copied to the other,
+// deletions included. A file changed on both sides keeps the remote
+// version under its name and the local one as a conflict copy.
+func cmdSync(c *client, args []string) error {
+    flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+    dryRun := flags.Bool("dry-run", false, "print what would be done without doing it")
+    rest, err := parseFlags(flags, args, "sync [-dry-run] <local dir> <remote folder>", 2, 2)
+    if err != nil {
+        return err
+    }
+    local, err := filepath.Abs(rest[0])
+    if err != nil {
+        return err
+    }
+    if info, err := os.Stat(local); err != nil || !info.IsDir() {
+        return fmt.Errorf("%s is not a directory", rest[0])
+    }
+    remote := joinRemote(splitRemote(rest[1])...)
+
+    state, err := loadSyncState(local)
+    if err != nil {
+        return err
+    }
+    // A directory synced with another folder starts over, so nothing is
+    // taken for deleted
+    if state.Server != c.cfg.Server || state.Remote != remote {
+        state = &syncState{Server: c.cfg.Server, Remote: remote, Files: map[string]syncedFile{}, Dirs: map[string]bool{}}
+    }
+
+    s := &syncer{c: c, local: local, remote: remote, dryRun: *dryRun, state: state,
+        remoteFiles: map[string]*remoteFile{}, remoteDirs: map[string]*uint{}}
+    root, err := c.mkdirAll(remote)
+    if err != nil {
+        return err
+    }
+    s.remoteDirs[""] = root
+    if err := s.scanRemote(root, ""); err != nil {
+        return err
+    }
+    if err := s.scanLocal(); err != nil {
+        return err
+    }
+
+    paths := map[string]bool{}
+    for rel := range s.localFiles {
+        paths[rel] = true
+    }
+    for rel := range s.remoteFiles {
+        paths[rel] = true
+    }
+    for rel := range s.state.Files {
+        paths[rel] = true
+    }
+    sorted := make([]string, 0, len(paths))
+    for rel := range paths {
+        sorted = append(sorted, rel)
+    }
+    sort.Strings(sorted)
+
+    // Keep going past a failed file so one problem does not hold up the
+    // rest; the state is saved as far as it got either way
+    var failed int
+    for _, rel := range sorted {
+        if err := s.syncFile(rel); err != nil {
+            fmt.Fprintf(os.Stderr, "%s: %v\n", rel, err)
+            failed++
+        }
+    }
+    if failed == 0 {
+        if err := s.syncDirs(); err != nil {
+            s.saveState()
+            return err
+        }
+    }
+    if err := s.saveState(); err != nil {
+        return err
+    }
+    if failed > 0 {
+        return fmt.Errorf("%d files could not be synced", failed)
+    }
+    return nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    tusVersion = "1.0.0"
+
+    // ChunkSize is how much of an upload is sent per request. A dropped
+    // connection costs at most one chunk.
+    ChunkSize = 8 << 20
+
+    // maxTransferRetries is how many failed requests in a row a transfer
+    // survives before giving up.
+    maxTransferRetries = 5
+)
+
+// pendingUpload remembers a tus upload so a later run can resume it, for
+// as long as the local file is unchanged.
+type pendingUpload struct {
+    URL      string    `json:"url"`
+    Size     int64     `json:"size"`
+    ModTime  time.Time `json:"mod_time"`
+    FolderID *uint     `json:"folder_id"`
+}
+
+func loadPendingUploads() (map[string]pendingUpload, error) {
+    pending := map[string]pendingUpload{}
+    return pending, readJSON("uploads.json", &pending)
+}
+
+func savePendingUpload(path string, upload *pendingUpload) error {
+    pending, err := loadPendingUploads()
+    if err != nil {
+        return err
+    }
+    if upload == nil {
+        delete(pending, path)
+    } else {
+        pending[path] = *upload
+    }
+    return writeJSON("uploads.json", pending)
+}
+
+func formatSize(n int64) string {
+    const unit = 1024
+    if n < unit {
+        return fmt.Sprintf("%d B", n)
+    }
+    div, exp := int64(unit), 0
+    for m := n / unit; m >= unit; m /= unit {
+        div *= unit
+        exp++
+    }
+    return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// progress reports a transfer on stderr when it is a terminal, redrawing
+// one line at most a few times a second.
+type progress struct {
+    name  string
+    total int64
+    done  int64
+    shown time.Time
+    tty   bool
+}
+
+func newProgress(name string, total, done int64) *progress {
+    info, err := os.Stderr.Stat()
+    return &progress{name: name, total: total, done: done, tty: err == nil && info.Mode()&os.ModeCharDevice != 0}
+}
+
+func (p *progress) add(n int64) {
+    p.done += n
+    if p.tty && time.Since(p.shown) > 200*time.Millisecond {
+        p.draw()
+    }
+}
+
+func (p *progress) draw() {
+    p.shown = time.Now()
+    percent := 100
+    if p.total > 0 {
+        percent = int(p.done * 100 / p.total)
+    }
+    fmt.Fprintf(os.Stderr, "\r%-40.40s %10s / %-10s %3d%%", p.name, formatSize(p.done), formatSize(p.total), percent)
+}
+
+func (p *progress) finish() {
+    if p.tty {
+        p.draw()
+        fmt.Fprintln(os.Stderr)
+    }
+}
+
+// progressWriter counts what passes through it towards p.
+type progressWriter struct {
+    w io.Writer
+    p *progress
+}
+
+func (pw progressWriter) Write(b []byte) (int, error) {
+    n, err := pw.w.Write(b)
+    pw.p.add(int64(n))
+    return n, err
+}
+
+func hashFile(path string) (string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    h := sha256.New()
+    if _, err := io.Copy(h, f); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func tusMetadata(values map[string]string) string {
+    var pairs []string
+    for key, value := range values {
+        pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+    }
+    return strings.Join(pairs, ",")
+}
+
+// tusOffset asks the server how much of an upload it has.
+func (c *client) tusOffset(uploadURL string) (int64, error) {
+    req, err := c.newRequest(http.MethodHead, uploadURL, nil)
+    if err != nil {
+        return 0, err
+    }
+    req.Header.Set("Tus-Resumable", tusVersion)
+    resp, err := c.do(req)
+    if err != nil {
+        return 0, err
+    }
+    resp.Body.Close()
+    return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// tusCreate starts a tus upload of name into folderID and returns its URL.
+func (c *client) tusCreate(name string, size int64, folderID *uint, sum string) (string, error) {
+    meta := map[string]string{"filename": name, "sha256": sum}
+    if folderID != nil {
+        meta["folder_id"] = strconv.FormatUint(uint64(*folderID), 10)
+    }
+    req, err := c.newRequest(http.MethodPost, "/api/files/tus", nil)
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Tus-Resumable", tusVersion)
+    req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+    req.Header.Set("Upload-Metadata", tusMetadata(meta))
+    resp, err := c.do(req)
+    if err != nil {
+        return "", err
+    }
+    resp.Body.Close()
+    location := resp.Header.Get("Location")
+    if location == "" {
+        return "", errors.New("server did not return an upload location")
+    }
+    return location, nil
+}
+
+// tusPatch sends one chunk at offset, with its checksum so a corrupted
+// chunk is refused rather than stored.
+func (c *client) tusPatch(uploadURL string, offset int64, chunk []byte) error {
+    req, err := c.newRequest(http.MethodPatch, uploadURL, bytes.NewReader(chunk))
+    if err != nil {
+        return err
+    }
+    sum := sha256.Sum256(chunk)
+    req.Header.Set("Tus-Resumable", tusVersion)
+    req.Header.Set("Content-Type", "application/offset+octet-stream")
+    req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+    req.Header.Set("Upload-Checksum", "sha256 "+base64.StdEncoding.EncodeToString(sum[:]))
+    resp, err := c.do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    return nil
+}
+
+// upload sends the local file at path into the remote folder folderID,
+// whose path is dir, and returns the file it became. An upload of the same
+// unchanged file interrupted earlier is resumed where it stopped. A file
+// of the same name gets a new version.
+func (c *client) upload(path string, folderID *uint, dir string) (*remoteFile, error) {
+    abs, err := filepath.Abs(path)
+    if err != nil {
+        return nil, err
+    }
+    info, err := os.Stat(abs)
+    if err != nil {
+        return nil, err
+    }
+    if info.IsDir() {
+        return nil, fmt.Errorf("%s is a directory", path)
+    }
+    name := filepath.Base(abs)
+
+    pending, err := loadPendingUploads()
+    if err != nil {
+        return nil, err
+    }
+    var uploadURL string
+    offset := int64(0)
+    if p, ok := pending[abs]; ok && p.Size == info.Size() && p.ModTime.Equal(info.ModTime()) && sameFolder(p.FolderID, folderID) {
+        if offset, err = c.tusOffset(p.URL); err == nil {
+            uploadURL = p.URL
+        } else {
+            offset = 0
+        }
+    }
+    if uploadURL == "" {
+        sum, err := hashFile(abs)
+        if err != nil {
+            return nil, err
+        }
+        if uploadURL, err = c.tusCreate(name, info.Size(), folderID, sum); err != nil {
+            return nil, err
+        }
+        if err := savePendingUpload(abs, &pendingUpload{URL: uploadURL, Size: info.Size(), ModTime: info.ModTime(), FolderID: folderID}); err != nil {
+            return nil, err
+        }
+    }
+
+    f, err := os.Open(abs)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    bar := newProgress(name, info.Size(), offset)
+    chunk := make([]byte, ChunkSize)
+    failures := 0
+    for offset < info.Size() {
+        n, err := f.ReadAt(chunk, offset)
+        if err != nil && !errors.Is(err, io.EOF) {
+            return nil, err
+        }
+        if err := c.tusPatch(uploadURL, offset, chunk[:n]); err != nil {
+            // A refused upload cannot be resumed; anything else is retried
+            // from wherever the server says it got to
+            var apiErr *apiError
+            if errors.As(err, &apiErr) && apiErr.status != http.StatusConflict && apiErr.status < 500 {
+                savePendingUpload(abs, nil)
+                return nil, err
+            }
+            if failures++; failures > maxTransferRetries {
+                return nil, fmt.Errorf("upload interrupted, run the command again to resume: %w", err)
+            }
+            time.Sleep(time.Duration(failures) * time.Second)
+            if current, err := c.tusOffset(uploadURL); err == nil {
+                bar.add(current - offset)
+                offset = current
+            }
+            continue
+        }
+        failures = 0
+        offset += int64(n)
+        bar.add(int64(n))
+    }
+    bar.finish()
+    savePendingUpload(abs, nil)
+
+    var file remoteFile
+    remotePath := strings.TrimRight(dir, "/") + "/" + name
+    if err := c.call(http.MethodGet, query("/api/files/resolve", url.Values{"path": {remotePath}}), nil, &file); err != nil {
+        return nil, err
+    }
+    return &file, nil
+}
+
+func sameFolder(a, b *uint) bool {
+    if a == nil || b == nil {
+        return a == b
+    }
+    return *a == *b
+}
+
+// download saves a remote file at path. The bytes go to path.part first,
+// so an interrupted download resumes from there and an incomplete file
+// never takes the place of a good one. The content is checked against its
+// SHA-256 when the server knows it.
+func (c *client) download(file *remoteFile, path string) error {
+    var link struct {
+        DownloadURL string `json:"download_url"`
+    }
+    if err := c.call(http.MethodGet, "/api/files/download/"+strconv.FormatUint(uint64(file.ID), 10), nil, &link); err != nil {
+        return err
+    }
+
+    partial := path + ".part"
+    out, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0o644)
+    if err != nil {
+        return err
+    }
+    defer out.Close()
+    offset, err := out.Seek(0, io.SeekEnd)
+    if err != nil {
+        return err
+    }
+    if offset > file.FileSize {
+        offset = 0
+    }
+    if offset > 0 && offset == file.FileSize {
+        out.Close()
+        return finishDownload(file, partial, path)
+    }
+
+    req, err := http.NewRequest(http.MethodGet, c.url(link.DownloadURL), nil)
+    if err != nil {
+        return err
+    }
+    if offset > 0 {
+        req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+    }
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    switch resp.StatusCode {
+    case http.StatusPartialContent:
+    case http.StatusOK:
+        // The server ignored the range and is sending everything
+        offset = 0
+    case http.StatusRequestedRangeNotSatisfiable:
+        // The partial file does not belong to this content; start over
+        resp.Body.Close()
+        out.Close()
+        os.Remove(partial)
+        return c.download(file, path)
+    default:
+        return responseError(resp)
+    }
+    if err := out.Truncate(offset); err != nil {
+        return err
+    }
+    if _, err := out.Seek(offset, io.SeekStart); err != nil {
+        return err
+    }
+
+    bar := newProgress(file.FileName, file.FileSize, offset)
+    _, err = io.Copy(progressWriter{out, bar}, resp.Body)
+    bar.finish()
+    if err != nil {
+        return fmt.Errorf("download interrupted, run the command again to resume: %w", err)
+    }
+    if err := out.Close(); err != nil {
+        return err
+    }
+    return finishDownload(file, partial, path)
+}
+
+// finishDownload checks a fully downloaded file and moves it into place.
+func finishDownload(file *remoteFile, partial, path string) error {
+    if file.SHA256 != "" {
+        sum, err := hashFile(partial)
+        if err != nil {
+            return err
+        }
+        if sum != file.SHA256 {
+            os.Remove(partial)
+            return fmt.Errorf("%s: downloaded content does not match its checksum", file.FileName)
+        }
+    }
+    return os.Rename(partial, path)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+	"CloudBox/controllers"
+	"CloudBox/initializers"
+	"CloudBox/utils"
+)
+
+func init() {
+	initializers.LoadEnvs()
+}
+
+// reconcile compares the storage bucket with the files table and reports
+// orphan objects, rows whose object is missing and size mismatches. It
+// only reports by default; pass -fix to repair what it finds.
+func main() {
+    fix := flag.Bool("fix", false, "repair the problems found instead of only reporting them")
+    minAge := flag.Duration("min-age", time.Hour, "ignore objects and rows younger than this, which may belong to uploads in progress")
+    asJSON := flag.Bool("json", false, "print the report as JSON")
+    flag.Parse()
+
+    db := utils.ConnectDB()
+    store, err := utils.NewStorage()
+    if err != nil {
+        log.Fatalf("Failed to initialise storage: %v", err)
+    }
+    h := controllers.NewHandler(db, store)
+
+    report, err := h.Reconcile(controllers.ReconcileOptions{Fix: *fix, MinAge: *minAge})
+    if err != nil {
+        log.Fatalf("Reconciliation failed: %v", err)
+    }
+
+    if *asJSON {
+        enc := json.NewEncoder(os.Stdout)
+        enc.SetIndent("", "  ")
+        enc.Encode(report)
+    } else {
+        for _, issue := range report.Issues {
+            line := fmt.Sprintf("%-15s %s", issue.Kind, issue.Key)
+            if issue.Table != "" {
+                line += fmt.Sprintf(" (%s #%d)", issue.Table, issue.RowID)
+            }
+            if issue.Kind == controllers.IssueSizeMismatch {
+                line += fmt.Sprintf(" recorded %d bytes, stored %d bytes", issue.RecordedSize, issue.ObjectSize)
+            }
+            switch {
+            case issue.Error != "":
+                line += " - fix failed: " + issue.Error
+            case issue.Fixed:
+                line += " - fixed"
+            }
+            fmt.Println(line)
+        }
+        mode := "dry run, nothing changed"
+        if *fix {
+            mode = "fixes applied"
+        }
+        fmt.Printf("Checked %d objects and %d rows: %d problems (%s)\n",
+            report.Objects, report.Rows, len(report.Issues), mode)
+    }
+
+    for _, issue := range report.Issues {
+        if !issue.Fixed {
+            os.Exit(1)
+        }
+    }
+}
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "crypto/rand"
+    "encoding/base32"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+)
+
+const MaxAccessKeysPerUser = 10
+
+type CreateAccessKeyRequest struct {
+    Name string `json:"name"`
+}
+
+// newAccessKey generates an access key ID and secret in the shapes S3
+// clients expect: 20 upper case characters and 40 characters.
+func newAccessKey() (string, string, error) {
+    id := make([]byte, 10)
+    secret := make([]byte, 30)
+    if _, err := rand.Read(id); err != nil {
+        return "", "", err
+    }
+    if _, err := rand.Read(secret); err != nil {
+        return "", "", err
+    }
+    return "CB" + base32.StdEncoding.EncodeToString(id)[:18], base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// CreateAccessKey issues an access key for the S3 gateway. The secret is
+// only returned here and cannot be retrieved later.
+func (h *Handler) CreateAccessKey(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    // The body is optional, since a key needs no name
+    var req CreateAccessKeyRequest
+    if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    var count int64
+    h.DB.Model(&models.AccessKey{}).Where("user_id = ?", userID).Count(&count)
+    if count >= MaxAccessKeysPerUser {
+        c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("a user can have at most %d access keys", MaxAccessKeysPerUser)})
+        return
+    }
+
+    id, secret, err := newAccessKey()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate access key"})
+        return
+    }
+    key := models.AccessKey{
+        UserID:      userID.(uint),
+        Name:        req.Name,
+        AccessKeyID: id,
+        SecretKey:   secret,
+    }
+    if result := h.DB.Create(&key); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create access key"})
+        return
+    }
+
+    c.JSON(http.StatusCreated, gin.H{
+        "id":                key.ID,
+        "name":              key.Name,
+        "access_key_id":     key.AccessKeyID,
+        "secret_access_key": key.SecretKey,
+        "created_at":        key.CreatedAt,
+    })
+}
+
+// ListAccessKeys returns the caller's access keys, without their secrets
+func (h *Handler) ListAccessKeys(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var keys []models.AccessKey
+    if result := h.DB.Where("user_id = ?", userID).Order("created_at").Find(&keys); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch access keys"})
+        return
+    }
+
+    c.JSON(http.StatusOK, keys)
+}
+
+// DeleteAccessKey revokes one of the caller's access keys
+func (h *Handler) DeleteAccessKey(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    result := h.DB.Unscoped().Where("id = ? AND user_id = ?", c.Param("id"), userID).Delete(&models.AccessKey{})
+    if result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke access key"})
+        return
+    }
+    if result.RowsAffected == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"error": "access key not found"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "access key revoked"})
+}
@@ -0,0 +1,355 @@
+package controllers
+
+import (
+	"CloudBox/models"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+    "golang.org/x/crypto/bcrypt"
+    "gorm.io/gorm"
+)
+
+// The operations in this file act on any account and back the
+// cloudbox-admin tool. None of them is reachable over HTTP.
+
+// UserUsage breaks down the storage a user holds.
+type UserUsage struct {
+    UserID       uint   `json:"user_id"`
+    Username     string `json:"username"`
+    QuotaBytes   int64  `json:"quota_bytes"`
+    UsedBytes    int64  `json:"used_bytes"` // as charged, which the rest should add up to
+    Folders      int64  `json:"folders"`
+    Files        int64  `json:"files"`
+    FileBytes    int64  `json:"file_bytes"`
+    TrashFiles   int64  `json:"trash_files"`
+    TrashBytes   int64  `json:"trash_bytes"`
+    Versions     int64  `json:"versions"`
+    VersionBytes int64  `json:"version_bytes"`
+}
+
+// TransferResult reports what TransferFiles moved.
+type TransferResult struct {
+    FolderID uint   `json:"folder_id"`
+    Folder   string `json:"folder"`
+    Files    int64  `json:"files"`
+    Folders  int64  `json:"folders"`
+}
+
+// DeleteResult reports what DeleteAccount removed.
+type DeleteResult struct {
+    Files   int `json:"files"`
+    Folders int `json:"folders"`
+    Failed  int `json:"failed"` // files whose content could not be released
+}
+
+// FindUser looks a user up by username, or by ID when ref is a number and
+// no user has it as a username.
+func (h *Handler) FindUser(ref string) (*models.User, error) {
+    var user models.User
+    err := h.DB.Where("username = ?", ref).First(&user).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        if id, convErr := strconv.ParseUint(ref, 10, 64); convErr == nil {
+            err = h.DB.First(&user, id).Error
+        }
+    }
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return nil, fmt.Errorf("user %q not found", ref)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &user, nil
+}
+
+// ListUsers returns every user, oldest first.
+func (h *Handler) ListUsers() ([]models.User, error) {
+    var users []models.User
+    err := h.DB.Order("id").Find(&users).Error
+    return users, err
+}
+
+// SetUserDisabled disables or re-enables user. A disabled user keeps their
+// data but cannot log in, renew tokens or use any existing credential,
+// and their share links stop working.
+func (h *Handler) SetUserDisabled(user *models.User, disabled bool) error {
+    return h.DB.Model(user).Update("disabled", disabled).Error
+}
+
+// UnlockUser clears the failed login count and any lockout on user.
+func (h *Handler) UnlockUser(user *models.User) error {
+    return h.DB.Model(user).Updates(map[string]interface{}{
+        "login_attempts": 0,
+        "locked_until":   time.Time{},
+    }).Error
+}
+
+// SetPassword replaces user's password, which must meet the same rules as
+// at registration, and unlocks the account.
+func (h *Handler) SetPassword(user *models.User, password string) error {
+    if err := validatePassword(password); err != nil {
+        return err
+    }
+    hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    if err != nil {
+        return fmt.Errorf("failed to hash password: %w", err)
+    }
+    return h.DB.Model(user).Updates(map[string]interface{}{
+        "password":       string(hashedPassword),
+        "login_attempts": 0,
+        "locked_until":   time.Time{},
+    }).Error
+}
+
+// Usage returns the breakdown of user's storage.
+func (h *Handler) Usage(user *models.User) (*UserUsage, error) {
+    usage := &UserUsage{
+        UserID:     user.ID,
+        Username:   user.Username,
+        QuotaBytes: effectiveQuota(user),
+        UsedBytes:  user.UsedBytes,
+    }
+    if err := h.DB.Model(&models.Folder{}).Where("user_id = ?", user.ID).Count(&usage.Folders).Error; err != nil {
+        return nil, err
+    }
+
+    var totals struct {
+        Count int64
+        Bytes int64
+    }
+    query := h.DB.Unscoped().Model(&models.File{}).Select("COUNT(*) AS count, COALESCE(SUM(file_size), 0) AS bytes")
+    if err := query.Where("user_id = ? AND status = ? AND deleted_at IS NULL", user.ID, models.FileStatusAvailable).
+        Scan(&totals).Error; err != nil {
+        return nil, err
+    }
+    usage.Files, usage.FileBytes = totals.Count, totals.Bytes
+
+    query = h.DB.Unscoped().Model(&models.File{}).Select("COUNT(*) AS count, COALESCE(SUM(file_size), 0) AS bytes")
+    if err := query.Where("user_id = ? AND status = ? AND deleted_at IS NOT NULL", user.ID, models.FileStatusAvailable).
+        Scan(&totals).Error; err != nil {
+        return nil, err
+    }
+    usage.TrashFiles, usage.TrashBytes = totals.Count, totals.Bytes
+
+    if err := h.DB.Model(&models.FileVersion{}).
+        Select("COUNT(*) AS count, COALESCE(SUM(file_versions.file_size), 0) AS bytes").
+        Joins("JOIN files ON files.id = file_versions.file_id").
+        Where("files.user_id = ?", user.ID).
+        Scan(&totals).Error; err != nil {
+        return nil, err
+    }
+    usage.Versions, usage.VersionBytes = totals.Count, totals.Bytes
+    return usage, nil
+}
+
+// RecomputeUsage sets userID's charged usage to what their files, in the
+// trash or not, and older versions add up to.
+func (h *Handler) RecomputeUsage(userID uint) error {
+    return h.DB.Exec(`UPDATE users SET used_bytes = (
+        SELECT COALESCE(SUM(file_size), 0) FROM files
+        WHERE files.user_id = users.id AND files.status = ?
+    ) + (
+        SELECT COALESCE(SUM(file_versions.file_size), 0) FROM file_versions
+        JOIN files ON files.id = file_versions.file_id
+        WHERE files.user_id = users.id AND file_versions.deleted_at IS NULL
+    ) WHERE id = ?`, models.FileStatusAvailable, userID).Error
+}
+
+// TransferFiles gives every file and folder of from to to, including the
+// trash, versions, tags and share links. They land in a new folder at the
+// root of to's drive named after from, and both users' usage is
+// recomputed. The quota of to is not enforced; check Usage afterwards.
+func (h *Handler) TransferFiles(from, to *models.User) (*TransferResult, error) {
+    if from.ID == to.ID {
+        return nil, errors.New("cannot transfer files to the same user")
+    }
+
+    // Remember what from can see now, to journal it away afterwards
+    var files []models.File
+    if err := h.DB.Where("user_id = ? AND status = ?", from.ID, models.FileStatusAvailable).Find(&files).Error; err != nil {
+        return nil, err
+    }
+    var roots []uint
+    if err := h.DB.Model(&models.Folder{}).Where("user_id = ? AND parent_id IS NULL", from.ID).Pluck("id", &roots).Error; err != nil {
+        return nil, err
+    }
+    var folderIDs []uint
+    for _, root := range roots {
+        subtree, err := h.folderSubtree(from.ID, root)
+        if err != nil {
+            return nil, err
+        }
+        folderIDs = append(folderIDs, subtree...)
+    }
+    var folders []models.Folder
+    if len(folderIDs) > 0 {
+        if err := h.DB.Where("id IN ?", folderIDs).Find(&folders).Error; err != nil {
+            return nil, err
+        }
+    }
+
+    name := from.Username
+    for i := 2; ; i++ {
+        var taken int64
+        if err := h.DB.Model(&models.Folder{}).Where("user_id = ? AND parent_id IS NULL AND name = ?", to.ID, name).
+            Count(&taken).Error; err != nil {
+            return nil, err
+        }
+        if taken == 0 {
+            break
+        }
+        name = fmt.Sprintf("%s (%d)", from.Username, i)
+    }
+
+    target := models.Folder{UserID: to.ID, Name: name}
+    result := &TransferResult{Folder: "/" + name}
+    err := h.DB.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Create(&target).Error; err != nil {
+            return err
+        }
+        if err := tx.Unscoped().Model(&models.Folder{}).Where("user_id = ? AND parent_id IS NULL", from.ID).
+            Update("parent_id", target.ID).Error; err != nil {
+            return err
+        }
+        moved := tx.Unscoped().Model(&models.Folder{}).Where("user_id = ?", from.ID).Update("user_id", to.ID)
+        if moved.Error != nil {
+            return moved.Error
+        }
+        result.Folders = moved.RowsAffected
+
+        if err := tx.Unscoped().Model(&models.File{}).Where("user_id = ? AND folder_id IS NULL", from.ID).
+            Update("folder_id", target.ID).Error; err != nil {
+            return err
+        }
+        if err := tx.Model(&models.FileTag{}).Where("user_id = ?", from.ID).Update("user_id", to.ID).Error; err != nil {
+            return err
+        }
+        if err := tx.Model(&models.FileShare{}).Where("created_by = ?", from.ID).Update("created_by", to.ID).Error; err != nil {
+            return err
+        }
+        moved = tx.Unscoped().Model(&models.File{}).Where("user_id = ?", from.ID).Update("user_id", to.ID)
+        result.Files = moved.RowsAffected
+        return moved.Error
+    })
+    if err != nil {
+        return nil, err
+    }
+    result.FolderID = target.ID
+
+    for _, id := range []uint{from.ID, to.ID} {
+        if err := h.RecomputeUsage(id); err != nil {
+            return nil, err
+        }
+    }
+
+    // from sees everything go, files first and folders from the deepest
+    // up; to sees the new folder and everything below it appear
+    removed := make([]models.Change, 0, len(files)+len(folders))
+    for i := range files {
+        removed = append(removed, fileChange(&files[i], models.ChangeDelete))
+    }
+    byID := make(map[uint]*models.Folder, len(folders))
+    for i := range folders {
+        byID[folders[i].ID] = &folders[i]
+    }
+    for i := len(folderIDs) - 1; i >= 0; i-- {
+        if folder, ok := byID[folderIDs[i]]; ok {
+            removed = append(removed, folderChange(folder, models.ChangeDelete))
+        }
+    }
+    h.recordChanges(from.ID, removed...)
+
+    added := []models.Change{folderChange(&target, models.ChangeCreate)}
+    for _, id := range folderIDs {
+        if folder, ok := byID[id]; ok {
+            if folder.ParentID == nil {
+                folder.ParentID = &target.ID
+            }
+            added = append(added, folderChange(folder, models.ChangeCreate))
+        }
+    }
+    for i := range files {
+        if files[i].FolderID == nil {
+            files[i].FolderID = &target.ID
+        }
+        added = append(added, fileChange(&files[i], models.ChangeCreate))
+    }
+    h.recordChanges(to.ID, added...)
+    return result, nil
+}
+
+// DeleteAccount permanently deletes user and everything they own: files
+// and their versions, the trash, folders, share links, access keys,
+// unfinished uploads and the change journal. When some content cannot be
+// released the user is kept, so the deletion can be run again.
+func (h *Handler) DeleteAccount(user *models.User) (*DeleteResult, error) {
+    result := &DeleteResult{}
+
+    var uploads []models.TusUpload
+    if err := h.DB.Where("user_id = ? AND status = ?", user.ID, models.UploadSessionActive).Find(&uploads).Error; err != nil {
+        return nil, err
+    }
+    for i := range uploads {
+        h.discardTusUpload(&uploads[i])
+    }
+    var sessions []models.UploadSession
+    if err := h.DB.Where("user_id = ? AND status = ?", user.ID, models.UploadSessionActive).Find(&sessions).Error; err != nil {
+        return nil, err
+    }
+    for i := range sessions {
+        // The storage may already have expired the parts
+        if err := h.abortSession(&sessions[i]); err != nil {
+            log.Printf("Failed to abort upload session %d: %v", sessions[i].ID, err)
+        }
+    }
+
+    var files []models.File
+    if err := h.DB.Unscoped().Where("user_id = ?", user.ID).Find(&files).Error; err != nil {
+        return nil, err
+    }
+    for i := range files {
+        if err := h.purgeFile(&files[i]); err != nil {
+            result.Failed++
+            continue
+        }
+        result.Files++
+    }
+    if result.Failed > 0 {
+        return result, fmt.Errorf("failed to release the content of %d files", result.Failed)
+    }
+
+    err := h.DB.Transaction(func(tx *gorm.DB) error {
+        deleted := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&models.Folder{})
+        if deleted.Error != nil {
+            return deleted.Error
+        }
+        result.Folders = int(deleted.RowsAffected)
+        for _, model := range []interface{}{&models.AccessKey{}, &models.Change{}, &models.TusUpload{}} {
+            if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+                return err
+            }
+        }
+        var sessionIDs []uint
+        if err := tx.Unscoped().Model(&models.UploadSession{}).Where("user_id = ?", user.ID).Pluck("id", &sessionIDs).Error; err != nil {
+            return err
+        }
+        if len(sessionIDs) > 0 {
+            if err := tx.Unscoped().Where("session_id IN ?", sessionIDs).Delete(&models.UploadPart{}).Error; err != nil {
+                return err
+            }
+            if err := tx.Unscoped().Where("id IN ?", sessionIDs).Delete(&models.UploadSession{}).Error; err != nil {
+                return err
+            }
+        }
+        if err := tx.Unscoped().Where("created_by = ?", user.ID).Delete(&models.FileShare{}).Error; err != nil {
+            return err
+        }
+        return tx.Unscoped().Delete(user).Error
+    })
+    if err != nil {
+        return nil, err
+    }
+    return result, nil
+}
@@ -58,58 +58,50 @@ func validatePassword(password string) error {
     return nil
 }
 
-func CreateUser(c *gin.Context) {
-    db := utils.ConnectDB()
-    var input AuthInput
+var (
+    ErrUsernameTaken = errors.New("username already exists")
+    ErrEmailTaken    = errors.New("email already exists")
+)
 
-    if err := c.ShouldBindJSON(&input); err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-        return
-    }
+// CreateAccount registers a user with a hashed password, after checking
+// the password is strong enough and the username and email are free.
+func (h *Handler) CreateAccount(username, email, password string) (*models.User, error) {
+    db := h.DB
 
     // Validate password
-    if err := validatePassword(input.Password); err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-        return
+    if err := validatePassword(password); err != nil {
+        return nil, err
     }
 
     // Check if username exists
     var existingUser models.User
-    if result := db.Where("username = ?", input.Username).First(&existingUser); result.Error == nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "username already exists"})
-        return
+    if result := db.Where("username = ?", username).First(&existingUser); result.Error == nil {
+        return nil, ErrUsernameTaken
     }
 
     // Check if email exists
-    if result := db.Where("email = ?", input.Email).First(&existingUser); result.Error == nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "email already exists"})
-        return
+    if result := db.Where("email = ?", email).First(&existingUser); result.Error == nil {
+        return nil, ErrEmailTaken
     }
 
     // Hash password
-    hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+    hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
-        return
+        return nil, fmt.Errorf("failed to hash password: %w", err)
     }
 
     user := models.User{
-        Username: input.Username,
+        Username: username,
         Password: string(hashedPassword),
-        Email:    input.Email,
+        Email:    email,
     }
-
     if result := db.Create(&user); result.Error != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create user"})
-        return
+        return nil, result.Error
     }
-
-    c.JSON(http.StatusCreated, gin.H{"message": "user created successfully"})
+    return &user, nil
 }
 
-
-func Login(c *gin.Context) {
-    db := utils.ConnectDB()
+func (h *Handler) CreateUser(c *gin.Context) {
     var input AuthInput
 
     if err := c.ShouldBindJSON(&input); err != nil {
@@ -117,40 +109,111 @@ func Login(c *gin.Context) {
         return
     }
 
-    var user models.User
-    if result := db.Where("username = ?", input.Username).First(&user); result.Error != nil {
-        c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+    // Validate password
+    if err := validatePassword(input.Password); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    if _, err := h.CreateAccount(input.Username, input.Email, input.Password); err != nil {
+        if errors.Is(err, ErrUsernameTaken) || errors.Is(err, ErrEmailTaken) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create user"})
         return
     }
 
+    c.JSON(http.StatusCreated, gin.H{"message": "user created successfully"})
+}
+
+
+var (
+    ErrInvalidCredentials = errors.New("invalid credentials")
+    ErrAccountDisabled    = errors.New("account is disabled")
+)
+
+// accountLockedError is returned for an account locked after too many
+// failed logins.
+type accountLockedError struct {
+    until time.Time
+}
+
+func (e *accountLockedError) Error() string {
+    return fmt.Sprintf("account is locked. Try again after %v", e.until)
+}
+
+// checkCredentials verifies a username and password. Failures count
+// towards locking the account, and a locked account is refused with an
+// *accountLockedError even when the password is right. A disabled account
+// gets ErrAccountDisabled, but only once the password has been checked.
+func (h *Handler) checkCredentials(username, password string) (*models.User, error) {
+    db := h.DB
+
+    var user models.User
+    if result := db.Where("username = ?", username).First(&user); result.Error != nil {
+        return nil, ErrInvalidCredentials
+    }
+
     // Check account lockout
     if user.LockedUntil.After(time.Now()) {
-        c.JSON(http.StatusTooManyRequests, gin.H{
-            "error": fmt.Sprintf("account is locked. Try again after %v", user.LockedUntil),
-        })
-        return
+        return nil, &accountLockedError{until: user.LockedUntil}
     }
 
     // Verify password
-    if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(input.Password)); err != nil {
+    if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
         user.LoginAttempts++
 
         // Lock account if too many attempts
+        err = ErrInvalidCredentials
         if user.LoginAttempts >= MaxLoginAttempts {
             user.LockedUntil = time.Now().Add(LockoutDuration)
-            c.JSON(http.StatusTooManyRequests, gin.H{"error": "account locked due to too many failed attempts"})
-        } else {
-            c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentialtems"})
+            err = &accountLockedError{until: user.LockedUntil}
         }
 
         db.Save(&user)
-        return
+        return nil, err
     }
 
     // Reset login attempts on successful login
-    user.LoginAttempts = 0
+    if user.LoginAttempts > 0 {
+        user.LoginAttempts = 0
+        db.Model(&user).Update("login_attempts", 0)
+    }
+    if user.Disabled {
+        return nil, ErrAccountDisabled
+    }
+    return &user, nil
+}
+
+func (h *Handler) Login(c *gin.Context) {
+    db := h.DB
+    // Logging in takes only the username and password, not the email
+    // registration asks for
+    var input models.AuthInput
+
+    if err := c.ShouldBindJSON(&input); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    user, err := h.checkCredentials(input.Username, input.Password)
+    var locked *accountLockedError
+    if errors.As(err, &locked) {
+        c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+        return
+    }
+    if errors.Is(err, ErrAccountDisabled) {
+        c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+        return
+    }
+    if err != nil {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+        return
+    }
+
     user.LastLogin = time.Now()
-    db.Save(&user)
+    db.Save(user)
 
     // Generate tokens
     tokens, err := utils.GenerateTokens(user.ID)
@@ -171,7 +234,7 @@ func Login(c *gin.Context) {
     c.JSON(http.StatusOK, response)
 }
 
-func RefreshToken(c *gin.Context) {
+func (h *Handler) RefreshToken(c *gin.Context) {
     refreshToken := c.GetHeader("Refresh-Token")
     if refreshToken == "" {
         c.JSON(http.StatusBadRequest, gin.H{"error": "refresh token required"})
@@ -197,6 +260,18 @@ func RefreshToken(c *gin.Context) {
         }
 
         userID := uint(claims["user_id"].(float64))
+
+        // Deleted and disabled accounts cannot keep renewing their tokens
+        var user models.User
+        if err := h.DB.First(&user, userID).Error; err != nil {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+            return
+        }
+        if user.Disabled {
+            c.JSON(http.StatusForbidden, gin.H{"error": ErrAccountDisabled.Error()})
+            return
+        }
+
         tokens, err := utils.GenerateTokens(userID)
         if err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate tokens"})
@@ -209,23 +284,34 @@ func RefreshToken(c *gin.Context) {
     }
 }
 
-func GetUserProfile(c *gin.Context) {
+func (h *Handler) GetUserProfile(c *gin.Context) {
     userID, exists := c.Get("userID")
     if !exists {
         c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
         return
     }
 
-    db := utils.ConnectDB()
+    db := h.DB
     var user models.User
     if result := db.First(&user, userID); result.Error != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
         return
     }
 
+    quota := effectiveQuota(&user)
+    remaining := quota - user.UsedBytes
+    if remaining < 0 {
+        remaining = 0
+    }
+
     c.JSON(http.StatusOK, gin.H{
         "username": user.Username,
         "email":    user.Email,
         "lastLogin": user.LastLogin,
+        "storage": gin.H{
+            "quota_bytes":     quota,
+            "used_bytes":      user.UsedBytes,
+            "remaining_bytes": remaining,
+        },
     })
 }
\ No newline at end of file
@@ -0,0 +1,230 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "crypto/md5"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "path/filepath"
+
+    "github.com/google/uuid"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+// newCloudPath returns a fresh storage key for an upload named fileName.
+func newCloudPath(fileName string) string {
+    return fmt.Sprintf("%s-%s", uuid.New().String(), filepath.Base(fileName))
+}
+
+// hashContent returns the checksums of r and the number of bytes read.
+func hashContent(r io.Reader) (Checksums, int64, error) {
+    sha, sum := sha256.New(), md5.New()
+    n, err := io.Copy(io.MultiWriter(sha, sum), r)
+    if err != nil {
+        return Checksums{}, n, err
+    }
+    return Checksums{
+        SHA256: hex.EncodeToString(sha.Sum(nil)),
+        MD5:    hex.EncodeToString(sum.Sum(nil)),
+    }, n, nil
+}
+
+// referenceBlob takes a reference on the blob with the given content, if
+// one exists. Blobs registered before MD5s were recorded get theirs filled
+// in.
+func (h *Handler) referenceBlob(sum Checksums) (*models.Blob, error) {
+    var blob models.Blob
+    err := h.DB.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+            Where("hash = ?", sum.SHA256).First(&blob).Error; err != nil {
+            return err
+        }
+        blob.RefCount++
+        if blob.MD5 == "" {
+            blob.MD5 = sum.MD5
+        }
+        return tx.Model(&blob).Updates(map[string]interface{}{"ref_count": blob.RefCount, "md5": blob.MD5}).Error
+    })
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &blob, nil
+}
+
+// registerBlob records an object that was just written to cloudPath as the
+// blob for its content, holding one reference. If another upload registered the
+// same content first, the new object is discarded in favour of the
+// existing blob.
+func (h *Handler) registerBlob(sum Checksums, cloudPath string, size int64, contentType string) (*models.Blob, error) {
+    blob := models.Blob{
+        Hash:        sum.SHA256,
+        MD5:         sum.MD5,
+        CloudPath:   cloudPath,
+        Size:        size,
+        ContentType: contentType,
+        RefCount:    1,
+    }
+    result := h.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&blob)
+    if result.Error != nil {
+        return nil, result.Error
+    }
+    if result.RowsAffected == 1 {
+        return &blob, nil
+    }
+
+    existing, err := h.referenceBlob(sum)
+    if err != nil || existing == nil {
+        return nil, fmt.Errorf("failed to reference blob %s: %v", sum.SHA256, err)
+    }
+    // The existing blob may be this very object, registered by a request
+    // adopting it at the same time
+    if existing.CloudPath != cloudPath {
+        h.Storage.Delete(cloudPath)
+    }
+    return existing, nil
+}
+
+// storeContent hashes body and stores it, unless an object with the same
+// content already exists, in which case that blob is reused. Content that
+// does not match the checksums the client expected is refused. The
+// returned blob carries a reference for the caller.
+func (h *Handler) storeContent(body io.ReadSeeker, fileName, contentType string, expected Checksums) (*models.Blob, error) {
+    sum, size, err := hashContent(body)
+    if err != nil {
+        return nil, err
+    }
+    if err := expected.verify(sum); err != nil {
+        return nil, err
+    }
+
+    blob, err := h.referenceBlob(sum)
+    if err != nil || blob != nil {
+        return blob, err
+    }
+
+    if _, err := body.Seek(0, io.SeekStart); err != nil {
+        return nil, err
+    }
+    cloudPath := newCloudPath(fileName)
+    if err := h.Storage.Put(cloudPath, body, size, contentType); err != nil {
+        return nil, err
+    }
+    return h.registerBlob(sum, cloudPath, size, contentType)
+}
+
+// adoptStoredObject deduplicates an object that clients uploaded straight
+// to storage, such as a completed multipart upload. The object is read
+// back to hash it; when its content is already known the new copy is
+// deleted and the existing blob is returned instead. An object that does
+// not match the checksums the client expected is deleted and refused.
+func (h *Handler) adoptStoredObject(cloudPath, contentType string, expected Checksums) (*models.Blob, error) {
+    body, err := h.Storage.Get(cloudPath)
+    if err != nil {
+        return nil, err
+    }
+    sum, size, err := hashContent(body)
+    body.Close()
+    if err != nil {
+        return nil, err
+    }
+    if err := expected.verify(sum); err != nil {
+        h.Storage.Delete(cloudPath)
+        return nil, err
+    }
+
+    blob, err := h.referenceBlob(sum)
+    if err != nil {
+        return nil, err
+    }
+    if blob != nil {
+        if blob.CloudPath != cloudPath {
+            h.Storage.Delete(cloudPath)
+        }
+        return blob, nil
+    }
+    return h.registerBlob(sum, cloudPath, size, contentType)
+}
+
+// releaseFileContent drops file's reference on its blob and deletes the
+// stored object once nothing refers to it any more.
+func (h *Handler) releaseFileContent(file *models.File) error {
+    return h.releaseContent(file.BlobID, file.CloudPath)
+}
+
+// releaseContent drops one reference on blobID, deleting the stored object
+// with the last one. Content stored before deduplication has no blob and
+// is owned outright, so its object is deleted straight away.
+func (h *Handler) releaseContent(blobID *uint, cloudPath string) error {
+    if blobID == nil {
+        h.deleteThumbnails(cloudPath)
+        return h.Storage.Delete(cloudPath)
+    }
+
+    var orphan *models.Blob
+    err := h.DB.Transaction(func(tx *gorm.DB) error {
+        var blob models.Blob
+        if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&blob, *blobID).Error; err != nil {
+            return err
+        }
+        blob.RefCount--
+        if blob.RefCount > 0 {
+            return tx.Model(&blob).Update("ref_count", blob.RefCount).Error
+        }
+        orphan = &blob
+        return tx.Unscoped().Delete(&blob).Error
+    })
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return nil
+    }
+    if err != nil || orphan == nil {
+        return err
+    }
+    h.deleteThumbnails(orphan.CloudPath)
+    return h.Storage.Delete(orphan.CloudPath)
+}
+
+// adoptLegacyContent moves content stored before deduplication into a
+// blob, updating the row that owns it (a File or FileVersion) to point at
+// the blob. The blob keeps the owner's single reference.
+func (h *Handler) adoptLegacyContent(owner interface{}, blobID **uint, cloudPath *string, contentType string) error {
+    if *blobID != nil {
+        return nil
+    }
+    blob, err := h.adoptStoredObject(*cloudPath, contentType, Checksums{})
+    if err != nil {
+        return err
+    }
+    if blob.CloudPath != *cloudPath {
+        h.deleteThumbnails(*cloudPath)
+    }
+    *blobID = &blob.ID
+    *cloudPath = blob.CloudPath
+    return h.DB.Model(owner).Updates(map[string]interface{}{
+        "blob_id":    blob.ID,
+        "cloud_path": blob.CloudPath,
+    }).Error
+}
+
+// shareBlob takes an extra reference on blobID, so its content can back
+// another file or version.
+func (h *Handler) shareBlob(blobID uint) (*models.Blob, error) {
+    var blob models.Blob
+    err := h.DB.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&blob, blobID).Error; err != nil {
+            return err
+        }
+        blob.RefCount++
+        return tx.Model(&blob).Update("ref_count", blob.RefCount).Error
+    })
+    if err != nil {
+        return nil, err
+    }
+    return &blob, nil
+}
@@ -0,0 +1,225 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "CloudBox/utils"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+const (
+    DefaultChangeRetention = 90 * 24 * time.Hour
+    MaxChangeWait          = 60 * time.Second
+
+    // changePollInterval bounds how long a long poll can miss changes
+    // recorded by another server process, which cannot signal it.
+    changePollInterval = 5 * time.Second
+)
+
+// changeSignals holds, per user, a channel that is closed when changes are
+// recorded for them, waking every long poll waiting on it.
+var changeSignals = struct {
+    sync.Mutex
+    m map[uint]chan struct{}
+}{m: make(map[uint]chan struct{})}
+
+func changeSignal(userID uint) <-chan struct{} {
+    changeSignals.Lock()
+    defer changeSignals.Unlock()
+    signal, ok := changeSignals.m[userID]
+    if !ok {
+        signal = make(chan struct{})
+        changeSignals.m[userID] = signal
+    }
+    return signal
+}
+
+func notifyChanges(userID uint) {
+    changeSignals.Lock()
+    defer changeSignals.Unlock()
+    if signal, ok := changeSignals.m[userID]; ok {
+        close(signal)
+        delete(changeSignals.m, userID)
+    }
+}
+
+// ChangeRetention returns how long the change journal is kept, taken from
+// CHANGE_RETENTION_DAYS when set.
+func ChangeRetention() time.Duration {
+    if days, err := strconv.Atoi(utils.GetEnv("CHANGE_RETENTION_DAYS")); err == nil && days > 0 {
+        return time.Duration(days) * 24 * time.Hour
+    }
+    return DefaultChangeRetention
+}
+
+func fileChange(file *models.File, action string) models.Change {
+    return models.Change{
+        Action:    action,
+        EntryType: models.ChangeEntryFile,
+        EntryID:   file.ID,
+        Name:      file.FileName,
+        FolderID:  file.FolderID,
+        FileSize:  file.FileSize,
+        Version:   file.Version,
+    }
+}
+
+func folderChange(folder *models.Folder, action string) models.Change {
+    return models.Change{
+        Action:    action,
+        EntryType: models.ChangeEntryFolder,
+        EntryID:   folder.ID,
+        Name:      folder.Name,
+        FolderID:  folder.ParentID,
+    }
+}
+
+// recordChanges appends changes to userID's journal and wakes their long
+// polls. The change itself has already happened, so a failure is logged
+// rather than returned.
+func (h *Handler) recordChanges(userID uint, changes ...models.Change) {
+    if err := models.RecordChanges(h.DB, userID, changes); err != nil {
+        log.Printf("Failed to record %d changes for user %d: %v", len(changes), userID, err)
+        return
+    }
+    notifyChanges(userID)
+}
+
+func (h *Handler) fileChanged(file *models.File, action string) {
+    h.recordChanges(file.UserID, fileChange(file, action))
+}
+
+func (h *Handler) folderChanged(folder *models.Folder, action string) {
+    h.recordChanges(folder.UserID, folderChange(folder, action))
+}
+
+// PruneChanges deletes journal entries older than retention, returning how
+// many were removed. Clients whose cursor falls before what is left must
+// list their files again.
+func (h *Handler) PruneChanges(retention time.Duration) (int64, error) {
+    result := h.DB.Where("created_at < ?", time.Now().Add(-retention)).Delete(&models.Change{})
+    return result.RowsAffected, result.Error
+}
+
+// StartChangePrune runs PruneChanges every interval until the process
+// exits.
+func (h *Handler) StartChangePrune(interval time.Duration) {
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for range ticker.C {
+            if pruned, err := h.PruneChanges(ChangeRetention()); err != nil {
+                log.Printf("Failed to prune the change journal: %v", err)
+            } else if pruned > 0 {
+                log.Printf("Pruned %d changes from the journal", pruned)
+            }
+        }
+    }()
+}
+
+// ListChanges returns the caller's changes after cursor, oldest first.
+// Without a cursor it returns only the current one, for a client to take
+// before listing its files. With timeout (in seconds) the request waits
+// up to that long for a change when there are none yet. A cursor older
+// than the journal gets 410 Gone, and the client must list its files
+// again.
+func (h *Handler) ListChanges(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var user models.User
+    if result := h.DB.Select("id", "change_seq").First(&user, userID); result.Error != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+        return
+    }
+    value, ok := c.GetQuery("cursor")
+    if !ok {
+        c.JSON(http.StatusOK, gin.H{
+            "changes":  []models.Change{},
+            "cursor":   strconv.FormatInt(user.ChangeSeq, 10),
+            "has_more": false,
+        })
+        return
+    }
+    cursor, err := strconv.ParseInt(value, 10, 64)
+    if err != nil || cursor < 0 || cursor > user.ChangeSeq {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+        return
+    }
+    limit, err := listLimit(c)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    var wait time.Duration
+    if value := c.Query("timeout"); value != "" {
+        seconds, err := strconv.Atoi(value)
+        if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > MaxChangeWait {
+            c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("timeout must be between 0 and %d seconds", int(MaxChangeWait.Seconds()))})
+            return
+        }
+        wait = time.Duration(seconds) * time.Second
+    }
+
+    // Pruning leaves a gap between the cursor and the oldest change kept
+    var oldest int64
+    if result := h.DB.Model(&models.Change{}).Where("user_id = ?", user.ID).
+        Select("COALESCE(MIN(seq), ?)", user.ChangeSeq+1).Scan(&oldest); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch changes"})
+        return
+    }
+    if cursor+1 < oldest {
+        c.JSON(http.StatusGone, gin.H{"error": "cursor has expired, list files again"})
+        return
+    }
+
+    deadline := time.NewTimer(wait)
+    defer deadline.Stop()
+    poll := time.NewTicker(changePollInterval)
+    defer poll.Stop()
+    var changes []models.Change
+    for {
+        // Take the signal before querying so a change recorded in between
+        // still wakes the wait
+        signal := changeSignal(user.ID)
+        if result := h.DB.Where("user_id = ? AND seq > ?", user.ID, cursor).
+            Order("seq").Limit(limit + 1).Find(&changes); result.Error != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch changes"})
+            return
+        }
+        if len(changes) > 0 || wait == 0 {
+            break
+        }
+        select {
+        case <-signal:
+        case <-poll.C:
+        case <-deadline.C:
+            wait = 0
+        case <-c.Request.Context().Done():
+            return
+        }
+    }
+
+    hasMore := len(changes) > limit
+    if hasMore {
+        changes = changes[:limit]
+    }
+    if len(changes) > 0 {
+        cursor = changes[len(changes)-1].Seq
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "changes":  changes,
+        "cursor":   strconv.FormatInt(cursor, 10),
+        "has_more": hasMore,
+    })
+}
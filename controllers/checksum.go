@@ -0,0 +1,121 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "regexp"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var (
+    sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+    md5Pattern    = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+// Checksums are the hex encoded digests recorded for stored content. The
+// MD5 matches the ETag S3 gives objects uploaded in a single request.
+type Checksums struct {
+    SHA256 string `json:"sha256,omitempty"`
+    MD5    string `json:"md5,omitempty"`
+}
+
+// parseChecksums validates checksums supplied by a client. Either may be
+// empty when the client did not send it.
+func parseChecksums(sha256, md5 string) (Checksums, error) {
+    sum := Checksums{
+        SHA256: strings.ToLower(strings.TrimSpace(sha256)),
+        MD5:    strings.ToLower(strings.TrimSpace(md5)),
+    }
+    if sum.SHA256 != "" && !sha256Pattern.MatchString(sum.SHA256) {
+        return sum, errors.New("sha256 must be 64 hex digits")
+    }
+    if sum.MD5 != "" && !md5Pattern.MatchString(sum.MD5) {
+        return sum, errors.New("md5 must be 32 hex digits")
+    }
+    return sum, nil
+}
+
+// verify checks actual against the checksums the client expected,
+// ignoring those it did not supply.
+func (expected Checksums) verify(actual Checksums) error {
+    if expected.SHA256 != "" && expected.SHA256 != actual.SHA256 {
+        return fmt.Errorf("%w: expected sha256 %s, got %s", ErrChecksumMismatch, expected.SHA256, actual.SHA256)
+    }
+    if expected.MD5 != "" && expected.MD5 != actual.MD5 {
+        return fmt.Errorf("%w: expected md5 %s, got %s", ErrChecksumMismatch, expected.MD5, actual.MD5)
+    }
+    return nil
+}
+
+// checksumError writes the response for content that could not be stored,
+// singling out content that did not match the client's checksums.
+func checksumError(c *gin.Context, err error) {
+    if errors.Is(err, ErrChecksumMismatch) {
+        c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store file"})
+}
+
+// VerifyFile re-reads a file's stored object and compares it with the
+// checksums recorded at upload. Files stored before checksums were
+// recorded get them recorded now.
+func (h *Handler) VerifyFile(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    file, ok := h.findOwnedFile(c, userID)
+    if !ok {
+        return
+    }
+
+    body, err := h.Storage.Get(file.CloudPath)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read stored file"})
+        return
+    }
+    actual, size, err := hashContent(body)
+    body.Close()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read stored file"})
+        return
+    }
+
+    recorded := Checksums{SHA256: file.SHA256, MD5: file.MD5}
+    if recorded.SHA256 == "" {
+        recorded = actual
+        h.DB.Model(file).Updates(map[string]interface{}{"sha256": actual.SHA256, "md5": actual.MD5})
+    } else if recorded.MD5 == "" {
+        recorded.MD5 = actual.MD5
+        h.DB.Model(file).Update("md5", actual.MD5)
+    }
+
+    intact := recorded.verify(actual) == nil && size == file.FileSize
+    if !intact {
+        log.Printf("File %d failed verification: recorded %+v (%d bytes), stored %+v (%d bytes)",
+            file.ID, recorded, file.FileSize, actual, size)
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "file_id":  file.ID,
+        "intact":   intact,
+        "recorded": recorded,
+        "actual":   actual,
+        "size":     size,
+    })
+}
+
+// fileChecksums returns the checksums recorded for a file's current content.
+func fileChecksums(file *models.File) Checksums {
+    return Checksums{SHA256: file.SHA256, MD5: file.MD5}
+}
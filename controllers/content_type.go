@@ -0,0 +1,196 @@
+package controllers
+
+import (
+    "CloudBox/utils"
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+    "path/filepath"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+)
+
+// sniffLen is how many leading bytes http.DetectContentType looks at.
+const sniffLen = 512
+
+var ErrContentTypeRejected = errors.New("file type not allowed")
+
+// sniffedTypes are the media types http.DetectContentType can recognise
+// from content. When an extension claims one of these but the bytes say
+// otherwise, the extension is lying.
+var sniffedTypes = map[string]bool{
+    "image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true,
+    "image/bmp": true, "image/x-icon": true, "application/pdf": true,
+    "application/zip": true, "application/x-gzip": true, "application/x-rar-compressed": true,
+    "application/wasm": true, "application/ogg": true, "audio/mpeg": true, "audio/wave": true,
+    "audio/aiff": true, "audio/basic": true, "audio/midi": true, "video/mp4": true,
+    "video/webm": true, "video/avi": true, "font/woff": true, "font/woff2": true,
+    "font/ttf": true, "font/otf": true, "application/vnd.ms-fontobject": true,
+    "application/postscript": true,
+}
+
+// mediaType strips parameters such as charset from a Content-Type value.
+func mediaType(contentType string) string {
+    if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+        return mt
+    }
+    return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// textual reports whether a media type is some form of text, which content
+// sniffing can only report as text/plain.
+func textual(mt string) bool {
+    return strings.HasPrefix(mt, "text/") || strings.HasSuffix(mt, "+xml") || strings.HasSuffix(mt, "+json") ||
+        mt == "application/json" || mt == "application/xml" || mt == "application/javascript" ||
+        mt == "application/x-sh" || mt == "application/x-yaml"
+}
+
+// zipBased reports whether a media type is a format packaged as a ZIP
+// archive, such as Office documents, which sniff as application/zip.
+func zipBased(mt string) bool {
+    return strings.HasSuffix(mt, "+zip") || strings.Contains(mt, "openxmlformats") ||
+        strings.Contains(mt, "opendocument") || mt == "application/java-archive" ||
+        mt == "application/vnd.android.package-archive"
+}
+
+// sniffContentType works out the real type of an upload from its first
+// bytes, using the extension of fileName only to refine generic results.
+// The type the client declared is never trusted.
+func sniffContentType(head []byte, fileName string) string {
+    sniffed := http.DetectContentType(head)
+    sniffedType := mediaType(sniffed)
+    extType := mime.TypeByExtension(strings.ToLower(filepath.Ext(fileName)))
+    if extType == "" {
+        return sniffed
+    }
+
+    switch mt := mediaType(extType); sniffedType {
+    case "application/octet-stream":
+        // Unrecognised bytes: believe the extension unless it names a
+        // format that would have been recognised
+        if !sniffedTypes[mt] && !textual(mt) {
+            return extType
+        }
+    case "text/plain":
+        if textual(mt) {
+            return extType
+        }
+    case "text/xml":
+        if strings.HasSuffix(mt, "+xml") || strings.HasSuffix(mt, "/xml") {
+            return extType
+        }
+    case "application/zip":
+        if zipBased(mt) {
+            return extType
+        }
+    }
+    return sniffed
+}
+
+// readHead reads up to sniffLen bytes from r for sniffing.
+func readHead(r io.Reader) ([]byte, error) {
+    head := make([]byte, sniffLen)
+    n, err := io.ReadFull(r, head)
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+        err = nil
+    }
+    return head[:n], err
+}
+
+// sniffReader sniffs the type of body and rewinds it for storing.
+func sniffReader(body io.ReadSeeker, fileName string) (string, error) {
+    head, err := readHead(body)
+    if err != nil {
+        return "", err
+    }
+    if _, err := body.Seek(0, io.SeekStart); err != nil {
+        return "", err
+    }
+    return sniffContentType(head, fileName), nil
+}
+
+// sniffStoredObject sniffs the type of an object clients uploaded straight
+// to storage.
+func (h *Handler) sniffStoredObject(cloudPath, fileName string) (string, error) {
+    body, err := h.Storage.Get(cloudPath)
+    if err != nil {
+        return "", err
+    }
+    defer body.Close()
+    head, err := readHead(body)
+    if err != nil {
+        return "", err
+    }
+    return sniffContentType(head, fileName), nil
+}
+
+// envList reads a comma separated, case-insensitive list from key.
+func envList(key string) []string {
+    var list []string
+    for _, item := range strings.Split(utils.GetEnv(key), ",") {
+        if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+            list = append(list, item)
+        }
+    }
+    return list
+}
+
+// matchesType reports whether mt matches one of patterns, where a pattern
+// is a media type or a wildcard such as "image/*".
+func matchesType(mt string, patterns []string) bool {
+    for _, pattern := range patterns {
+        if pattern == mt || (strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mt, strings.TrimSuffix(pattern, "*"))) {
+            return true
+        }
+    }
+    return false
+}
+
+// matchesExtension reports whether ext, such as ".exe", is in extensions,
+// which may be written with or without the leading dot.
+func matchesExtension(ext string, extensions []string) bool {
+    for _, e := range extensions {
+        if "."+strings.TrimPrefix(e, ".") == ext {
+            return true
+        }
+    }
+    return false
+}
+
+// checkUploadPolicy applies the deployment's allow and deny lists, set with
+// UPLOAD_ALLOWED_TYPES, UPLOAD_DENIED_TYPES, UPLOAD_ALLOWED_EXTENSIONS and
+// UPLOAD_DENIED_EXTENSIONS. Deny lists win; an empty allow list allows
+// everything. contentType may be empty when only the name is known yet.
+func checkUploadPolicy(fileName, contentType string) error {
+    ext := strings.ToLower(filepath.Ext(fileName))
+    if matchesExtension(ext, envList("UPLOAD_DENIED_EXTENSIONS")) {
+        return fmt.Errorf("%w: files with the extension %q are not allowed", ErrContentTypeRejected, ext)
+    }
+    if allowed := envList("UPLOAD_ALLOWED_EXTENSIONS"); len(allowed) > 0 && !matchesExtension(ext, allowed) {
+        return fmt.Errorf("%w: files with the extension %q are not allowed", ErrContentTypeRejected, ext)
+    }
+    if contentType == "" {
+        return nil
+    }
+
+    mt := mediaType(contentType)
+    if matchesType(mt, envList("UPLOAD_DENIED_TYPES")) {
+        return fmt.Errorf("%w: files of type %q are not allowed", ErrContentTypeRejected, mt)
+    }
+    if allowed := envList("UPLOAD_ALLOWED_TYPES"); len(allowed) > 0 && !matchesType(mt, allowed) {
+        return fmt.Errorf("%w: files of type %q are not allowed", ErrContentTypeRejected, mt)
+    }
+    return nil
+}
+
+// contentTypeError writes the response for a failed upload policy check.
+func contentTypeError(c *gin.Context, err error) {
+    if errors.Is(err, ErrContentTypeRejected) {
+        c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check file type"})
+}
@@ -0,0 +1,103 @@
+package controllers
+
+import (
+    "errors"
+    "io"
+    "strings"
+    "testing"
+)
+
+var (
+    pngHead  = "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+    htmlHead = "<!DOCTYPE html><html><body>hello</body></html>"
+)
+
+func TestSniffContentType(t *testing.T) {
+    tests := []struct {
+        name     string
+        head     string
+        fileName string
+        want     string
+    }{
+        {"image matching its extension", pngHead, "photo.png", "image/png"},
+        {"image with another image's extension", pngHead, "photo.jpg", "image/png"},
+        {"image without an extension", pngHead, "photo", "image/png"},
+        {"HTML posing as an image", htmlHead, "photo.png", "text/html; charset=utf-8"},
+        {"HTML posing as JSON", htmlHead, "data.json", "text/html; charset=utf-8"},
+        {"text refined by its extension", `{"a": 1}`, "data.json", "application/json"},
+        {"text with a binary extension", "just some words", "photo.png", "text/plain; charset=utf-8"},
+        {"text without an extension", "just some words", "notes", "text/plain; charset=utf-8"},
+        {"XML refined by its extension", `<?xml version="1.0"?><svg></svg>`, "icon.svg", "image/svg+xml"},
+        {"unrecognised bytes with an unsniffable format", "\x00\x01\x02\x03", "picture.avif", "image/avif"},
+        {"unrecognised bytes posing as a sniffable format", "\x00\x01\x02\x03", "document.pdf", "application/octet-stream"},
+        {"unrecognised bytes posing as text", "\x00\x01\x02\x03", "data.json", "application/octet-stream"},
+        {"empty body", "", "empty.json", "application/json"},
+        {"empty body with a binary extension", "", "empty.png", "text/plain; charset=utf-8"},
+        {"body shorter than a signature", "\x89PN", "photo.png", "text/plain; charset=utf-8"},
+        {"body just long enough for a signature", "GIF89a", "anim.gif", "image/gif"},
+        {"upper case extension", `{"a": 1}`, "DATA.JSON", "application/json"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := sniffContentType([]byte(tt.head), tt.fileName); got != tt.want {
+                t.Errorf("sniffContentType(%q, %q) = %q, want %q", tt.head, tt.fileName, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestSniffReader(t *testing.T) {
+    long := pngHead + strings.Repeat("x", 2*sniffLen)
+    for _, body := range []string{"", "GIF89a", long} {
+        r := strings.NewReader(body)
+        if _, err := sniffReader(r, "file"); err != nil {
+            t.Fatalf("sniffReader(%d bytes): %v", len(body), err)
+        }
+        // The body is rewound, so it can be stored in full afterwards
+        rest, _ := io.ReadAll(r)
+        if string(rest) != body {
+            t.Errorf("after sniffing %d bytes, %d are left to read", len(body), len(rest))
+        }
+    }
+}
+
+func TestCheckUploadPolicy(t *testing.T) {
+    tests := []struct {
+        name        string
+        env         map[string]string
+        fileName    string
+        contentType string
+        allowed     bool
+    }{
+        {"no lists", nil, "setup.exe", "application/octet-stream", true},
+        {"denied extension", map[string]string{"UPLOAD_DENIED_EXTENSIONS": "exe,.bat"}, "setup.exe", "", false},
+        {"denied extension with a dot", map[string]string{"UPLOAD_DENIED_EXTENSIONS": "exe,.bat"}, "run.bat", "", false},
+        {"denied extension in upper case", map[string]string{"UPLOAD_DENIED_EXTENSIONS": "EXE"}, "SETUP.EXE", "", false},
+        {"extension not denied", map[string]string{"UPLOAD_DENIED_EXTENSIONS": "exe"}, "photo.png", "image/png", true},
+        {"allowed extension", map[string]string{"UPLOAD_ALLOWED_EXTENSIONS": "png, jpg"}, "photo.jpg", "image/jpeg", true},
+        {"extension not allowed", map[string]string{"UPLOAD_ALLOWED_EXTENSIONS": "png,jpg"}, "notes.txt", "", false},
+        {"no extension with an allow list", map[string]string{"UPLOAD_ALLOWED_EXTENSIONS": "png"}, "README", "", false},
+        {"denied type", map[string]string{"UPLOAD_DENIED_TYPES": "text/html"}, "page.txt", "text/html; charset=utf-8", false},
+        {"denied type by wildcard", map[string]string{"UPLOAD_DENIED_TYPES": "video/*"}, "clip.mp4", "video/mp4", false},
+        {"type not denied", map[string]string{"UPLOAD_DENIED_TYPES": "video/*"}, "photo.png", "image/png", true},
+        {"allowed type by wildcard", map[string]string{"UPLOAD_ALLOWED_TYPES": "image/*"}, "photo.png", "image/png", true},
+        {"type not allowed", map[string]string{"UPLOAD_ALLOWED_TYPES": "image/*"}, "photo.png", "text/html; charset=utf-8", false},
+        {"type unknown yet", map[string]string{"UPLOAD_ALLOWED_TYPES": "image/*"}, "photo.png", "", true},
+        {"deny list wins", map[string]string{"UPLOAD_ALLOWED_TYPES": "image/*", "UPLOAD_DENIED_TYPES": "image/svg+xml"}, "icon.svg", "image/svg+xml", false},
+        {"extension allowed but sniffed type denied", map[string]string{"UPLOAD_ALLOWED_EXTENSIONS": "png", "UPLOAD_DENIED_TYPES": "text/html"}, "photo.png", "text/html; charset=utf-8", false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            for _, key := range []string{"UPLOAD_ALLOWED_TYPES", "UPLOAD_DENIED_TYPES", "UPLOAD_ALLOWED_EXTENSIONS", "UPLOAD_DENIED_EXTENSIONS"} {
+                t.Setenv(key, tt.env[key])
+            }
+            err := checkUploadPolicy(tt.fileName, tt.contentType)
+            if tt.allowed && err != nil {
+                t.Errorf("checkUploadPolicy(%q, %q) = %v, want it allowed", tt.fileName, tt.contentType, err)
+            }
+            if !tt.allowed && !errors.Is(err, ErrContentTypeRejected) {
+                t.Errorf("checkUploadPolicy(%q, %q) = %v, want ErrContentTypeRejected", tt.fileName, tt.contentType, err)
+            }
+        })
+    }
+}
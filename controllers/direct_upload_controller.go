@@ -0,0 +1,313 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "CloudBox/storage"
+    "errors"
+    "fmt"
+    "log"
+    "mime"
+    "net/http"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+const (
+    MaxDirectUploadSize = 5 << 30 // 5 GB, S3 limit on a single PUT
+    PresignedPutExpiry  = 15 * time.Minute
+    PendingUploadTTL    = time.Hour
+)
+
+type PresignUploadRequest struct {
+    FileName    string `json:"file_name" binding:"required"`
+    ContentType string `json:"content_type"`
+    FileSize    int64  `json:"file_size" binding:"required,min=1"`
+    FolderID    *uint  `json:"folder_id"` // omit for the root
+    SHA256      string `json:"sha256"`    // verified on confirmation
+    MD5         string `json:"md5"`
+}
+
+// PresignUpload reserves a pending file record and returns a URL the
+// client can PUT the bytes to directly, bypassing the API server.
+func (h *Handler) PresignUpload(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var req PresignUploadRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    if req.FileSize > MaxDirectUploadSize {
+        c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file too large, use a multipart upload instead"})
+        return
+    }
+    if req.ContentType == "" {
+        req.ContentType = "application/octet-stream"
+    }
+    expected, err := parseChecksums(req.SHA256, req.MD5)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    // The content is sniffed on confirmation, but a forbidden extension or
+    // declared type can be refused straight away
+    if err := checkUploadPolicy(req.FileName, req.ContentType); err != nil {
+        contentTypeError(c, err)
+        return
+    }
+    if err := h.checkFolder(userID.(uint), req.FolderID); err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+        return
+    }
+    // Space is only charged on confirmation, but refuse uploads that
+    // cannot fit right away
+    if err := h.checkQuota(userID.(uint), req.FileSize); err != nil {
+        quotaError(c, err)
+        return
+    }
+
+    cloudPath := newCloudPath(req.FileName)
+    fileRecord := models.File{
+        UserID:      userID.(uint),
+        FolderID:    req.FolderID,
+        FileName:    req.FileName,
+        FileSize:    req.FileSize,
+        ContentType: req.ContentType,
+        CloudPath:   cloudPath,
+        SHA256:      expected.SHA256, // until confirmed, the client's checksums
+        MD5:         expected.MD5,
+        UploadDate:  time.Now(),
+        Status:      models.FileStatusPending,
+    }
+    if result := h.DB.Create(&fileRecord); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reserve file"})
+        return
+    }
+
+    url, err := h.Storage.PresignPut(cloudPath, req.ContentType, PresignedPutExpiry)
+    if err != nil {
+        h.DB.Unscoped().Delete(&fileRecord)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate upload url"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "file_id":    fileRecord.ID,
+        "upload_url": url,
+        "method":     http.MethodPut,
+        "headers":    gin.H{"Content-Type": req.ContentType},
+        "expires_in": "15 minutes",
+    })
+}
+
+// ConfirmUpload checks that the object behind a pending file was uploaded
+// with the size and content type that were reserved, then makes the file
+// available.
+func (h *Handler) ConfirmUpload(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var fileRecord models.File
+    if result := h.DB.Where("id = ? AND user_id = ? AND status = ?",
+        c.Param("id"), userID, models.FileStatusPending).First(&fileRecord); result.Error != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "pending file not found"})
+        return
+    }
+
+    // Claim the file first, so a second confirmation or the cleanup of
+    // stale uploads cannot work on the same object at once. It goes back to
+    // pending if the confirmation fails, unless the upload was refused.
+    claim := h.DB.Model(&models.File{}).Where("id = ? AND status = ?", fileRecord.ID, models.FileStatusPending).
+        Update("status", models.FileStatusConfirming)
+    if claim.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to confirm upload"})
+        return
+    }
+    if claim.RowsAffected == 0 {
+        c.JSON(http.StatusConflict, gin.H{"error": "upload is already being confirmed"})
+        return
+    }
+    confirmed := false
+    defer func() {
+        if !confirmed {
+            h.DB.Model(&models.File{}).Where("id = ? AND status = ?", fileRecord.ID, models.FileStatusConfirming).
+                Update("status", models.FileStatusPending)
+        }
+    }()
+
+    info, err := h.Storage.Stat(fileRecord.CloudPath)
+    if errors.Is(err, storage.ErrNotFound) {
+        c.JSON(http.StatusConflict, gin.H{"error": "file has not been uploaded yet"})
+        return
+    }
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check uploaded file"})
+        return
+    }
+
+    if info.Size != fileRecord.FileSize {
+        c.JSON(http.StatusUnprocessableEntity, gin.H{
+            "error": fmt.Sprintf("uploaded size %d does not match reserved size %d", info.Size, fileRecord.FileSize),
+        })
+        return
+    }
+    if !sameMediaType(info.ContentType, fileRecord.ContentType) {
+        c.JSON(http.StatusUnprocessableEntity, gin.H{
+            "error": fmt.Sprintf("uploaded content type %q does not match reserved type %q", info.ContentType, fileRecord.ContentType),
+        })
+        return
+    }
+
+    // The declared type only has to match what was reserved; what is
+    // stored is the type sniffed from the bytes
+    contentType, err := h.sniffStoredObject(fileRecord.CloudPath, fileRecord.FileName)
+    if err == nil {
+        err = checkUploadPolicy(fileRecord.FileName, contentType)
+    }
+    if err != nil {
+        if errors.Is(err, ErrContentTypeRejected) {
+            h.Storage.Delete(fileRecord.CloudPath)
+            h.DB.Unscoped().Delete(&fileRecord)
+        }
+        contentTypeError(c, err)
+        return
+    }
+    fileRecord.ContentType = contentType
+
+    if err := h.chargeUsage(fileRecord.UserID, fileRecord.FileSize); err != nil {
+        if errors.Is(err, ErrQuotaExceeded) {
+            h.Storage.Delete(fileRecord.CloudPath)
+            h.DB.Unscoped().Delete(&fileRecord)
+        }
+        quotaError(c, err)
+        return
+    }
+
+    // Hash the uploaded object, replacing it with an existing copy if the
+    // same content was uploaded before
+    blob, err := h.adoptStoredObject(fileRecord.CloudPath, fileRecord.ContentType, fileChecksums(&fileRecord))
+    if err != nil {
+        h.creditUsage(fileRecord.UserID, fileRecord.FileSize)
+        if errors.Is(err, ErrChecksumMismatch) {
+            h.DB.Unscoped().Delete(&fileRecord)
+        }
+        checksumError(c, err)
+        return
+    }
+
+    // Re-uploading an existing name adds a version to that file, and the
+    // reservation is no longer needed
+    fileRecord.FolderID = h.liveFolder(fileRecord.UserID, fileRecord.FolderID)
+    existing, err := h.findFileByName(fileRecord.UserID, fileRecord.FolderID, fileRecord.FileName)
+    if err == nil && existing != nil {
+        err = h.addVersion(existing, blob, fileRecord.ContentType)
+        if err == nil {
+            confirmed = true
+            h.DB.Unscoped().Delete(&fileRecord)
+            c.JSON(http.StatusOK, newFileUploadResponse(existing))
+            return
+        }
+    }
+    if err == nil {
+        fileRecord.CloudPath = blob.CloudPath
+        fileRecord.BlobID = &blob.ID
+        fileRecord.SHA256 = blob.Hash
+        fileRecord.MD5 = blob.MD5
+        fileRecord.Status = models.FileStatusAvailable
+        fileRecord.ScanStatus = newScanStatus()
+        fileRecord.UploadDate = time.Now()
+        // The claim only lapses if the cleanup judged it abandoned
+        result := h.DB.Model(&fileRecord).Where("status = ?", models.FileStatusConfirming).Updates(map[string]interface{}{
+            "folder_id":    fileRecord.FolderID,
+            "content_type": fileRecord.ContentType,
+            "cloud_path":   fileRecord.CloudPath,
+            "blob_id":      fileRecord.BlobID,
+            "sha256":       fileRecord.SHA256,
+            "md5":          fileRecord.MD5,
+            "status":       fileRecord.Status,
+            "scan_status":  fileRecord.ScanStatus,
+            "upload_date":  fileRecord.UploadDate,
+        })
+        err = result.Error
+        if err == nil && result.RowsAffected == 0 {
+            err = errors.New("pending file was removed while it was being confirmed")
+        }
+    }
+    if err != nil {
+        h.releaseContent(&blob.ID, blob.CloudPath)
+        h.creditUsage(fileRecord.UserID, fileRecord.FileSize)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save file metadata"})
+        return
+    }
+    confirmed = true
+    h.fileChanged(&fileRecord, models.ChangeCreate)
+    h.processContent(&fileRecord)
+
+    c.JSON(http.StatusOK, newFileUploadResponse(&fileRecord))
+}
+
+// sameMediaType compares two Content-Type values, ignoring parameters
+// such as charset.
+func sameMediaType(a, b string) bool {
+    ma, _, errA := mime.ParseMediaType(a)
+    mb, _, errB := mime.ParseMediaType(b)
+    if errA != nil || errB != nil {
+        return a == b
+    }
+    return ma == mb
+}
+
+// CleanupPendingUploads removes pending files that were never confirmed
+// within PendingUploadTTL, along with any object uploaded for them,
+// returning how many were removed. Confirmations that have held their
+// claim for as long were cut short by a restart and are removed too.
+func (h *Handler) CleanupPendingUploads() (int, error) {
+    cutoff := time.Now().Add(-PendingUploadTTL)
+    stale := func() *gorm.DB {
+        return h.DB.Unscoped().Where("((status = ? AND created_at < ?) OR (status = ? AND updated_at < ?))",
+            models.FileStatusPending, cutoff, models.FileStatusConfirming, cutoff)
+    }
+    var files []models.File
+    if result := stale().Find(&files); result.Error != nil {
+        return 0, result.Error
+    }
+
+    removed := 0
+    for i := range files {
+        file := &files[i]
+        // A confirmation may have claimed the file since it was read; its
+        // object is left alone then
+        result := stale().Delete(file)
+        if result.Error != nil || result.RowsAffected != 1 {
+            continue
+        }
+        if err := h.Storage.Delete(file.CloudPath); err != nil {
+            log.Printf("Failed to delete object for pending file %d: %v", file.ID, err)
+        }
+        removed++
+    }
+    return removed, nil
+}
+
+// StartPendingUploadCleanup runs CleanupPendingUploads every interval
+// until the process exits.
+func (h *Handler) StartPendingUploadCleanup(interval time.Duration) {
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for range ticker.C {
+            if _, err := h.CleanupPendingUploads(); err != nil {
+                log.Printf("Failed to fetch stale pending uploads: %v", err)
+            }
+        }
+    }()
+}
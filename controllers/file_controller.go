@@ -2,15 +2,10 @@ package controllers
 
 import (
     "CloudBox/models"
-    "CloudBox/utils"
-    "fmt"
     "net/http"
-    "path/filepath"
     "time"
     "github.com/gin-gonic/gin"
-    "github.com/google/uuid"
-    "github.com/aws/aws-sdk-go/aws"
-    "github.com/aws/aws-sdk-go/service/s3"
+    "gorm.io/gorm"
 )
 
 const (
@@ -23,9 +18,27 @@ type FileUploadResponse struct {
 	FileSize int64 `json:"file_size"`
 	ContentType string `json:"content_type"`
 	UploadDate time.Time `json:"upload_date"`
+	Version int `json:"version"`
+	SHA256 string `json:"sha256"`
+	MD5 string `json:"md5"`
+	ScanStatus string `json:"scan_status"`
 }
 
-func UploadFile(c *gin.Context) {
+func newFileUploadResponse(file *models.File) FileUploadResponse {
+	return FileUploadResponse{
+		FileID:      file.ID,
+		FileName:    file.FileName,
+		FileSize:    file.FileSize,
+		ContentType: file.ContentType,
+		UploadDate:  file.UploadDate,
+		Version:     file.Version,
+		SHA256:      file.SHA256,
+		MD5:         file.MD5,
+		ScanStatus:  file.ScanStatus,
+	}
+}
+
+func (h *Handler) UploadFile(c *gin.Context) {
 	userID, exists := c.Get("userID")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
@@ -44,68 +57,149 @@ func UploadFile(c *gin.Context) {
 	}
 	defer file.Close()
 
-	filename := fmt.Sprintf("%s-%s", uuid.New().String(), filepath.Base(header.Filename))
-	s3Client := utils.GetS3Client()
-    bucket := aws.String(utils.GetEnv("AWS_BUCKET_NAME"))
-
-    // Upload to S3
-    _, err = s3Client.PutObject(&s3.PutObjectInput{
-        Bucket:        bucket,
-        Key:           aws.String(filename),
-        Body:          file,
-        ContentType:   aws.String(header.Header.Get("Content-Type")),
-        ContentLength: aws.Int64(header.Size),
-    })
+    // Sniff the real type rather than trusting the client's Content-Type
+    contentType, err := sniffReader(file, header.Filename)
+    if err == nil {
+        err = checkUploadPolicy(header.Filename, contentType)
+    }
+    if err != nil {
+        contentTypeError(c, err)
+        return
+    }
 
+    // Checksums sent with the upload are verified against the content
+    expected, err := parseChecksums(c.Request.FormValue("sha256"), c.Request.FormValue("md5"))
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to upload file"})
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
         return
     }
 
-    // Save file metadata to database
-    db := utils.ConnectDB()
-    fileRecord := models.File{
-        UserID:      userID.(uint),
-        FileName:    header.Filename,
-        FileSize:    header.Size,
-        ContentType: header.Header.Get("Content-Type"),
-        CloudPath:   filename,
-        UploadDate:  time.Now(),
+    // Uploading with a file_id adds a new version to that file
+    var target *models.File
+    if fileID := c.Request.FormValue("file_id"); fileID != "" {
+        if target, err = h.findTargetFile(userID.(uint), fileID); err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+            return
+        }
+    }
+
+    // Uploads land in the root unless a folder_id is given
+    folderID, err := parseFolderID(c.Request.FormValue("folder_id"))
+    if err == nil {
+        err = h.checkFolder(userID.(uint), folderID)
+    }
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+        return
     }
 
-    if result := db.Create(&fileRecord); result.Error != nil {
+    // Reserve the space up front so concurrent uploads cannot overshoot
+    if err := h.chargeUsage(userID.(uint), header.Size); err != nil {
+        quotaError(c, err)
+        return
+    }
+
+    // Store the content, reusing an existing object with identical bytes
+    blob, err := h.storeContent(file, header.Filename, contentType, expected)
+    if err != nil {
+        h.creditUsage(userID.(uint), header.Size)
+        checksumError(c, err)
+        return
+    }
+
+    // Save file metadata to database, as a new version when the file exists
+    fileRecord, err := h.commitUpload(userID.(uint), target, folderID, header.Filename, contentType, blob)
+    if err != nil {
+        h.releaseContent(&blob.ID, blob.CloudPath)
+        h.creditUsage(userID.(uint), header.Size)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save file metadata"})
         return
     }
 
     // Return response
-    c.JSON(http.StatusOK, FileUploadResponse{
-        FileID:      fileRecord.ID,
-        FileName:    fileRecord.FileName,
-        FileSize:    fileRecord.FileSize,
-        ContentType: fileRecord.ContentType,
-        UploadDate:  fileRecord.UploadDate,
-    })
+    c.JSON(http.StatusOK, newFileUploadResponse(fileRecord))
 
 }
 
-func ListFiles(c *gin.Context) {
+// ListFiles returns one page of the caller's files, filtered and sorted as
+// the query asks (see fileFilters and fileSort). Pass next_cursor back as
+// cursor to fetch the following page.
+func (h *Handler) ListFiles(c *gin.Context) {
 	userID, exists := c.Get("userID")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "user is not authenticated"})
 		return
 	}
-	db := utils.ConnectDB()
+	db := h.DB.Model(&models.File{}).Where("user_id = ? AND status = ?", userID, models.FileStatusAvailable)
+    // Narrow the listing to one folder when folder_id is given
+    if value, ok := c.GetQuery("folder_id"); ok {
+        folderID, err := parseFolderID(value)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "invalid folder_id"})
+            return
+        }
+        db = inFolder(db, "folder_id", folderID)
+    }
+    size, ok := thumbnailSize(c, "thumbnail_size")
+    if !ok {
+        return
+    }
+    db, err := fileFilters(c, db)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    sort, desc, err := fileSort(c)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    limit, err := listLimit(c)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    // The total covers every page, so it ignores the cursor
+    var total int64
+    if result := db.Session(&gorm.Session{}).Count(&total); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to count files"})
+        return
+    }
+
+    page, err := pageAfter(db, sort, desc, c.Query("cursor"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
 	var files []models.File
-	if result := db.Where("user_id = ?", userID).Find(&files); result.Error != nil {
+	if result := page.Preload("Tags").Preload("Metadata").Limit(limit + 1).Find(&files); result.Error != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch files"})
         return
     }
 
-    c.JSON(http.StatusOK, files)
+    // One row beyond the page tells whether another page follows
+    var nextCursor string
+    if len(files) > limit {
+        files = files[:limit]
+        last := files[limit-1]
+        nextCursor = listCursor{
+            Sort:  sort,
+            Desc:  desc,
+            Value: cursorValue(sort, last.FileName, last.FileSize, last.UploadDate),
+            ID:    last.ID,
+        }.encode()
+    }
+    h.attachThumbnailURLs(files, size)
+
+    c.JSON(http.StatusOK, gin.H{
+        "files":       files,
+        "total":       total,
+        "next_cursor": nextCursor,
+    })
 }
 
-func DownloadFile(c *gin.Context) {
+func (h *Handler) DownloadFile(c *gin.Context) {
     userID, exists := c.Get("userID")
     if !exists {
         c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
@@ -115,23 +209,20 @@ func DownloadFile(c *gin.Context) {
     fileID := c.Param("id")
 
     // Get file metadata from database
-    db := utils.ConnectDB()
+    db := h.DB
     var file models.File
 
-    if result := db.Where("id = ? AND user_id = ?", fileID, userID).First(&file); result.Error != nil {
+    if result := db.Where("id = ? AND user_id = ? AND status = ?", fileID, userID, models.FileStatusAvailable).First(&file); result.Error != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
         return
     }
+    if err := scanBlocked(file.ScanStatus, file.ScanResult); err != nil {
+        scanError(c, err)
+        return
+    }
 
-    // Generate presigned URL for download
-    s3Client := utils.GetS3Client()
-    req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
-        Bucket: aws.String(utils.GetEnv("AWS_BUCKET_NAME")),
-        Key:    aws.String(file.CloudPath),
-    })
-
-    // URL valid for 15 minutes
-    url, err := req.Presign(15 * time.Minute)
+    // Generate presigned URL for download, valid for 15 minutes
+    url, err := h.Storage.PresignGet(file.CloudPath, 15*time.Minute)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate download url"})
         return
@@ -140,6 +231,8 @@ func DownloadFile(c *gin.Context) {
     c.JSON(http.StatusOK, gin.H{
         "download_url": url,
         "file_name":   file.FileName,
+        "sha256":      file.SHA256,
+        "md5":         file.MD5,
         "expires_in":  "15 minutes",
     })
 }
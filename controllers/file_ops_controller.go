@@ -0,0 +1,231 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "fmt"
+    "log"
+    "net/http"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+type RenameFileRequest struct {
+    FileName string `json:"file_name" binding:"required"`
+}
+
+type CopyFileRequest struct {
+    FolderID *uint  `json:"folder_id"` // omit for the root
+    FileName string `json:"file_name"` // defaults to the original name
+}
+
+// fileNameTaken reports whether folderID already holds an available file
+// called fileName, other than the file excludeID.
+func (h *Handler) fileNameTaken(userID uint, folderID *uint, fileName string, excludeID uint) (bool, error) {
+    existing, err := h.findFileByName(userID, folderID, fileName)
+    if err != nil {
+        return false, err
+    }
+    return existing != nil && existing.ID != excludeID, nil
+}
+
+// copyName returns a name for a copy of fileName that is free in folderID,
+// such as "report (copy).pdf" or "report (copy 2).pdf".
+func (h *Handler) copyName(userID uint, folderID *uint, fileName string) (string, error) {
+    ext := filepath.Ext(fileName)
+    base := strings.TrimSuffix(fileName, ext)
+    name := fileName
+    for n := 1; ; n++ {
+        taken, err := h.fileNameTaken(userID, folderID, name, 0)
+        if err != nil || !taken {
+            return name, err
+        }
+        if n == 1 {
+            name = fmt.Sprintf("%s (copy)%s", base, ext)
+        } else {
+            name = fmt.Sprintf("%s (copy %d)%s", base, n, ext)
+        }
+    }
+}
+
+// RenameFile changes a file's name within its folder
+func (h *Handler) RenameFile(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var req RenameFileRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    if err := validateName(req.FileName); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    file, ok := h.findOwnedFile(c, userID)
+    if !ok {
+        return
+    }
+
+    taken, err := h.fileNameTaken(file.UserID, file.FolderID, req.FileName, file.ID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rename file"})
+        return
+    }
+    if taken {
+        c.JSON(http.StatusConflict, gin.H{"error": "a file with this name already exists"})
+        return
+    }
+
+    if result := h.DB.Model(file).Update("file_name", req.FileName); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rename file"})
+        return
+    }
+    h.refreshSearch(file.ID)
+    h.fileChanged(file, models.ChangeMove)
+
+    c.JSON(http.StatusOK, file)
+}
+
+// MoveFile moves a file to another folder or to the root
+func (h *Handler) MoveFile(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var req MoveRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    file, ok := h.findOwnedFile(c, userID)
+    if !ok {
+        return
+    }
+    if err := h.checkFolder(file.UserID, req.FolderID); err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "destination folder not found"})
+        return
+    }
+
+    taken, err := h.fileNameTaken(file.UserID, req.FolderID, file.FileName, file.ID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to move file"})
+        return
+    }
+    if taken {
+        c.JSON(http.StatusConflict, gin.H{"error": "a file with this name already exists at the destination"})
+        return
+    }
+
+    if result := h.DB.Model(file).Update("folder_id", req.FolderID); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to move file"})
+        return
+    }
+    file.FolderID = req.FolderID
+    h.fileChanged(file, models.ChangeMove)
+
+    c.JSON(http.StatusOK, file)
+}
+
+// CopyFile copies a file's current version inside the storage backend. The
+// copy is a separate object with its own cloud path, so the bytes never
+// pass through the server and the two files are independent afterwards.
+func (h *Handler) CopyFile(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var req CopyFileRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    file, ok := h.findOwnedFile(c, userID)
+    if !ok {
+        return
+    }
+    if err := h.checkFolder(file.UserID, req.FolderID); err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "destination folder not found"})
+        return
+    }
+
+    // An explicit name must be free; otherwise a "(copy)" name is picked
+    fileName := req.FileName
+    if fileName != "" {
+        if err := validateName(fileName); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        taken, err := h.fileNameTaken(file.UserID, req.FolderID, fileName, 0)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to copy file"})
+            return
+        }
+        if taken {
+            c.JSON(http.StatusConflict, gin.H{"error": "a file with this name already exists at the destination"})
+            return
+        }
+    } else {
+        name, err := h.copyName(file.UserID, req.FolderID, file.FileName)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to copy file"})
+            return
+        }
+        fileName = name
+    }
+
+    if err := h.chargeUsage(file.UserID, file.FileSize); err != nil {
+        quotaError(c, err)
+        return
+    }
+
+    cloudPath := newCloudPath(fileName)
+    if err := h.Storage.Copy(file.CloudPath, cloudPath); err != nil {
+        h.creditUsage(file.UserID, file.FileSize)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to copy file"})
+        return
+    }
+
+    // The copy owns its object outright, like content stored before
+    // deduplication, so deleting it removes the object
+    fileRecord := models.File{
+        UserID:      file.UserID,
+        FolderID:    req.FolderID,
+        FileName:    fileName,
+        FileSize:    file.FileSize,
+        ContentType: file.ContentType,
+        CloudPath:   cloudPath,
+        SHA256:      file.SHA256,
+        MD5:         file.MD5,
+        UploadDate:  time.Now(),
+        Version:     1,
+        ScanStatus:  file.ScanStatus, // the same bytes, so the same verdict
+        ScanResult:  file.ScanResult,
+        ScannedAt:   file.ScannedAt,
+    }
+    if result := h.DB.Create(&fileRecord); result.Error != nil {
+        h.Storage.Delete(cloudPath)
+        h.creditUsage(file.UserID, file.FileSize)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save file metadata"})
+        return
+    }
+    if err := h.copyTagsAndMetadata(file, &fileRecord); err != nil {
+        log.Printf("Failed to copy tags of file %d to %d: %v", file.ID, fileRecord.ID, err)
+    }
+    h.fileChanged(&fileRecord, models.ChangeCreate)
+    h.processContent(&fileRecord)
+
+    c.JSON(http.StatusCreated, newFileUploadResponse(&fileRecord))
+}
@@ -0,0 +1,183 @@
+package controllers
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+const (
+    DefaultListLimit = 100
+    MaxListLimit     = 1000
+)
+
+// sortColumns maps the sort values ListFiles accepts to their columns.
+var sortColumns = map[string]string{
+    "name": "file_name",
+    "size": "file_size",
+    "date": "upload_date",
+}
+
+// listCursor marks where a page of ListFiles ended: the sort value and ID
+// of its last file. The sort is recorded too, so a cursor cannot be
+// replayed against a different ordering.
+type listCursor struct {
+    Sort  string `json:"s"`
+    Desc  bool   `json:"d"`
+    Value string `json:"v"`
+    ID    uint   `json:"i"`
+}
+
+func (lc listCursor) encode() string {
+    raw, _ := json.Marshal(lc)
+    return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (listCursor, error) {
+    var lc listCursor
+    raw, err := base64.RawURLEncoding.DecodeString(s)
+    if err == nil {
+        err = json.Unmarshal(raw, &lc)
+    }
+    if err != nil {
+        return lc, errors.New("invalid cursor")
+    }
+    return lc, nil
+}
+
+// cursorValue renders the sort value of a row for a cursor.
+func cursorValue(sort string, name string, size int64, date time.Time) string {
+    switch sort {
+    case "name":
+        return name
+    case "size":
+        return strconv.FormatInt(size, 10)
+    }
+    return date.UTC().Format(time.RFC3339Nano)
+}
+
+// parseCursorValue turns a cursor's sort value back into the column's type.
+func parseCursorValue(sort, value string) (interface{}, error) {
+    switch sort {
+    case "name":
+        return value, nil
+    case "size":
+        return strconv.ParseInt(value, 10, 64)
+    }
+    return time.Parse(time.RFC3339Nano, value)
+}
+
+// parseTime accepts an RFC 3339 timestamp or a plain date.
+func parseTime(value string) (time.Time, error) {
+    if t, err := time.Parse(time.RFC3339, value); err == nil {
+        return t, nil
+    }
+    return time.Parse("2006-01-02", value)
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+    return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// fileFilters narrows db to the files matching ListFiles' query
+// parameters: q (name substring), content_type (exact, or a wildcard such
+// as image/*), min_size, max_size, uploaded_after and uploaded_before, as
+// well as tag and metadata[key] (see tagAndMetadataFilters).
+func fileFilters(c *gin.Context, db *gorm.DB) (*gorm.DB, error) {
+    if q := c.Query("q"); q != "" {
+        db = db.Where("file_name ILIKE ?", "%"+escapeLike(q)+"%")
+    }
+    if ct := strings.ToLower(c.Query("content_type")); ct != "" {
+        if strings.HasSuffix(ct, "/*") {
+            db = db.Where("content_type ILIKE ?", escapeLike(strings.TrimSuffix(ct, "*"))+"%")
+        } else {
+            db = db.Where("(content_type = ? OR content_type ILIKE ?)", ct, escapeLike(ct)+";%")
+        }
+    }
+    for param, op := range map[string]string{"min_size": ">=", "max_size": "<="} {
+        if value := c.Query(param); value != "" {
+            size, err := strconv.ParseInt(value, 10, 64)
+            if err != nil || size < 0 {
+                return nil, fmt.Errorf("%s must be a non-negative number of bytes", param)
+            }
+            db = db.Where("file_size "+op+" ?", size)
+        }
+    }
+    for param, op := range map[string]string{"uploaded_after": ">=", "uploaded_before": "<"} {
+        if value := c.Query(param); value != "" {
+            t, err := parseTime(value)
+            if err != nil {
+                return nil, fmt.Errorf("%s must be an RFC 3339 timestamp or a YYYY-MM-DD date", param)
+            }
+            db = db.Where("upload_date "+op+" ?", t)
+        }
+    }
+    return tagAndMetadataFilters(c, db)
+}
+
+// fileSort reads the sort and order query parameters, defaulting to the
+// newest files first.
+func fileSort(c *gin.Context) (string, bool, error) {
+    sort := c.DefaultQuery("sort", "date")
+    if _, ok := sortColumns[sort]; !ok {
+        return "", false, errors.New("sort must be one of name, size or date")
+    }
+    defaultOrder := "asc"
+    if sort == "date" {
+        defaultOrder = "desc"
+    }
+    switch c.DefaultQuery("order", defaultOrder) {
+    case "asc":
+        return sort, false, nil
+    case "desc":
+        return sort, true, nil
+    }
+    return "", false, errors.New("order must be asc or desc")
+}
+
+// listLimit reads the page size from the limit query parameter.
+func listLimit(c *gin.Context) (int, error) {
+    value := c.Query("limit")
+    if value == "" {
+        return DefaultListLimit, nil
+    }
+    limit, err := strconv.Atoi(value)
+    if err != nil || limit < 1 || limit > MaxListLimit {
+        return 0, fmt.Errorf("limit must be between 1 and %d", MaxListLimit)
+    }
+    return limit, nil
+}
+
+// pageAfter orders db by the sort column with the ID as a tie breaker, and
+// starts it after cursor when one is given.
+func pageAfter(db *gorm.DB, sort string, desc bool, cursor string) (*gorm.DB, error) {
+    column := sortColumns[sort]
+    direction, cmp := "ASC", ">"
+    if desc {
+        direction, cmp = "DESC", "<"
+    }
+
+    if cursor != "" {
+        lc, err := decodeCursor(cursor)
+        if err != nil {
+            return nil, err
+        }
+        if lc.Sort != sort || lc.Desc != desc {
+            return nil, errors.New("cursor was issued for a different sort order")
+        }
+        value, err := parseCursorValue(sort, lc.Value)
+        if err != nil {
+            return nil, errors.New("invalid cursor")
+        }
+        db = db.Where(fmt.Sprintf("(%s, id) %s (?, ?)", column, cmp), value, lc.ID)
+    }
+    return db.Order(fmt.Sprintf("%s %s, id %s", column, direction, direction)), nil
+}
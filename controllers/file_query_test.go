@@ -0,0 +1,158 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "encoding/base64"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/driver/postgres"
+    "gorm.io/gorm"
+)
+
+// dryRunDB returns a database handle that builds SQL without running it.
+func dryRunDB(t *testing.T) *gorm.DB {
+    t.Helper()
+    db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost dbname=cloudbox sslmode=disable"}),
+        &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return db
+}
+
+func TestListCursorRoundTrip(t *testing.T) {
+    date := time.Date(2024, 3, 1, 12, 30, 45, 123456789, time.FixedZone("CET", 3600))
+    tests := []struct {
+        sort string
+        want interface{}
+    }{
+        {"name", "report, final (2).pdf"},
+        {"size", int64(1 << 40)},
+        {"date", date},
+    }
+    for _, tt := range tests {
+        for _, desc := range []bool{false, true} {
+            lc := listCursor{Sort: tt.sort, Desc: desc, Value: cursorValue(tt.sort, "report, final (2).pdf", 1<<40, date), ID: 42}
+            decoded, err := decodeCursor(lc.encode())
+            if err != nil {
+                t.Fatalf("%s: decodeCursor: %v", tt.sort, err)
+            }
+            if decoded != lc {
+                t.Errorf("%s: decoded %+v, want %+v", tt.sort, decoded, lc)
+            }
+
+            value, err := parseCursorValue(tt.sort, decoded.Value)
+            if err != nil {
+                t.Fatalf("%s: parseCursorValue: %v", tt.sort, err)
+            }
+            if want, ok := tt.want.(time.Time); ok {
+                if !value.(time.Time).Equal(want) {
+                    t.Errorf("date: parsed %v, want %v", value, want)
+                }
+            } else if value != tt.want {
+                t.Errorf("%s: parsed %v, want %v", tt.sort, value, tt.want)
+            }
+        }
+    }
+}
+
+func TestPageAfter(t *testing.T) {
+    db := dryRunDB(t)
+    tests := []struct {
+        sort      string
+        desc      bool
+        value     string
+        wantWhere string
+        wantOrder string
+        wantValue interface{}
+    }{
+        {"name", false, "b.txt", `(file_name, id) > ($1, $2)`, "ORDER BY file_name ASC, id ASC", "b.txt"},
+        {"name", true, "b.txt", `(file_name, id) < ($1, $2)`, "ORDER BY file_name DESC, id DESC", "b.txt"},
+        {"size", false, "1024", `(file_size, id) > ($1, $2)`, "ORDER BY file_size ASC, id ASC", int64(1024)},
+        {"size", true, "1024", `(file_size, id) < ($1, $2)`, "ORDER BY file_size DESC, id DESC", int64(1024)},
+        {"date", false, "2024-03-01T12:00:00Z", `(upload_date, id) > ($1, $2)`, "ORDER BY upload_date ASC, id ASC",
+            time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+        {"date", true, "2024-03-01T12:00:00Z", `(upload_date, id) < ($1, $2)`, "ORDER BY upload_date DESC, id DESC",
+            time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+    }
+    for _, tt := range tests {
+        cursor := listCursor{Sort: tt.sort, Desc: tt.desc, Value: tt.value, ID: 7}.encode()
+        page, err := pageAfter(db.Model(&models.File{}), tt.sort, tt.desc, cursor)
+        if err != nil {
+            t.Fatalf("%s desc=%v: %v", tt.sort, tt.desc, err)
+        }
+        stmt := page.Find(&[]models.File{}).Statement
+        sql := stmt.SQL.String()
+        if !strings.Contains(sql, tt.wantWhere) || !strings.HasSuffix(sql, tt.wantOrder) {
+            t.Errorf("%s desc=%v: SQL %q, want %q and %q", tt.sort, tt.desc, sql, tt.wantWhere, tt.wantOrder)
+        }
+        // Rows sharing the sort value are told apart by their ID, so the
+        // next page starts after the last row rather than after its value
+        if want := []interface{}{tt.wantValue, uint(7)}; !reflect.DeepEqual(stmt.Vars, want) {
+            t.Errorf("%s desc=%v: vars %#v, want %#v", tt.sort, tt.desc, stmt.Vars, want)
+        }
+    }
+}
+
+func TestPageAfterFirstPage(t *testing.T) {
+    page, err := pageAfter(dryRunDB(t).Model(&models.File{}), "size", true, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    sql := page.Find(&[]models.File{}).Statement.SQL.String()
+    if strings.Contains(sql, "WHERE (file_size, id)") || !strings.HasSuffix(sql, "ORDER BY file_size DESC, id DESC") {
+        t.Errorf("SQL %q", sql)
+    }
+}
+
+func TestPageAfterRejectsCursor(t *testing.T) {
+    db := dryRunDB(t)
+    b64 := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+    valid := listCursor{Sort: "size", Desc: false, Value: "1024", ID: 7}.encode()
+    tests := []struct {
+        name   string
+        sort   string
+        desc   bool
+        cursor string
+    }{
+        {"reversed order", "size", true, valid},
+        {"different sort", "name", false, valid},
+        {"not base64", "size", false, "not a cursor!"},
+        {"not JSON", "size", false, b64("size:1024:7")},
+        {"truncated", "size", false, valid[:len(valid)-4]},
+        {"tampered size", "size", false, listCursor{Sort: "size", Value: "1024 OR 1=1", ID: 7}.encode()},
+        {"tampered date", "date", true, listCursor{Sort: "date", Desc: true, Value: "yesterday", ID: 7}.encode()},
+        {"wrong field types", "size", false, b64(`{"s":"size","d":false,"v":1024,"i":"7"}`)},
+    }
+    for _, tt := range tests {
+        if _, err := pageAfter(db.Model(&models.File{}), tt.sort, tt.desc, tt.cursor); err == nil {
+            t.Errorf("%s: cursor accepted", tt.name)
+        }
+    }
+}
+
+func TestListFilesInvalidCursor(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    h := NewHandler(dryRunDB(t), nil)
+    for _, query := range []string{
+        "cursor=" + url.QueryEscape("%%%"),
+        "sort=name&cursor=" + listCursor{Sort: "size", Value: "1", ID: 1}.encode(),
+        "sort=size&order=asc&cursor=" + listCursor{Sort: "size", Value: "big", ID: 1}.encode(),
+    } {
+        w := httptest.NewRecorder()
+        c, _ := gin.CreateTestContext(w)
+        c.Request = httptest.NewRequest(http.MethodGet, "/api/files/list?"+query, nil)
+        c.Set("userID", uint(1))
+        h.ListFiles(c)
+        if w.Code != http.StatusBadRequest {
+            t.Errorf("%s: status %d, want %d", query, w.Code, http.StatusBadRequest)
+        }
+    }
+}
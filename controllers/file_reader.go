@@ -0,0 +1,66 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "io"
+    "os"
+)
+
+// fileReader reads a file's current content as an io.ReadSeeker, for
+// serving ranges with http.ServeContent. Storage objects can only be read
+// from the start, so seeking backwards reopens the object and seeking
+// forwards skips ahead.
+type fileReader struct {
+    h      *Handler
+    file   *models.File
+    body   io.ReadCloser
+    pos    int64 // position of body
+    offset int64 // position the next read starts at
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+    if r.body != nil && r.offset < r.pos {
+        r.body.Close()
+        r.body = nil
+    }
+    if r.body == nil {
+        body, err := r.h.Storage.Get(r.file.CloudPath)
+        if err != nil {
+            return 0, err
+        }
+        r.body, r.pos = body, 0
+    }
+    if r.offset > r.pos {
+        n, err := io.CopyN(io.Discard, r.body, r.offset-r.pos)
+        r.pos += n
+        if err != nil {
+            return 0, err
+        }
+    }
+
+    n, err := r.body.Read(p)
+    r.pos += int64(n)
+    r.offset = r.pos
+    return n, err
+}
+
+func (r *fileReader) Seek(offset int64, whence int) (int64, error) {
+    switch whence {
+    case io.SeekCurrent:
+        offset += r.offset
+    case io.SeekEnd:
+        offset += r.file.FileSize
+    }
+    if offset < 0 {
+        return 0, os.ErrInvalid
+    }
+    r.offset = offset
+    return offset, nil
+}
+
+func (r *fileReader) Close() error {
+    if r.body != nil {
+        return r.body.Close()
+    }
+    return nil
+}
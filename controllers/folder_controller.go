@@ -0,0 +1,465 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+var ErrInvalidName = errors.New("name must not be empty, \".\" or \"..\", or contain \"/\"")
+
+type CreateFolderRequest struct {
+    Name     string `json:"name" binding:"required"`
+    ParentID *uint  `json:"parent_id"` // omit for the root
+}
+
+type RenameFolderRequest struct {
+    Name string `json:"name" binding:"required"`
+}
+
+type MoveRequest struct {
+    FolderID *uint `json:"folder_id"` // null moves to the root
+}
+
+// validateName checks a file or folder name can be used as a path segment.
+func validateName(name string) error {
+    if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+        return ErrInvalidName
+    }
+    return nil
+}
+
+// inFolder restricts db to rows whose column refers to folderID, where a
+// nil folderID means the root.
+func inFolder(db *gorm.DB, column string, folderID *uint) *gorm.DB {
+    if folderID == nil {
+        return db.Where(column + " IS NULL")
+    }
+    return db.Where(column+" = ?", *folderID)
+}
+
+// checkFolder verifies that folderID is nil (the root) or one of userID's
+// folders.
+func (h *Handler) checkFolder(userID uint, folderID *uint) error {
+    if folderID == nil {
+        return nil
+    }
+    var folder models.Folder
+    return h.DB.Where("id = ? AND user_id = ?", *folderID, userID).First(&folder).Error
+}
+
+// parseFolderID parses an optional folder_id form or metadata value, an
+// empty value meaning the root.
+func parseFolderID(value string) (*uint, error) {
+    if value == "" {
+        return nil, nil
+    }
+    id, err := strconv.ParseUint(value, 10, 64)
+    if err != nil {
+        return nil, err
+    }
+    folderID := uint(id)
+    return &folderID, nil
+}
+
+// liveFolder returns folderID if it still exists, or nil so that content
+// whose folder was deleted in the meantime lands in the root.
+func (h *Handler) liveFolder(userID uint, folderID *uint) *uint {
+    if h.checkFolder(userID, folderID) != nil {
+        return nil
+    }
+    return folderID
+}
+
+// folderNameTaken reports whether parentID already holds a folder called
+// name, other than the folder excludeID.
+func (h *Handler) folderNameTaken(userID uint, parentID *uint, name string, excludeID uint) bool {
+    var count int64
+    inFolder(h.DB.Model(&models.Folder{}), "parent_id", parentID).
+        Where("user_id = ? AND name = ? AND id <> ?", userID, name, excludeID).Count(&count)
+    return count > 0
+}
+
+// folderSubtree returns rootID and the IDs of every folder below it.
+func (h *Handler) folderSubtree(userID, rootID uint) ([]uint, error) {
+    ids := []uint{rootID}
+    frontier := []uint{rootID}
+    for len(frontier) > 0 {
+        var children []uint
+        if err := h.DB.Model(&models.Folder{}).Where("user_id = ? AND parent_id IN ?", userID, frontier).
+            Pluck("id", &children).Error; err != nil {
+            return nil, err
+        }
+        ids = append(ids, children...)
+        frontier = children
+    }
+    return ids, nil
+}
+
+// folderPath returns the absolute path of folderID, "/" for the root.
+func (h *Handler) folderPath(folderID *uint) (string, error) {
+    var segments []string
+    for folderID != nil {
+        var folder models.Folder
+        if err := h.DB.First(&folder, *folderID).Error; err != nil {
+            return "", err
+        }
+        segments = append([]string{folder.Name}, segments...)
+        folderID = folder.ParentID
+    }
+    return "/" + strings.Join(segments, "/"), nil
+}
+
+// resolveFolder walks segments from the root of userID's drive and returns
+// the folder they name, nil meaning the root.
+func (h *Handler) resolveFolder(userID uint, segments []string) (*uint, error) {
+    var folderID *uint
+    for _, name := range segments {
+        var folder models.Folder
+        if err := inFolder(h.DB, "parent_id", folderID).
+            Where("user_id = ? AND name = ?", userID, name).First(&folder).Error; err != nil {
+            return nil, err
+        }
+        folderID = &folder.ID
+    }
+    return folderID, nil
+}
+
+// ensureFolders walks segments from the root of userID's drive like
+// resolveFolder, creating the folders that do not exist yet.
+func (h *Handler) ensureFolders(userID uint, segments []string) (*uint, error) {
+    var folderID *uint
+    for _, name := range segments {
+        if err := validateName(name); err != nil {
+            return nil, err
+        }
+        var folder models.Folder
+        err := inFolder(h.DB, "parent_id", folderID).Where("user_id = ? AND name = ?", userID, name).First(&folder).Error
+        if errors.Is(err, gorm.ErrRecordNotFound) {
+            folder = models.Folder{UserID: userID, Name: name, ParentID: folderID}
+            if err = h.DB.Create(&folder).Error; err == nil {
+                h.folderChanged(&folder, models.ChangeCreate)
+            }
+        }
+        if err != nil {
+            return nil, err
+        }
+        folderID = &folder.ID
+    }
+    return folderID, nil
+}
+
+// splitPath breaks a slash separated path into its non-empty segments.
+func splitPath(path string) []string {
+    var segments []string
+    for _, segment := range strings.Split(path, "/") {
+        if segment != "" {
+            segments = append(segments, segment)
+        }
+    }
+    return segments
+}
+
+// deleteFolderTree deletes folder and every folder below it, moving the
+// files inside to the trash. Direct uploads still waiting to be confirmed
+// were never charged for, so they are dropped outright with their objects
+// rather than trashed. It returns how many folders were deleted and how
+// many files were trashed.
+func (h *Handler) deleteFolderTree(folder *models.Folder) (int, int64, error) {
+    subtree, err := h.folderSubtree(folder.UserID, folder.ID)
+    if err != nil {
+        return 0, 0, err
+    }
+
+    var files, pending []models.File
+    var folders []models.Folder
+    err = h.DB.Transaction(func(tx *gorm.DB) error {
+        available := tx.Where("user_id = ? AND folder_id IN ? AND status = ?", folder.UserID, subtree, models.FileStatusAvailable)
+        if err := available.Session(&gorm.Session{}).Find(&files).Error; err != nil {
+            return err
+        }
+        if err := tx.Where("id IN ?", subtree).Find(&folders).Error; err != nil {
+            return err
+        }
+        if err := available.Session(&gorm.Session{}).Delete(&models.File{}).Error; err != nil {
+            return err
+        }
+        if err := tx.Unscoped().Clauses(clause.Returning{}).
+            Where("user_id = ? AND folder_id IN ? AND status = ?", folder.UserID, subtree, models.FileStatusPending).
+            Delete(&pending).Error; err != nil {
+            return err
+        }
+        return tx.Where("id IN ?", subtree).Delete(&models.Folder{}).Error
+    })
+    if err != nil {
+        return 0, 0, err
+    }
+    for _, file := range pending {
+        h.Storage.Delete(file.CloudPath)
+    }
+
+    // Journal the files first, then the folders from the deepest up, so a
+    // client replaying the changes never removes a folder that is not empty
+    changes := make([]models.Change, 0, len(files)+len(folders))
+    for i := range files {
+        changes = append(changes, fileChange(&files[i], models.ChangeDelete))
+    }
+    byID := make(map[uint]*models.Folder, len(folders))
+    for i := range folders {
+        byID[folders[i].ID] = &folders[i]
+    }
+    for i := len(subtree) - 1; i >= 0; i-- {
+        if deleted, ok := byID[subtree[i]]; ok {
+            changes = append(changes, folderChange(deleted, models.ChangeDelete))
+        }
+    }
+    h.recordChanges(folder.UserID, changes...)
+    return len(subtree), int64(len(files)), nil
+}
+
+// CreateFolder creates a folder at the root or inside another folder
+func (h *Handler) CreateFolder(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var req CreateFolderRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    if err := validateName(req.Name); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    if err := h.checkFolder(userID.(uint), req.ParentID); err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "parent folder not found"})
+        return
+    }
+    if h.folderNameTaken(userID.(uint), req.ParentID, req.Name, 0) {
+        c.JSON(http.StatusConflict, gin.H{"error": "a folder with this name already exists"})
+        return
+    }
+
+    folder := models.Folder{
+        UserID:   userID.(uint),
+        Name:     req.Name,
+        ParentID: req.ParentID,
+    }
+    if result := h.DB.Create(&folder); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create folder"})
+        return
+    }
+    h.folderChanged(&folder, models.ChangeCreate)
+
+    c.JSON(http.StatusCreated, folder)
+}
+
+// ListFolder returns the folders and files directly inside a folder, or
+// inside the root when no id is given
+func (h *Handler) ListFolder(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var folderID *uint
+    if c.Param("id") != "" {
+        var folder models.Folder
+        if result := h.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&folder); result.Error != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+            return
+        }
+        folderID = &folder.ID
+    }
+
+    path, err := h.folderPath(folderID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to resolve folder path"})
+        return
+    }
+
+    var folders []models.Folder
+    if result := inFolder(h.DB, "parent_id", folderID).Where("user_id = ?", userID).
+        Order("name").Find(&folders); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch folders"})
+        return
+    }
+
+    var files []models.File
+    if result := inFolder(h.DB, "folder_id", folderID).Where("user_id = ? AND status = ?",
+        userID, models.FileStatusAvailable).Order("file_name").Find(&files); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch files"})
+        return
+    }
+    h.attachThumbnailURLs(files, DefaultThumbnailSize)
+
+    c.JSON(http.StatusOK, gin.H{
+        "folder_id": folderID,
+        "path":      path,
+        "folders":   folders,
+        "files":     files,
+    })
+}
+
+// RenameFolder changes a folder's name
+func (h *Handler) RenameFolder(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var req RenameFolderRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    if err := validateName(req.Name); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    var folder models.Folder
+    if result := h.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&folder); result.Error != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+        return
+    }
+    if h.folderNameTaken(folder.UserID, folder.ParentID, req.Name, folder.ID) {
+        c.JSON(http.StatusConflict, gin.H{"error": "a folder with this name already exists"})
+        return
+    }
+
+    folder.Name = req.Name
+    if result := h.DB.Save(&folder); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rename folder"})
+        return
+    }
+    h.folderChanged(&folder, models.ChangeMove)
+
+    c.JSON(http.StatusOK, folder)
+}
+
+// MoveFolder moves a folder, with everything inside it, under another
+// folder or to the root
+func (h *Handler) MoveFolder(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var req MoveRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    var folder models.Folder
+    if result := h.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&folder); result.Error != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+        return
+    }
+    if err := h.checkFolder(folder.UserID, req.FolderID); err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "destination folder not found"})
+        return
+    }
+
+    // A folder cannot be moved into itself or one of its descendants
+    if req.FolderID != nil {
+        subtree, err := h.folderSubtree(folder.UserID, folder.ID)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to move folder"})
+            return
+        }
+        for _, id := range subtree {
+            if id == *req.FolderID {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "cannot move a folder into itself"})
+                return
+            }
+        }
+    }
+    if h.folderNameTaken(folder.UserID, req.FolderID, folder.Name, folder.ID) {
+        c.JSON(http.StatusConflict, gin.H{"error": "a folder with this name already exists at the destination"})
+        return
+    }
+
+    if result := h.DB.Model(&folder).Update("parent_id", req.FolderID); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to move folder"})
+        return
+    }
+    folder.ParentID = req.FolderID
+    h.folderChanged(&folder, models.ChangeMove)
+
+    c.JSON(http.StatusOK, folder)
+}
+
+// DeleteFolder deletes a folder and everything below it. The files inside
+// are moved to the trash.
+func (h *Handler) DeleteFolder(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var folder models.Folder
+    if result := h.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&folder); result.Error != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+        return
+    }
+
+    deleted, trashed, err := h.deleteFolderTree(&folder)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete folder"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "message":         "folder deleted",
+        "folders_deleted": deleted,
+        "files_trashed":   trashed,
+    })
+}
+
+// ResolvePath looks up a file by its absolute path, such as
+// /reports/2026/q3.pdf
+func (h *Handler) ResolvePath(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    segments := splitPath(c.Query("path"))
+    if len(segments) == 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "path is required"})
+        return
+    }
+
+    folderID, err := h.resolveFolder(userID.(uint), segments[:len(segments)-1])
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+        return
+    }
+    file, err := h.findFileByName(userID.(uint), folderID, segments[len(segments)-1])
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to resolve path"})
+        return
+    }
+    if file == nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+        return
+    }
+
+    c.JSON(http.StatusOK, file)
+}
@@ -0,0 +1,19 @@
+package controllers
+
+import (
+    "CloudBox/storage"
+
+    "gorm.io/gorm"
+)
+
+// Handler holds the application-scoped dependencies shared by every route.
+// It is created once at startup so requests reuse the same connection pool
+// and storage client.
+type Handler struct {
+    DB      *gorm.DB
+    Storage storage.Storage
+}
+
+func NewHandler(db *gorm.DB, store storage.Storage) *Handler {
+    return &Handler{DB: db, Storage: store}
+}
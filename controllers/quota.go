@@ -0,0 +1,79 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "CloudBox/utils"
+    "errors"
+    "net/http"
+    "strconv"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+const DefaultQuotaBytes = 10 << 30 // 10 GB
+
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// deploymentQuota returns the quota applied to users without their own,
+// taken from DEFAULT_QUOTA_BYTES when set.
+func deploymentQuota() int64 {
+    if quota, err := strconv.ParseInt(utils.GetEnv("DEFAULT_QUOTA_BYTES"), 10, 64); err == nil && quota > 0 {
+        return quota
+    }
+    return DefaultQuotaBytes
+}
+
+// effectiveQuota returns the number of bytes user may store.
+func effectiveQuota(user *models.User) int64 {
+    if user.QuotaBytes > 0 {
+        return user.QuotaBytes
+    }
+    return deploymentQuota()
+}
+
+// checkQuota reports whether userID has room for size more bytes without
+// reserving them.
+func (h *Handler) checkQuota(userID uint, size int64) error {
+    var user models.User
+    if err := h.DB.First(&user, userID).Error; err != nil {
+        return err
+    }
+    if user.UsedBytes+size > effectiveQuota(&user) {
+        return ErrQuotaExceeded
+    }
+    return nil
+}
+
+// chargeUsage adds size bytes to userID's usage, failing with
+// ErrQuotaExceeded when that would go over quota. The check and update are
+// a single statement so concurrent uploads cannot overshoot.
+func (h *Handler) chargeUsage(userID uint, size int64) error {
+    result := h.DB.Model(&models.User{}).
+        Where("id = ? AND used_bytes + ? <= CASE WHEN quota_bytes > 0 THEN quota_bytes ELSE ? END",
+            userID, size, deploymentQuota()).
+        Update("used_bytes", gorm.Expr("used_bytes + ?", size))
+    if result.Error != nil {
+        return result.Error
+    }
+    if result.RowsAffected == 0 {
+        return ErrQuotaExceeded
+    }
+    return nil
+}
+
+// creditUsage gives size bytes back to userID, after a delete or a failed
+// upload that had already been charged.
+func (h *Handler) creditUsage(userID uint, size int64) error {
+    return h.DB.Model(&models.User{}).Where("id = ?", userID).
+        Update("used_bytes", gorm.Expr("GREATEST(used_bytes - ?, 0)", size)).Error
+}
+
+// quotaError writes the response for a failed quota check or charge.
+func quotaError(c *gin.Context, err error) {
+    if errors.Is(err, ErrQuotaExceeded) {
+        c.JSON(http.StatusInsufficientStorage, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check storage quota"})
+}
@@ -0,0 +1,251 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "CloudBox/storage"
+    "errors"
+    "strings"
+    "time"
+
+    "gorm.io/gorm"
+)
+
+const (
+    IssueOrphanObject  = "orphan_object"  // object no row refers to
+    IssueMissingObject = "missing_object" // row whose object is gone
+    IssueSizeMismatch  = "size_mismatch"  // row and object disagree on size
+)
+
+// ReconcileOptions controls a Reconcile run.
+type ReconcileOptions struct {
+    // Fix repairs the issues found instead of only reporting them.
+    Fix bool
+    // MinAge leaves objects and rows younger than this alone, since an
+    // upload may have stored its object and not yet written its row, and
+    // a row written during the run may refer to an object listed too late.
+    MinAge time.Duration
+}
+
+// ReconcileIssue is one disagreement between storage and the database.
+type ReconcileIssue struct {
+    Kind         string `json:"kind"`
+    Key          string `json:"key"`
+    Table        string `json:"table,omitempty"`
+    RowID        uint   `json:"row_id,omitempty"`
+    ObjectSize   int64  `json:"object_size,omitempty"`
+    RecordedSize int64  `json:"recorded_size,omitempty"`
+    Fixed        bool   `json:"fixed"`
+    Error        string `json:"error,omitempty"`
+}
+
+// ReconcileReport summarises a Reconcile run.
+type ReconcileReport struct {
+    Objects int              `json:"objects"`
+    Rows    int              `json:"rows"`
+    Issues  []ReconcileIssue `json:"issues"`
+}
+
+// objectOwner strips the thumbnail suffix from key, returning the key of
+// the object the thumbnail was generated from.
+func objectOwner(key string) string {
+    if i := strings.LastIndex(key, ".thumb-"); i >= 0 {
+        if _, ok := ThumbnailSizes[key[i+len(".thumb-"):]]; ok {
+            return key[:i]
+        }
+    }
+    return key
+}
+
+var errObjectPresent = errors.New("object exists after all, left alone")
+
+// confirmMissing checks, just before a row is purged, that it still refers
+// to key and that the object under key is really gone. The listing is a
+// snapshot, and the row may have been re-pointed or the object stored
+// since.
+func (h *Handler) confirmMissing(key, current string) error {
+    if current != key {
+        return errObjectPresent
+    }
+    _, err := h.Storage.Stat(key)
+    if err == nil {
+        return errObjectPresent
+    }
+    if errors.Is(err, storage.ErrNotFound) {
+        return nil
+    }
+    return err
+}
+
+// adjustUsage changes userID's recorded usage by delta bytes, without the
+// quota check an upload would get.
+func (h *Handler) adjustUsage(userID uint, delta int64) error {
+    return h.DB.Model(&models.User{}).Where("id = ?", userID).
+        Update("used_bytes", gorm.Expr("GREATEST(used_bytes + ?, 0)", delta)).Error
+}
+
+// Reconcile compares every object in storage with the files, versions and
+// blobs that refer to them. It reports objects nothing refers to, rows
+// whose object has gone and rows whose size differs from the object's.
+// With opts.Fix, orphan objects are deleted, dangling files and versions
+// are purged and recorded sizes are corrected to match storage.
+func (h *Handler) Reconcile(opts ReconcileOptions) (*ReconcileReport, error) {
+    // Rows written since shortly before the listing may refer to objects
+    // it could not include, so they are not judged against it
+    cutoff := time.Now().Add(-opts.MinAge)
+    objects, err := h.Storage.List("")
+    if err != nil {
+        return nil, err
+    }
+    stored := make(map[string]storage.ObjectInfo, len(objects))
+    for _, object := range objects {
+        stored[object.Key] = object
+    }
+
+    var files []models.File
+    if err := h.DB.Unscoped().Find(&files).Error; err != nil {
+        return nil, err
+    }
+    var versions []models.FileVersion
+    if err := h.DB.Unscoped().Find(&versions).Error; err != nil {
+        return nil, err
+    }
+    var blobPaths, sessionPaths []string
+    if err := h.DB.Model(&models.Blob{}).Pluck("cloud_path", &blobPaths).Error; err != nil {
+        return nil, err
+    }
+    if err := h.DB.Model(&models.UploadSession{}).Where("status IN ?", []string{models.UploadSessionActive, models.UploadSessionCompleting}).
+        Pluck("cloud_path", &sessionPaths).Error; err != nil {
+        return nil, err
+    }
+
+    referenced := make(map[string]bool)
+    owners := make(map[uint]*models.File, len(files))
+    for i := range files {
+        referenced[files[i].CloudPath] = true
+        owners[files[i].ID] = &files[i]
+    }
+    for _, version := range versions {
+        referenced[version.CloudPath] = true
+    }
+    for _, p := range append(blobPaths, sessionPaths...) {
+        referenced[p] = true
+    }
+
+    report := &ReconcileReport{Objects: len(objects), Rows: len(files) + len(versions)}
+    record := func(issue ReconcileIssue, fix func() error) {
+        if opts.Fix {
+            if err := fix(); err != nil {
+                issue.Error = err.Error()
+            } else {
+                issue.Fixed = true
+            }
+        }
+        report.Issues = append(report.Issues, issue)
+    }
+
+    for _, object := range objects {
+        if referenced[objectOwner(object.Key)] || time.Since(object.LastModified) < opts.MinAge {
+            continue
+        }
+        key := object.Key
+        record(ReconcileIssue{Kind: IssueOrphanObject, Key: key, ObjectSize: object.Size}, func() error {
+            return h.Storage.Delete(key)
+        })
+    }
+
+    // Versions go first, so that purging a dangling file does not leave
+    // them to be reported a second time
+    for i := range versions {
+        version := &versions[i]
+        if version.UpdatedAt.After(cutoff) {
+            continue
+        }
+        owner := owners[version.FileID]
+        object, ok := stored[version.CloudPath]
+        issue := ReconcileIssue{Key: version.CloudPath, Table: "file_versions", RowID: version.ID, RecordedSize: version.FileSize}
+        switch {
+        case !ok:
+            issue.Kind = IssueMissingObject
+            record(issue, func() error {
+                var current models.FileVersion
+                if err := h.DB.Unscoped().First(&current, version.ID).Error; err != nil {
+                    return err
+                }
+                if err := h.confirmMissing(version.CloudPath, current.CloudPath); err != nil {
+                    return err
+                }
+                if err := h.DB.Unscoped().Delete(version).Error; err != nil {
+                    return err
+                }
+                h.releaseContent(version.BlobID, version.CloudPath)
+                if owner != nil {
+                    h.creditUsage(owner.UserID, version.FileSize)
+                }
+                return nil
+            })
+        case object.Size != version.FileSize:
+            issue.Kind, issue.ObjectSize = IssueSizeMismatch, object.Size
+            record(issue, func() error {
+                // Update writes the new size into version, so take the
+                // difference first
+                delta := object.Size - version.FileSize
+                if err := h.DB.Model(version).Update("file_size", object.Size).Error; err != nil {
+                    return err
+                }
+                h.DB.Model(&models.Blob{}).Where("cloud_path = ?", object.Key).Update("size", object.Size)
+                if owner != nil {
+                    return h.adjustUsage(owner.UserID, delta)
+                }
+                return nil
+            })
+        }
+    }
+
+    for i := range files {
+        file := &files[i]
+        // Pending files are waiting for their object to be uploaded or
+        // confirmed, and files created or given new content since the
+        // cutoff may be newer than the listing
+        if file.Status != models.FileStatusAvailable || file.UpdatedAt.After(cutoff) {
+            continue
+        }
+        object, ok := stored[file.CloudPath]
+        issue := ReconcileIssue{Key: file.CloudPath, Table: "files", RowID: file.ID, RecordedSize: file.FileSize}
+        switch {
+        case !ok:
+            issue.Kind = IssueMissingObject
+            record(issue, func() error {
+                var current models.File
+                if err := h.DB.Unscoped().First(&current, file.ID).Error; err != nil {
+                    return err
+                }
+                if err := h.confirmMissing(file.CloudPath, current.CloudPath); err != nil {
+                    return err
+                }
+                if err := h.purgeFile(file); err != nil {
+                    return err
+                }
+                // Files in the trash were journaled as deleted already
+                if !file.DeletedAt.Valid {
+                    h.fileChanged(file, models.ChangeDelete)
+                }
+                return nil
+            })
+        case object.Size != file.FileSize:
+            issue.Kind, issue.ObjectSize = IssueSizeMismatch, object.Size
+            record(issue, func() error {
+                delta := object.Size - file.FileSize
+                if err := h.DB.Unscoped().Model(file).Update("file_size", object.Size).Error; err != nil {
+                    return err
+                }
+                h.DB.Model(&models.Blob{}).Where("cloud_path = ?", object.Key).Update("size", object.Size)
+                if !file.DeletedAt.Valid {
+                    h.fileChanged(file, models.ChangeUpdate)
+                }
+                return h.adjustUsage(file.UserID, delta)
+            })
+        }
+    }
+
+    return report, nil
+}
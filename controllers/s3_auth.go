@@ -0,0 +1,375 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "bufio"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+const (
+    sigV4Algorithm   = "AWS4-HMAC-SHA256"
+    amzDateFormat    = "20060102T150405Z"
+    maxClockSkew     = 15 * time.Minute
+    maxPresignExpiry = 7 * 24 * time.Hour
+    maxChunkSize     = 64 << 20
+
+    unsignedPayload  = "UNSIGNED-PAYLOAD"
+    streamingPayload = "STREAMING-" // prefix of the aws-chunked payload modes
+    signedChunks     = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+)
+
+// emptySHA256 is the hex SHA-256 of no bytes.
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+// sigV4 is a verified request signature. Streamed uploads sign each chunk
+// with the previous signature as seed, so it is kept to check them.
+type sigV4 struct {
+    key       []byte
+    amzDate   string
+    scope     string
+    signature string
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:])
+}
+
+// signingKey derives the SigV4 key for one day, region and service.
+func signingKey(secret, date, region, service string) []byte {
+    key := hmacSHA256([]byte("AWS4"+secret), date)
+    key = hmacSHA256(key, region)
+    key = hmacSHA256(key, service)
+    return hmacSHA256(key, "aws4_request")
+}
+
+// uriEncode percent-encodes everything but the unreserved characters, as
+// SigV4 requires, leaving slashes alone unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        ch := s[i]
+        switch {
+        case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+            ch == '-', ch == '_', ch == '.', ch == '~':
+            b.WriteByte(ch)
+        case ch == '/' && !encodeSlash:
+            b.WriteByte(ch)
+        default:
+            fmt.Fprintf(&b, "%%%02X", ch)
+        }
+    }
+    return b.String()
+}
+
+// canonicalQuery sorts and encodes the query parameters, leaving out the
+// signature itself when the request is presigned.
+func canonicalQuery(query url.Values) string {
+    var pairs []string
+    for key, values := range query {
+        if key == "X-Amz-Signature" {
+            continue
+        }
+        for _, value := range values {
+            pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+        }
+    }
+    sort.Strings(pairs)
+    return strings.Join(pairs, "&")
+}
+
+// canonicalHeaders renders the signed headers, lower case and with their
+// values trimmed, one per line.
+func canonicalHeaders(r *http.Request, signed []string) string {
+    var b strings.Builder
+    for _, name := range signed {
+        var value string
+        switch name {
+        case "host":
+            value = r.Host
+        case "content-length":
+            value = strconv.FormatInt(r.ContentLength, 10)
+        default:
+            value = strings.Join(r.Header.Values(name), ",")
+        }
+        b.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+    }
+    return b.String()
+}
+
+// sigV4Request holds the signature fields of a request, taken from its
+// Authorization header or, for presigned URLs, its query.
+type sigV4Request struct {
+    credential    string
+    signedHeaders string
+    signature     string
+    amzDate       string
+    payload       string
+    expires       time.Duration // presigned URLs only
+}
+
+func parseSigV4Request(r *http.Request) (*sigV4Request, error) {
+    query := r.URL.Query()
+    if query.Get("X-Amz-Algorithm") != "" {
+        if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+            return nil, s3ErrInvalidRequest("only " + sigV4Algorithm + " signatures are supported")
+        }
+        seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+        if err != nil || seconds < 1 || time.Duration(seconds)*time.Second > maxPresignExpiry {
+            return nil, s3ErrInvalidRequest("X-Amz-Expires must be between 1 and 604800 seconds")
+        }
+        req := &sigV4Request{
+            credential:    query.Get("X-Amz-Credential"),
+            signedHeaders: query.Get("X-Amz-SignedHeaders"),
+            signature:     query.Get("X-Amz-Signature"),
+            amzDate:       query.Get("X-Amz-Date"),
+            payload:       unsignedPayload,
+            expires:       time.Duration(seconds) * time.Second,
+        }
+        if payload := r.Header.Get("X-Amz-Content-Sha256"); payload != "" {
+            req.payload = payload
+        }
+        return req, nil
+    }
+
+    auth := r.Header.Get("Authorization")
+    if auth == "" {
+        return nil, errS3AccessDenied
+    }
+    if !strings.HasPrefix(auth, sigV4Algorithm+" ") {
+        return nil, s3ErrInvalidRequest("only " + sigV4Algorithm + " signatures are supported")
+    }
+    req := &sigV4Request{
+        amzDate: r.Header.Get("X-Amz-Date"),
+        payload: r.Header.Get("X-Amz-Content-Sha256"),
+    }
+    for _, field := range strings.Split(strings.TrimPrefix(auth, sigV4Algorithm+" "), ",") {
+        key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+        switch key {
+        case "Credential":
+            req.credential = value
+        case "SignedHeaders":
+            req.signedHeaders = value
+        case "Signature":
+            req.signature = value
+        }
+    }
+    if req.payload == "" {
+        return nil, s3ErrInvalidRequest("missing x-amz-content-sha256")
+    }
+    return req, nil
+}
+
+// canonicalRequest renders r in the canonical form SigV4 signs, covering
+// the headers in signedHeaders and the payload hash the client declared.
+func canonicalRequest(r *http.Request, signedHeaders, payload string) string {
+    return strings.Join([]string{
+        r.Method,
+        uriEncode(r.URL.Path, false),
+        canonicalQuery(r.URL.Query()),
+        canonicalHeaders(r, strings.Split(signedHeaders, ";")),
+        signedHeaders,
+        payload,
+    }, "\n")
+}
+
+// sigV4Signature signs a canonical request with the key for scope.
+func sigV4Signature(key []byte, amzDate, scope, canonical string) string {
+    stringToSign := strings.Join([]string{
+        sigV4Algorithm,
+        amzDate,
+        scope,
+        sha256Hex([]byte(canonical)),
+    }, "\n")
+    return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// verifySigV4 checks the request's SigV4 signature and returns the access
+// key it was made with.
+func (h *Handler) verifySigV4(r *http.Request) (*models.AccessKey, *sigV4, error) {
+    req, err := parseSigV4Request(r)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    // Credential is <access key>/<date>/<region>/<service>/aws4_request
+    parts := strings.Split(req.credential, "/")
+    if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" {
+        return nil, nil, s3ErrInvalidRequest("malformed credential")
+    }
+    signedAt, err := time.Parse(amzDateFormat, req.amzDate)
+    if err != nil || parts[1] != req.amzDate[:8] {
+        return nil, nil, s3ErrInvalidRequest("missing or malformed X-Amz-Date")
+    }
+    if req.expires > 0 {
+        if time.Now().After(signedAt.Add(req.expires)) {
+            return nil, nil, errS3Expired
+        }
+        // A URL signed in the future would stay valid for longer than
+        // maxPresignExpiry
+        if time.Until(signedAt) > maxClockSkew {
+            return nil, nil, errS3TimeSkewed
+        }
+    } else if d := time.Since(signedAt); d > maxClockSkew || d < -maxClockSkew {
+        return nil, nil, errS3TimeSkewed
+    }
+    signed := strings.Split(req.signedHeaders, ";")
+    if !sort.StringsAreSorted(signed) || sort.SearchStrings(signed, "host") == len(signed) {
+        return nil, nil, s3ErrInvalidRequest("SignedHeaders must be sorted and include host")
+    }
+
+    var key models.AccessKey
+    if err := h.DB.Where("access_key_id = ?", parts[0]).First(&key).Error; err != nil {
+        if errors.Is(err, gorm.ErrRecordNotFound) {
+            return nil, nil, errS3InvalidAccessKey
+        }
+        return nil, nil, err
+    }
+
+    scope := strings.Join(parts[1:], "/")
+    signingKey := signingKey(key.SecretKey, parts[1], parts[2], parts[3])
+    signature := sigV4Signature(signingKey, req.amzDate, scope, canonicalRequest(r, req.signedHeaders, req.payload))
+    if !hmac.Equal([]byte(signature), []byte(req.signature)) {
+        return nil, nil, errS3SignatureMismatch
+    }
+
+    return &key, &sigV4{key: signingKey, amzDate: req.amzDate, scope: scope, signature: signature}, nil
+}
+
+// S3Auth authenticates S3 gateway requests by their SigV4 signature,
+// either in the Authorization header or in a presigned URL's query.
+func (h *Handler) S3Auth(c *gin.Context) {
+    key, sig, err := h.verifySigV4(c.Request)
+    if err != nil {
+        s3Error(c, err)
+        c.Abort()
+        return
+    }
+
+    var user models.User
+    if err := h.DB.First(&user, key.UserID).Error; err != nil {
+        s3Error(c, errS3InvalidAccessKey)
+        c.Abort()
+        return
+    }
+    if user.Disabled {
+        s3Error(c, errS3AccessDenied)
+        c.Abort()
+        return
+    }
+
+    // Record use at most once a minute rather than on every request
+    now := time.Now()
+    h.DB.Model(&models.AccessKey{}).
+        Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", key.ID, now.Add(-time.Minute)).
+        Update("last_used_at", now)
+
+    c.Set("currentUser", user)
+    c.Set("userID", user.ID)
+    c.Set("s3Signature", sig)
+    c.Next()
+}
+
+// chunkedReader removes aws-chunked framing from a streamed upload body.
+// Each chunk is "<hex size>[;chunk-signature=<sig>]\r\n<data>\r\n", ending
+// with an empty chunk and optional trailers. When sig is set, every chunk's
+// signature is checked before its data is returned.
+type chunkedReader struct {
+    r     *bufio.Reader
+    sig   *sigV4
+    prev  string // signature of the previous chunk
+    chunk []byte
+    done  bool
+}
+
+func newChunkedReader(body io.Reader, sig *sigV4) *chunkedReader {
+    cr := &chunkedReader{r: bufio.NewReader(body), sig: sig}
+    if sig != nil {
+        cr.prev = sig.signature
+    }
+    return cr
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+    for len(cr.chunk) == 0 {
+        if cr.done {
+            return 0, io.EOF
+        }
+        if err := cr.next(); err != nil {
+            return 0, err
+        }
+    }
+    n := copy(p, cr.chunk)
+    cr.chunk = cr.chunk[n:]
+    return n, nil
+}
+
+// next reads and verifies the following chunk.
+func (cr *chunkedReader) next() error {
+    line, err := cr.r.ReadString('\n')
+    if err != nil {
+        return io.ErrUnexpectedEOF
+    }
+    header, signature, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+    size, err := strconv.ParseInt(header, 16, 64)
+    if err != nil || size < 0 || size > maxChunkSize {
+        return s3ErrInvalidRequest("malformed aws-chunked body")
+    }
+
+    data := make([]byte, size)
+    if _, err := io.ReadFull(cr.r, data); err != nil {
+        return io.ErrUnexpectedEOF
+    }
+    if cr.sig != nil {
+        stringToSign := strings.Join([]string{
+            sigV4Algorithm + "-PAYLOAD",
+            cr.sig.amzDate,
+            cr.sig.scope,
+            cr.prev,
+            emptySHA256,
+            sha256Hex(data),
+        }, "\n")
+        expected := hex.EncodeToString(hmacSHA256(cr.sig.key, stringToSign))
+        if !hmac.Equal([]byte("chunk-signature="+expected), []byte(signature)) {
+            return errS3SignatureMismatch
+        }
+        cr.prev = expected
+    }
+
+    if size == 0 {
+        // Skip any trailers, which end with an empty line
+        for {
+            line, err := cr.r.ReadString('\n')
+            if strings.TrimSpace(line) == "" || err != nil {
+                break
+            }
+        }
+        cr.done = true
+        return nil
+    }
+    if crlf, err := cr.r.ReadString('\n'); err != nil || crlf != "\r\n" {
+        return s3ErrInvalidRequest("malformed aws-chunked body")
+    }
+    cr.chunk = data
+    return nil
+}
@@ -0,0 +1,1008 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "crypto/md5"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+const (
+    s3Namespace      = "http://s3.amazonaws.com/doc/2006-03-01/"
+    s3TimeFormat     = "2006-01-02T15:04:05.000Z"
+    MaxS3ListKeys    = 1000
+    MaxS3DeleteKeys  = 1000
+    maxS3RequestXML  = 1 << 20
+    s3MetadataPrefix = "X-Amz-Meta-"
+)
+
+// emptyMD5 is the ETag S3 gives empty objects, used for folder markers.
+var emptyMD5 = hex.EncodeToString(md5.New().Sum(nil))
+
+// s3APIError is an error reported to S3 clients with its S3 error code.
+type s3APIError struct {
+    status  int
+    code    string
+    message string
+}
+
+func (e *s3APIError) Error() string { return e.message }
+
+var (
+    errS3AccessDenied      = &s3APIError{http.StatusForbidden, "AccessDenied", "Access Denied"}
+    errS3Expired           = &s3APIError{http.StatusForbidden, "AccessDenied", "Request has expired"}
+    errS3InvalidAccessKey  = &s3APIError{http.StatusForbidden, "InvalidAccessKeyId", "The access key ID you provided does not exist in our records."}
+    errS3SignatureMismatch = &s3APIError{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+    errS3TimeSkewed        = &s3APIError{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large."}
+    errS3NoSuchBucket      = &s3APIError{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist."}
+    errS3NoSuchKey         = &s3APIError{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+    errS3NoSuchUpload      = &s3APIError{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist."}
+    errS3BucketOwned       = &s3APIError{http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it."}
+    errS3MalformedXML      = &s3APIError{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema."}
+    errS3InvalidDigest     = &s3APIError{http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified is not valid."}
+    errS3ContentSHA256     = &s3APIError{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."}
+    errS3IncompleteBody    = &s3APIError{http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header."}
+    errS3EntityTooLarge    = &s3APIError{http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size."}
+    errS3MissingLength     = &s3APIError{http.StatusLengthRequired, "MissingContentLength", "You must provide the Content-Length HTTP header."}
+    errS3NotImplemented    = &s3APIError{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented."}
+)
+
+func s3ErrInvalidRequest(message string) error {
+    return &s3APIError{http.StatusBadRequest, "InvalidRequest", message}
+}
+
+type s3ErrorResponse struct {
+    XMLName  xml.Name `xml:"Error"`
+    Code     string   `xml:"Code"`
+    Message  string   `xml:"Message"`
+    Resource string   `xml:"Resource"`
+}
+
+type s3Bucket struct {
+    Name         string `xml:"Name"`
+    CreationDate string `xml:"CreationDate"`
+}
+
+type s3Owner struct {
+    ID          string `xml:"ID"`
+    DisplayName string `xml:"DisplayName"`
+}
+
+type s3ListBucketsResult struct {
+    XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+    Xmlns   string     `xml:"xmlns,attr"`
+    Owner   s3Owner    `xml:"Owner"`
+    Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+    Key          string `xml:"Key"`
+    LastModified string `xml:"LastModified"`
+    ETag         string `xml:"ETag"`
+    Size         int64  `xml:"Size"`
+    StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+    Prefix string `xml:"Prefix"`
+}
+
+// s3ListObjectsResult answers both ListObjects and ListObjectsV2; the
+// marker fields belong to the first and the key count and continuation
+// tokens to the second.
+type s3ListObjectsResult struct {
+    XMLName               xml.Name         `xml:"ListBucketResult"`
+    Xmlns                 string           `xml:"xmlns,attr"`
+    Name                  string           `xml:"Name"`
+    Prefix                string           `xml:"Prefix"`
+    Delimiter             string           `xml:"Delimiter,omitempty"`
+    MaxKeys               int              `xml:"MaxKeys"`
+    KeyCount              int              `xml:"KeyCount,omitempty"`
+    IsTruncated           bool             `xml:"IsTruncated"`
+    Marker                string           `xml:"Marker,omitempty"`
+    NextMarker            string           `xml:"NextMarker,omitempty"`
+    ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+    NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+    StartAfter            string           `xml:"StartAfter,omitempty"`
+    EncodingType          string           `xml:"EncodingType,omitempty"`
+    Contents              []s3Object       `xml:"Contents"`
+    CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3LocationResult struct {
+    XMLName xml.Name `xml:"LocationConstraint"`
+    Xmlns   string   `xml:"xmlns,attr"`
+}
+
+type s3InitiateResult struct {
+    XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+    Xmlns    string   `xml:"xmlns,attr"`
+    Bucket   string   `xml:"Bucket"`
+    Key      string   `xml:"Key"`
+    UploadID string   `xml:"UploadId"`
+}
+
+type s3CompleteRequest struct {
+    XMLName xml.Name `xml:"CompleteMultipartUpload"`
+    Parts   []struct {
+        PartNumber int    `xml:"PartNumber"`
+        ETag       string `xml:"ETag"`
+    } `xml:"Part"`
+}
+
+type s3CompleteResult struct {
+    XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+    Xmlns    string   `xml:"xmlns,attr"`
+    Location string   `xml:"Location"`
+    Bucket   string   `xml:"Bucket"`
+    Key      string   `xml:"Key"`
+    ETag     string   `xml:"ETag"`
+}
+
+type s3DeleteRequest struct {
+    XMLName xml.Name `xml:"Delete"`
+    Quiet   bool     `xml:"Quiet"`
+    Objects []struct {
+        Key string `xml:"Key"`
+    } `xml:"Object"`
+}
+
+type s3Deleted struct {
+    Key string `xml:"Key"`
+}
+
+type s3DeleteError struct {
+    Key     string `xml:"Key"`
+    Code    string `xml:"Code"`
+    Message string `xml:"Message"`
+}
+
+type s3DeleteResult struct {
+    XMLName xml.Name        `xml:"DeleteResult"`
+    Xmlns   string          `xml:"xmlns,attr"`
+    Deleted []s3Deleted     `xml:"Deleted"`
+    Errors  []s3DeleteError `xml:"Error"`
+}
+
+// s3Entry is one key of a user's virtual bucket: a file, or a folder
+// marker ending in a slash.
+type s3Entry struct {
+    key  string
+    file *models.File
+}
+
+// toS3Error translates CloudBox's own errors into the nearest S3 errors.
+func toS3Error(err error) *s3APIError {
+    var apiErr *s3APIError
+    switch {
+    case errors.As(err, &apiErr):
+        return apiErr
+    case errors.Is(err, ErrQuotaExceeded):
+        return &s3APIError{http.StatusForbidden, "QuotaExceeded", err.Error()}
+    case errors.Is(err, ErrContentTypeRejected), errors.Is(err, ErrInvalidName):
+        return &s3APIError{http.StatusBadRequest, "InvalidArgument", err.Error()}
+    case errors.Is(err, ErrChecksumMismatch):
+        return &s3APIError{http.StatusBadRequest, "BadDigest", err.Error()}
+    case errors.Is(err, ErrIncompleteUpload):
+        return &s3APIError{http.StatusBadRequest, "InvalidPart", err.Error()}
+    case errors.Is(err, ErrPartTooSmall):
+        return &s3APIError{http.StatusBadRequest, "EntityTooSmall", err.Error()}
+    case errors.Is(err, ErrUploadNotActive):
+        return errS3NoSuchUpload
+    }
+    log.Printf("S3 gateway error: %v", err)
+    return &s3APIError{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+}
+
+// s3Error writes err as an S3 XML error response.
+func s3Error(c *gin.Context, err error) {
+    apiErr := toS3Error(err)
+    c.XML(apiErr.status, s3ErrorResponse{
+        Code:     apiErr.code,
+        Message:  apiErr.message,
+        Resource: c.Request.URL.Path,
+    })
+}
+
+func s3Time(t time.Time) string {
+    return t.UTC().Format(s3TimeFormat)
+}
+
+// s3ETag returns a file's ETag: its MD5, as S3 gives objects uploaded in
+// one request. Files stored before MD5s were recorded get a tag that
+// clients will not mistake for one.
+func s3ETag(file *models.File) string {
+    if file.MD5 != "" {
+        return `"` + file.MD5 + `"`
+    }
+    return fmt.Sprintf(`"%d-%d"`, file.ID, file.Version)
+}
+
+// s3User returns the caller, checking that the request names their bucket,
+// which is named after their username.
+func s3User(c *gin.Context) (*models.User, bool) {
+    current, exists := c.Get("currentUser")
+    if !exists {
+        s3Error(c, errS3AccessDenied)
+        return nil, false
+    }
+    user := current.(models.User)
+    if bucket := c.Param("bucket"); bucket != "" && bucket != user.Username {
+        s3Error(c, errS3NoSuchBucket)
+        return nil, false
+    }
+    return &user, true
+}
+
+func s3Key(c *gin.Context) string {
+    return strings.TrimPrefix(c.Param("key"), "/")
+}
+
+// s3Body returns the request body with any aws-chunked framing removed,
+// and its size, or -1 when the client did not give it.
+func s3Body(c *gin.Context) (io.Reader, int64, error) {
+    payload := c.GetHeader("X-Amz-Content-Sha256")
+    if !strings.HasPrefix(payload, streamingPayload) {
+        return c.Request.Body, c.Request.ContentLength, nil
+    }
+    size, err := strconv.ParseInt(c.GetHeader("X-Amz-Decoded-Content-Length"), 10, 64)
+    if err != nil || size < 0 {
+        return nil, 0, s3ErrInvalidRequest("streamed uploads must give x-amz-decoded-content-length")
+    }
+    var sig *sigV4
+    if strings.HasPrefix(payload, signedChunks) {
+        if value, ok := c.Get("s3Signature"); ok {
+            sig = value.(*sigV4)
+        }
+    }
+    return newChunkedReader(c.Request.Body, sig), size, nil
+}
+
+// s3Checksums returns the checksums a request's body must match: the
+// SHA-256 it was signed with and the Content-MD5 header, where given.
+func s3Checksums(c *gin.Context) (Checksums, error) {
+    var expected Checksums
+    if payload := c.GetHeader("X-Amz-Content-Sha256"); sha256Pattern.MatchString(payload) {
+        expected.SHA256 = payload
+    }
+    if value := c.GetHeader("Content-MD5"); value != "" {
+        raw, err := base64.StdEncoding.DecodeString(value)
+        if err != nil || len(raw) != md5.Size {
+            return expected, errS3InvalidDigest
+        }
+        expected.MD5 = hex.EncodeToString(raw)
+    }
+    return expected, nil
+}
+
+// s3DecodeXML reads an XML request body into v. The body is checked
+// against the SHA-256 in X-Amz-Content-Sha256 first, as the signature
+// only covers that header and not the body itself.
+func s3DecodeXML(c *gin.Context, v interface{}) error {
+    body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxS3RequestXML))
+    if err != nil {
+        return errS3IncompleteBody
+    }
+    if payload := c.GetHeader("X-Amz-Content-Sha256"); sha256Pattern.MatchString(payload) && sha256Hex(body) != payload {
+        return errS3ContentSHA256
+    }
+    if err := xml.Unmarshal(body, v); err != nil {
+        return errS3MalformedXML
+    }
+    return nil
+}
+
+// s3File finds the available file an object key names.
+func (h *Handler) s3File(userID uint, key string) (*models.File, error) {
+    segments := splitPath(key)
+    if len(segments) == 0 || strings.HasSuffix(key, "/") {
+        return nil, errS3NoSuchKey
+    }
+    folderID, err := h.resolveFolder(userID, segments[:len(segments)-1])
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return nil, errS3NoSuchKey
+    }
+    if err != nil {
+        return nil, err
+    }
+    file, err := h.findFileByName(userID, folderID, segments[len(segments)-1])
+    if err != nil {
+        return nil, err
+    }
+    if file == nil {
+        return nil, errS3NoSuchKey
+    }
+    return file, nil
+}
+
+// s3Entries returns every key of userID's bucket in S3 order: a key per
+// available file, named by its folder path, and a marker per folder.
+func (h *Handler) s3Entries(userID uint) ([]s3Entry, error) {
+    var folders []models.Folder
+    if err := h.DB.Where("user_id = ?", userID).Find(&folders).Error; err != nil {
+        return nil, err
+    }
+    var files []models.File
+    if err := h.DB.Where("user_id = ? AND status = ?", userID, models.FileStatusAvailable).Find(&files).Error; err != nil {
+        return nil, err
+    }
+
+    byID := make(map[uint]*models.Folder, len(folders))
+    for i := range folders {
+        byID[folders[i].ID] = &folders[i]
+    }
+    prefixes := make(map[uint]string, len(folders))
+    var prefix func(id uint) (string, bool)
+    prefix = func(id uint) (string, bool) {
+        if p, ok := prefixes[id]; ok {
+            return p, true
+        }
+        folder, ok := byID[id]
+        if !ok {
+            return "", false
+        }
+        parent := ""
+        if folder.ParentID != nil {
+            if parent, ok = prefix(*folder.ParentID); !ok {
+                return "", false
+            }
+        }
+        prefixes[id] = parent + folder.Name + "/"
+        return prefixes[id], true
+    }
+
+    entries := make([]s3Entry, 0, len(folders)+len(files))
+    for _, folder := range folders {
+        if p, ok := prefix(folder.ID); ok {
+            entries = append(entries, s3Entry{key: p})
+        }
+    }
+    for i := range files {
+        p := ""
+        if files[i].FolderID != nil {
+            var ok bool
+            if p, ok = prefix(*files[i].FolderID); !ok {
+                continue
+            }
+        }
+        entries = append(entries, s3Entry{key: p + files[i].FileName, file: &files[i]})
+    }
+    sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+    return entries, nil
+}
+
+// s3Delete moves the file a key names to the trash. A folder marker key
+// deletes its folder only when the folder is empty, as deleting a marker
+// in S3 leaves the keys under it alone. Deleting a missing key succeeds.
+func (h *Handler) s3Delete(userID uint, key string) error {
+    if !strings.HasSuffix(key, "/") {
+        file, err := h.s3File(userID, key)
+        if errors.Is(err, errS3NoSuchKey) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if err := h.DB.Delete(file).Error; err != nil {
+            return err
+        }
+        h.fileChanged(file, models.ChangeDelete)
+        return nil
+    }
+
+    folderID, err := h.resolveFolder(userID, splitPath(key))
+    if errors.Is(err, gorm.ErrRecordNotFound) || folderID == nil {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    var folders, files int64
+    h.DB.Model(&models.Folder{}).Where("parent_id = ?", *folderID).Count(&folders)
+    h.DB.Model(&models.File{}).Where("folder_id = ?", *folderID).Count(&files)
+    if folders > 0 || files > 0 {
+        return nil
+    }
+    var folder models.Folder
+    if err := h.DB.First(&folder, *folderID).Error; err != nil {
+        return err
+    }
+    if err := h.DB.Delete(&folder).Error; err != nil {
+        return err
+    }
+    h.folderChanged(&folder, models.ChangeDelete)
+    return nil
+}
+
+// s3Session loads the caller's active multipart upload named by the
+// uploadId parameter, which must be for the request's key.
+func (h *Handler) s3Session(c *gin.Context, userID uint) (*models.UploadSession, error) {
+    var session models.UploadSession
+    err := h.DB.Where("id = ? AND user_id = ? AND status = ?", c.Query("uploadId"), userID, models.UploadSessionActive).
+        First(&session).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && session.FileName != path.Base(s3Key(c))) {
+        return nil, errS3NoSuchUpload
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &session, nil
+}
+
+// setS3Metadata records the x-amz-meta-* headers of an upload as file
+// metadata.
+func (h *Handler) setS3Metadata(file *models.File, header http.Header) error {
+    var entries []models.FileMetadata
+    for name, values := range header {
+        if key := strings.ToLower(strings.TrimPrefix(name, s3MetadataPrefix)); key != strings.ToLower(name) && key != "" {
+            value := strings.Join(values, ",")
+            if len(key) <= MaxMetadataKey && len(value) <= MaxMetadataValue {
+                entries = append(entries, models.FileMetadata{FileID: file.ID, Key: key, Value: value})
+            }
+        }
+    }
+    if len(entries) == 0 {
+        return nil
+    }
+    return h.upsertMetadata(entries)
+}
+
+// S3ListBuckets lists the caller's one bucket
+func (h *Handler) S3ListBuckets(c *gin.Context) {
+    user, ok := s3User(c)
+    if !ok {
+        return
+    }
+
+    c.XML(http.StatusOK, s3ListBucketsResult{
+        Xmlns:   s3Namespace,
+        Owner:   s3Owner{ID: strconv.FormatUint(uint64(user.ID), 10), DisplayName: user.Username},
+        Buckets: []s3Bucket{{Name: user.Username, CreationDate: s3Time(user.CreatedAt)}},
+    })
+}
+
+// S3HeadBucket confirms the bucket exists and is the caller's
+func (h *Handler) S3HeadBucket(c *gin.Context) {
+    if _, ok := s3User(c); !ok {
+        return
+    }
+    c.Status(http.StatusOK)
+}
+
+// S3CreateBucket answers clients that create their bucket before use. The
+// caller's bucket always exists and no other can be created.
+func (h *Handler) S3CreateBucket(c *gin.Context) {
+    if _, ok := s3User(c); !ok {
+        return
+    }
+    s3Error(c, errS3BucketOwned)
+}
+
+// S3GetBucket answers GetBucketLocation, ListObjects and ListObjectsV2
+func (h *Handler) S3GetBucket(c *gin.Context) {
+    user, ok := s3User(c)
+    if !ok {
+        return
+    }
+    query := c.Request.URL.Query()
+    if query.Has("location") {
+        c.XML(http.StatusOK, s3LocationResult{Xmlns: s3Namespace})
+        return
+    }
+    for _, subresource := range []string{"acl", "cors", "lifecycle", "policy", "uploads", "versioning", "versions", "tagging"} {
+        if query.Has(subresource) {
+            s3Error(c, errS3NotImplemented)
+            return
+        }
+    }
+
+    v2 := query.Get("list-type") == "2"
+    prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+    maxKeys := MaxS3ListKeys
+    if value := query.Get("max-keys"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 0 {
+            s3Error(c, &s3APIError{http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer"})
+            return
+        }
+        if n < maxKeys {
+            maxKeys = n
+        }
+    }
+
+    result := s3ListObjectsResult{
+        Xmlns:     s3Namespace,
+        Name:      user.Username,
+        Prefix:    prefix,
+        Delimiter: delimiter,
+        MaxKeys:   maxKeys,
+    }
+    // Listing resumes after the marker, start-after or continuation token
+    after := query.Get("marker")
+    if v2 {
+        result.StartAfter = query.Get("start-after")
+        after = result.StartAfter
+        if token := query.Get("continuation-token"); token != "" {
+            raw, err := base64.RawURLEncoding.DecodeString(token)
+            if err != nil {
+                s3Error(c, &s3APIError{http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect"})
+                return
+            }
+            result.ContinuationToken = token
+            after = string(raw)
+        }
+    } else {
+        result.Marker = after
+    }
+
+    entries, err := h.s3Entries(user.ID)
+    if err != nil {
+        s3Error(c, err)
+        return
+    }
+
+    // A common prefix stands for every key under it, so those keys are
+    // skipped once it has been listed, including on the page before
+    last, lastPrefix := "", after
+    count := 0
+    for _, entry := range entries {
+        if !strings.HasPrefix(entry.key, prefix) || entry.key <= after {
+            continue
+        }
+        if delimiter != "" {
+            if i := strings.Index(entry.key[len(prefix):], delimiter); i >= 0 {
+                common := entry.key[:len(prefix)+i+len(delimiter)]
+                if common == lastPrefix {
+                    continue
+                }
+                if count == maxKeys {
+                    result.IsTruncated = true
+                    break
+                }
+                result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: common})
+                last, lastPrefix = common, common
+                count++
+                continue
+            }
+        }
+        // Folders only show as common prefixes
+        if entry.file == nil {
+            continue
+        }
+        if count == maxKeys {
+            result.IsTruncated = true
+            break
+        }
+        result.Contents = append(result.Contents, s3Object{
+            Key:          entry.key,
+            LastModified: s3Time(entry.file.UploadDate),
+            ETag:         s3ETag(entry.file),
+            Size:         entry.file.FileSize,
+            StorageClass: "STANDARD",
+        })
+        last = entry.key
+        count++
+    }
+
+    if result.IsTruncated {
+        if v2 {
+            result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+        } else if delimiter != "" {
+            result.NextMarker = last
+        }
+    }
+    if v2 {
+        result.KeyCount = count
+    }
+    if query.Get("encoding-type") == "url" {
+        result.EncodingType = "url"
+        result.Prefix = uriEncode(result.Prefix, false)
+        result.Delimiter = uriEncode(result.Delimiter, false)
+        result.StartAfter = uriEncode(result.StartAfter, false)
+        result.Marker = uriEncode(result.Marker, false)
+        result.NextMarker = uriEncode(result.NextMarker, false)
+        for i := range result.Contents {
+            result.Contents[i].Key = uriEncode(result.Contents[i].Key, false)
+        }
+        for i := range result.CommonPrefixes {
+            result.CommonPrefixes[i].Prefix = uriEncode(result.CommonPrefixes[i].Prefix, false)
+        }
+    }
+
+    c.XML(http.StatusOK, result)
+}
+
+// S3DeleteObjects deletes up to 1000 keys in one request
+func (h *Handler) S3DeleteObjects(c *gin.Context) {
+    user, ok := s3User(c)
+    if !ok {
+        return
+    }
+    if !c.Request.URL.Query().Has("delete") {
+        s3Error(c, errS3NotImplemented)
+        return
+    }
+
+    var req s3DeleteRequest
+    if err := s3DecodeXML(c, &req); err != nil {
+        s3Error(c, err)
+        return
+    }
+    if len(req.Objects) > MaxS3DeleteKeys {
+        s3Error(c, errS3MalformedXML)
+        return
+    }
+
+    result := s3DeleteResult{Xmlns: s3Namespace}
+    for _, object := range req.Objects {
+        if err := h.s3Delete(user.ID, object.Key); err != nil {
+            apiErr := toS3Error(err)
+            result.Errors = append(result.Errors, s3DeleteError{Key: object.Key, Code: apiErr.code, Message: apiErr.message})
+        } else if !req.Quiet {
+            result.Deleted = append(result.Deleted, s3Deleted{Key: object.Key})
+        }
+    }
+
+    c.XML(http.StatusOK, result)
+}
+
+// S3GetObject downloads an object, honouring Range and conditional
+// headers. It answers HEAD requests too.
+func (h *Handler) S3GetObject(c *gin.Context) {
+    user, ok := s3User(c)
+    if !ok {
+        return
+    }
+    key := s3Key(c)
+    if key == "" {
+        h.S3GetBucket(c)
+        return
+    }
+
+    // Folder markers read as empty objects
+    if strings.HasSuffix(key, "/") {
+        folderID, err := h.resolveFolder(user.ID, splitPath(key))
+        if err != nil || folderID == nil {
+            s3Error(c, errS3NoSuchKey)
+            return
+        }
+        c.Header("ETag", `"`+emptyMD5+`"`)
+        c.Header("Content-Length", "0")
+        c.Status(http.StatusOK)
+        return
+    }
+
+    file, err := h.s3File(user.ID, key)
+    if err != nil {
+        s3Error(c, err)
+        return
+    }
+    if err := scanBlocked(file.ScanStatus, file.ScanResult); err != nil {
+        s3Error(c, &s3APIError{http.StatusForbidden, "AccessDenied", err.Error()})
+        return
+    }
+
+    var metadata []models.FileMetadata
+    h.DB.Where("file_id = ?", file.ID).Find(&metadata)
+    for _, entry := range metadata {
+        if validHeaderName(entry.Key) {
+            c.Header(s3MetadataPrefix+entry.Key, entry.Value)
+        }
+    }
+    c.Header("ETag", s3ETag(file))
+    c.Header("Content-Type", file.ContentType)
+    reader := &fileReader{h: h, file: file}
+    defer reader.Close()
+    http.ServeContent(c.Writer, c.Request, file.FileName, file.UploadDate, reader)
+}
+
+// validHeaderName reports whether a metadata key can be sent back as an
+// x-amz-meta-* header.
+func validHeaderName(name string) bool {
+    for _, ch := range name {
+        if !('a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || '0' <= ch && ch <= '9' || ch == '-' || ch == '_' || ch == '.') {
+            return false
+        }
+    }
+    return name != ""
+}
+
+// S3PutObject uploads an object, or one part of a multipart upload. Keys
+// map onto folders, which are created as needed; a key ending in a slash
+// just creates its folder. Uploading over an existing key adds a version.
+func (h *Handler) S3PutObject(c *gin.Context) {
+    user, ok := s3User(c)
+    if !ok {
+        return
+    }
+    if c.Request.URL.Query().Has("uploadId") {
+        h.s3UploadPart(c, user)
+        return
+    }
+    if c.GetHeader("X-Amz-Copy-Source") != "" {
+        s3Error(c, errS3NotImplemented)
+        return
+    }
+
+    key := s3Key(c)
+    segments := splitPath(key)
+    if len(segments) == 0 {
+        s3Error(c, s3ErrInvalidRequest("an object key is required"))
+        return
+    }
+    body, size, err := s3Body(c)
+    if err != nil {
+        s3Error(c, err)
+        return
+    }
+
+    if strings.HasSuffix(key, "/") {
+        if size > 0 {
+            s3Error(c, s3ErrInvalidRequest("folder objects must be empty"))
+            return
+        }
+        if _, err := h.ensureFolders(user.ID, segments); err != nil {
+            s3Error(c, err)
+            return
+        }
+        c.Header("ETag", `"`+emptyMD5+`"`)
+        c.Status(http.StatusOK)
+        return
+    }
+
+    // Refuse uploads that cannot succeed before their body is read
+    name := segments[len(segments)-1]
+    if size > MaxPartSize {
+        s3Error(c, errS3EntityTooLarge)
+        return
+    }
+    if err := validateName(name); err != nil {
+        s3Error(c, err)
+        return
+    }
+    if err := checkUploadPolicy(name, ""); err != nil {
+        s3Error(c, err)
+        return
+    }
+    if size > 0 {
+        if err := h.checkQuota(user.ID, size); err != nil {
+            s3Error(c, err)
+            return
+        }
+    }
+    expected, err := s3Checksums(c)
+    if err != nil {
+        s3Error(c, err)
+        return
+    }
+    folderID, err := h.ensureFolders(user.ID, segments[:len(segments)-1])
+    if err != nil {
+        s3Error(c, err)
+        return
+    }
+
+    tmp, err := os.CreateTemp("", "cloudbox-s3-*")
+    if err != nil {
+        s3Error(c, err)
+        return
+    }
+    defer os.Remove(tmp.Name())
+    defer tmp.Close()
+    n, err := io.Copy(tmp, io.LimitReader(body, MaxPartSize+1))
+    if err != nil {
+        s3Error(c, err)
+        return
+    }
+    if n > MaxPartSize {
+        s3Error(c, errS3EntityTooLarge)
+        return
+    }
+    if size >= 0 && n != size {
+        s3Error(c, errS3IncompleteBody)
+        return
+    }
+    if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+        s3Error(c, err)
+        return
+    }
+
+    file, err := h.saveUpload(user.ID, nil, folderID, name, tmp, n, expected)
+    if err != nil {
+        s3Error(c, err)
+        return
+    }
+    if err := h.setS3Metadata(file, c.Request.Header); err != nil {
+        log.Printf("Failed to record S3 metadata of file %d: %v", file.ID, err)
+    }
+
+    c.Header("ETag", s3ETag(file))
+    c.Status(http.StatusOK)
+}
+
+// s3UploadPart stores one part of a multipart upload
+func (h *Handler) s3UploadPart(c *gin.Context, user *models.User) {
+    partNumber, err := strconv.Atoi(c.Query("partNumber"))
+    if err != nil || partNumber < 1 || partNumber > MaxPartNumber {
+        s3Error(c, &s3APIError{http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("Part number must be an integer between 1 and %d", MaxPartNumber)})
+        return
+    }
+    session, err := h.s3Session(c, user.ID)
+    if err != nil {
+        s3Error(c, err)
+        return
+    }
+    body, size, err := s3Body(c)
+    if err != nil {
+        s3Error(c, err)
+        return
+    }
+    if size < 0 {
+        s3Error(c, errS3MissingLength)
+        return
+    }
+    if size > MaxPartSize {
+        s3Error(c, errS3EntityTooLarge)
+        return
+    }
+    expected, err := s3Checksums(c)
+    if err != nil {
+        s3Error(c, err)
+        return
+    }
+
+    part, err := h.storeSessionPart(session, partNumber, body, size, expected)
+    if err != nil {
+        s3Error(c, err)
+        return
+    }
+
+    c.Header("ETag", `"`+strings.Trim(part.ETag, `"`)+`"`)
+    c.Status(http.StatusOK)
+}
+
+// S3PostObject starts or completes a multipart upload
+func (h *Handler) S3PostObject(c *gin.Context) {
+    user, ok := s3User(c)
+    if !ok {
+        return
+    }
+    query := c.Request.URL.Query()
+    switch {
+    case query.Has("uploads"):
+        h.s3CreateMultipartUpload(c, user)
+    case query.Has("uploadId"):
+        h.s3CompleteMultipartUpload(c, user)
+    default:
+        s3Error(c, errS3NotImplemented)
+    }
+}
+
+func (h *Handler) s3CreateMultipartUpload(c *gin.Context, user *models.User) {
+    key := s3Key(c)
+    segments := splitPath(key)
+    if len(segments) == 0 || strings.HasSuffix(key, "/") {
+        s3Error(c, s3ErrInvalidRequest("an object key is required"))
+        return
+    }
+    name := segments[len(segments)-1]
+    if err := validateName(name); err != nil {
+        s3Error(c, err)
+        return
+    }
+    // The content is sniffed on completion, but a forbidden extension can
+    // be refused straight away
+    if err := checkUploadPolicy(name, ""); err != nil {
+        s3Error(c, err)
+        return
+    }
+    folderID, err := h.ensureFolders(user.ID, segments[:len(segments)-1])
+    if err != nil {
+        s3Error(c, err)
+        return
+    }
+
+    contentType := c.GetHeader("Content-Type")
+    if contentType == "" {
+        contentType = "application/octet-stream"
+    }
+    session, err := h.startUploadSession(user.ID, name, contentType, nil, folderID, Checksums{})
+    if err != nil {
+        s3Error(c, err)
+        return
+    }
+
+    c.XML(http.StatusOK, s3InitiateResult{
+        Xmlns:    s3Namespace,
+        Bucket:   user.Username,
+        Key:      key,
+        UploadID: strconv.FormatUint(uint64(session.ID), 10),
+    })
+}
+
+// s3CompleteMultipartUpload assembles an upload's parts. Every uploaded
+// part must be listed, in order and with its ETag.
+func (h *Handler) s3CompleteMultipartUpload(c *gin.Context, user *models.User) {
+    session, err := h.s3Session(c, user.ID)
+    if err != nil {
+        s3Error(c, err)
+        return
+    }
+    var req s3CompleteRequest
+    if err := s3DecodeXML(c, &req); err != nil {
+        s3Error(c, err)
+        return
+    }
+
+    var parts []models.UploadPart
+    if err := h.DB.Where("session_id = ?", session.ID).Order("part_number").Find(&parts).Error; err != nil {
+        s3Error(c, err)
+        return
+    }
+    if len(req.Parts) != len(parts) {
+        s3Error(c, fmt.Errorf("%w: every uploaded part must be listed", ErrIncompleteUpload))
+        return
+    }
+    for i, part := range req.Parts {
+        if part.PartNumber != parts[i].PartNumber || strings.Trim(part.ETag, `"`) != strings.Trim(parts[i].ETag, `"`) {
+            s3Error(c, fmt.Errorf("%w: part %d does not match the uploaded part", ErrIncompleteUpload, part.PartNumber))
+            return
+        }
+    }
+
+    file, err := h.completeSession(session)
+    if err != nil {
+        s3Error(c, err)
+        return
+    }
+
+    c.XML(http.StatusOK, s3CompleteResult{
+        Xmlns:    s3Namespace,
+        Location: "/" + user.Username + "/" + s3Key(c),
+        Bucket:   user.Username,
+        Key:      s3Key(c),
+        ETag:     s3ETag(file),
+    })
+}
+
+// S3DeleteObject moves an object to the trash, or aborts a multipart
+// upload
+func (h *Handler) S3DeleteObject(c *gin.Context) {
+    user, ok := s3User(c)
+    if !ok {
+        return
+    }
+
+    if c.Request.URL.Query().Has("uploadId") {
+        session, err := h.s3Session(c, user.ID)
+        if err == nil {
+            err = h.abortSession(session)
+        }
+        if err != nil {
+            s3Error(c, err)
+            return
+        }
+        c.Status(http.StatusNoContent)
+        return
+    }
+
+    if err := h.s3Delete(user.ID, s3Key(c)); err != nil {
+        s3Error(c, err)
+        return
+    }
+    c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,204 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "CloudBox/utils"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+var (
+    ErrFileQuarantined = errors.New("file is quarantined until its virus scan is clean")
+    ErrFileInfected    = errors.New("file is infected and cannot be downloaded")
+)
+
+// scanning holds the storage keys being scanned, so content uploaded
+// while a retry is running is not scanned twice at once.
+var scanning sync.Map
+
+// newScanStatus returns the status new content starts in: pending when a
+// scanner is configured with CLAMD_ADDR, so it is quarantined until
+// scanned, and unscanned otherwise.
+func newScanStatus() string {
+    if utils.NewClamd() != nil {
+        return models.ScanStatusPending
+    }
+    return models.ScanStatusUnscanned
+}
+
+// scanBlocked returns why content with the given scan status cannot be
+// served, or nil when it can.
+func scanBlocked(status, result string) error {
+    switch status {
+    case models.ScanStatusPending, models.ScanStatusFailed:
+        return ErrFileQuarantined
+    case models.ScanStatusInfected:
+        return fmt.Errorf("%w (%s)", ErrFileInfected, result)
+    }
+    return nil
+}
+
+// scanError writes the response for content scanBlocked refused.
+func scanError(c *gin.Context, err error) {
+    if errors.Is(err, ErrFileInfected) {
+        c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(http.StatusLocked, gin.H{"error": err.Error()})
+}
+
+// queueScan scans file's content in the background when it is waiting
+// for a scan.
+func (h *Handler) queueScan(file *models.File) {
+    if file.ScanStatus != models.ScanStatusPending {
+        return
+    }
+    cloudPath := file.CloudPath
+    go func() {
+        if err := h.scanContent(cloudPath); err != nil {
+            log.Printf("Failed to scan file %d, will retry: %v", file.ID, err)
+        }
+    }()
+}
+
+// scanContent scans the object at cloudPath and records the outcome on
+// every file and version waiting on it; deduplicated content is shared,
+// and stored objects never change. A scanner that cannot be reached
+// leaves them pending to be retried, while content the scanner refuses
+// is marked failed and stays quarantined.
+func (h *Handler) scanContent(cloudPath string) error {
+    clamd := utils.NewClamd()
+    if clamd == nil {
+        return errors.New("no scanner configured, set CLAMD_ADDR")
+    }
+    if _, busy := scanning.LoadOrStore(cloudPath, true); busy {
+        return nil
+    }
+    defer scanning.Delete(cloudPath)
+
+    body, err := h.Storage.Get(cloudPath)
+    if err != nil {
+        return err
+    }
+    virus, err := clamd.Scan(body)
+    body.Close()
+
+    status, result := models.ScanStatusClean, ""
+    var refused *utils.ClamdError
+    switch {
+    case errors.As(err, &refused):
+        status, result = models.ScanStatusFailed, refused.Reply
+    case err != nil:
+        return err
+    case virus != "":
+        status, result = models.ScanStatusInfected, virus
+    }
+
+    var files []models.File
+    if err := h.DB.Unscoped().Where("cloud_path = ? AND scan_status = ?", cloudPath, models.ScanStatusPending).
+        Find(&files).Error; err != nil {
+        return err
+    }
+    // Matching on the key again leaves alone a file that got new content
+    // since it was read
+    now := time.Now()
+    if err := h.DB.Unscoped().Model(&models.File{}).Where("cloud_path = ? AND scan_status = ?", cloudPath, models.ScanStatusPending).
+        Updates(map[string]interface{}{"scan_status": status, "scan_result": result, "scanned_at": now}).Error; err != nil {
+        return err
+    }
+    if err := h.DB.Model(&models.FileVersion{}).Where("cloud_path = ? AND scan_status = ?", cloudPath, models.ScanStatusPending).
+        Updates(map[string]interface{}{"scan_status": status, "scan_result": result}).Error; err != nil {
+        return err
+    }
+
+    // Owners learn the outcome through the change journal, and clean
+    // content gets the thumbnails and indexing held back until now
+    for i := range files {
+        file := &files[i]
+        if status == models.ScanStatusInfected {
+            log.Printf("Found %s in file %d of user %d", virus, file.ID, file.UserID)
+        }
+        if file.DeletedAt.Valid || file.Status != models.FileStatusAvailable {
+            continue
+        }
+        file.ScanStatus, file.ScanResult, file.ScannedAt = status, result, &now
+        h.fileChanged(file, models.ChangeUpdate)
+        if status == models.ScanStatusClean {
+            h.indexContent(file)
+        }
+    }
+    return nil
+}
+
+// ScanPendingContent scans the content of every file and version still
+// waiting for a scan, returning how many objects were scanned.
+func (h *Handler) ScanPendingContent() (int, error) {
+    var paths []string
+    if err := h.DB.Unscoped().Model(&models.File{}).
+        Where("scan_status = ? AND status = ?", models.ScanStatusPending, models.FileStatusAvailable).
+        Distinct().Pluck("cloud_path", &paths).Error; err != nil {
+        return 0, err
+    }
+    var versionPaths []string
+    if err := h.DB.Model(&models.FileVersion{}).Where("scan_status = ?", models.ScanStatusPending).
+        Distinct().Pluck("cloud_path", &versionPaths).Error; err != nil {
+        return 0, err
+    }
+
+    scanned := 0
+    seen := make(map[string]bool, len(paths))
+    for _, cloudPath := range append(paths, versionPaths...) {
+        if seen[cloudPath] {
+            continue
+        }
+        seen[cloudPath] = true
+        if err := h.scanContent(cloudPath); err != nil {
+            return scanned, err
+        }
+        scanned++
+    }
+    return scanned, nil
+}
+
+// QueueUnscannedContent marks content stored while scanning was off as
+// pending, for ScanPendingContent to scan. It is quarantined until then.
+// It returns how many files were marked.
+func (h *Handler) QueueUnscannedContent() (int64, error) {
+    if utils.NewClamd() == nil {
+        return 0, errors.New("no scanner configured, set CLAMD_ADDR")
+    }
+    if err := h.DB.Model(&models.FileVersion{}).Where("scan_status = ?", models.ScanStatusUnscanned).
+        Update("scan_status", models.ScanStatusPending).Error; err != nil {
+        return 0, err
+    }
+    result := h.DB.Unscoped().Model(&models.File{}).
+        Where("scan_status = ? AND status = ?", models.ScanStatusUnscanned, models.FileStatusAvailable).
+        Update("scan_status", models.ScanStatusPending)
+    return result.RowsAffected, result.Error
+}
+
+// StartPendingScans runs ScanPendingContent every interval until the
+// process exits, retrying scans that failed to reach the scanner or were
+// cut short by a restart. It does nothing when no scanner is configured.
+func (h *Handler) StartPendingScans(interval time.Duration) {
+    if utils.NewClamd() == nil {
+        return
+    }
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for range ticker.C {
+            if scanned, err := h.ScanPendingContent(); err != nil {
+                log.Printf("Failed to scan pending files: %v", err)
+            } else if scanned > 0 {
+                log.Printf("Scanned %d pending files", scanned)
+            }
+        }
+    }()
+}
@@ -0,0 +1,197 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "io"
+    "log"
+    "mime"
+    "net/http"
+    "path/filepath"
+    "strconv"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm/clause"
+)
+
+const (
+    MaxExtractedText   = 512 << 10 // text indexed per file
+    DefaultSearchLimit = 20
+    MaxSearchLimit     = 100
+)
+
+// sourceExtensions are source code and config files that mime does not
+// know as text, but that are worth indexing.
+var sourceExtensions = map[string]bool{
+    ".go": true, ".py": true, ".rb": true, ".rs": true, ".java": true, ".kt": true,
+    ".c": true, ".h": true, ".cpp": true, ".hpp": true, ".cs": true, ".php": true,
+    ".ts": true, ".tsx": true, ".jsx": true, ".swift": true, ".scala": true, ".sql": true,
+    ".sh": true, ".yaml": true, ".yml": true, ".toml": true, ".ini": true, ".md": true,
+}
+
+type SearchResult struct {
+    models.File
+    Rank          float64 `json:"rank"`
+    NameHighlight string  `json:"name_highlight"`
+    Snippet       string  `json:"snippet"`
+}
+
+// textExtractable reports whether text is worth extracting from a file:
+// plain text, Markdown, CSV, JSON, source code and the like.
+func textExtractable(contentType, fileName string) bool {
+    if textual(mediaType(contentType)) {
+        return true
+    }
+    ext := strings.ToLower(filepath.Ext(fileName))
+    if sourceExtensions[ext] {
+        return true
+    }
+    return textual(mediaType(mime.TypeByExtension(ext)))
+}
+
+// cleanText makes extracted text safe to store: PostgreSQL text cannot
+// hold NUL bytes or invalid UTF-8, and a cut at MaxExtractedText may split
+// a character.
+func cleanText(data []byte) string {
+    return strings.ReplaceAll(strings.ToValidUTF8(string(data), ""), "\x00", "")
+}
+
+// extractText reads the start of a text-like object for indexing.
+func (h *Handler) extractText(cloudPath string) (string, error) {
+    body, err := h.Storage.Get(cloudPath)
+    if err != nil {
+        return "", err
+    }
+    defer body.Close()
+    data, err := io.ReadAll(io.LimitReader(body, MaxExtractedText))
+    if err != nil {
+        return "", err
+    }
+    return cleanText(data), nil
+}
+
+// indexFile stores the searchable text of file's current content and
+// rebuilds its search document.
+func (h *Handler) indexFile(file *models.File) error {
+    content := ""
+    if textExtractable(file.ContentType, file.FileName) {
+        text, err := h.extractText(file.CloudPath)
+        if err != nil {
+            return err
+        }
+        content = text
+    }
+
+    // The file may have been given new content while this one was read
+    var current models.File
+    if err := h.DB.Select("cloud_path").First(&current, file.ID).Error; err != nil || current.CloudPath != file.CloudPath {
+        return err
+    }
+
+    doc := models.FileSearchDocument{FileID: file.ID, Content: content}
+    if err := h.DB.Clauses(clause.OnConflict{
+        Columns:   []clause.Column{{Name: "file_id"}},
+        DoUpdates: clause.AssignmentColumns([]string{"content", "updated_at"}),
+    }).Create(&doc).Error; err != nil {
+        return err
+    }
+    return models.RefreshSearchDocuments(h.DB, file.ID)
+}
+
+// refreshSearch rebuilds a file's search document after its name or tags
+// changed.
+func (h *Handler) refreshSearch(fileID uint) {
+    if err := models.RefreshSearchDocuments(h.DB, fileID); err != nil {
+        log.Printf("Failed to refresh search document of file %d: %v", fileID, err)
+    }
+}
+
+// processContent starts the background work that follows new content on
+// a file: the virus scan, thumbnails for images and text extraction for
+// search. Content in quarantine is only read by the scanner; the rest
+// waits until the scan comes back clean.
+func (h *Handler) processContent(file *models.File) {
+    h.queueScan(file)
+    if scanBlocked(file.ScanStatus, file.ScanResult) != nil {
+        return
+    }
+    h.indexContent(file)
+}
+
+// indexContent generates thumbnails for file's content and extracts its
+// text for search, in the background.
+func (h *Handler) indexContent(file *models.File) {
+    h.queueThumbnails(file)
+    indexed := *file
+    go func() {
+        if err := h.indexFile(&indexed); err != nil {
+            log.Printf("Failed to index file %d for search: %v", indexed.ID, err)
+        }
+    }()
+}
+
+// SearchFiles runs a full-text search over the names, tags and text
+// contents of the caller's files, best matches first. Matches are
+// highlighted with <mark> in the name and in a snippet of the content.
+func (h *Handler) SearchFiles(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    q := strings.TrimSpace(c.Query("q"))
+    if q == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+        return
+    }
+    limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(DefaultSearchLimit)))
+    if err != nil || limit < 1 || limit > MaxSearchLimit {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 100"})
+        return
+    }
+    offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+    if err != nil || offset < 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "offset must not be negative"})
+        return
+    }
+
+    // Names and tags are indexed unstemmed and content stemmed, so the
+    // query is parsed both ways
+    const from = `FROM files
+        JOIN file_search_documents d ON d.file_id = files.id AND d.deleted_at IS NULL,
+        (SELECT websearch_to_tsquery('simple', @q) || websearch_to_tsquery('english', @q) AS query) q
+        WHERE files.user_id = @user AND files.status = @status AND files.deleted_at IS NULL
+        AND d.document @@ q.query`
+    args := map[string]interface{}{
+        "q":      q,
+        "user":   userID,
+        "status": models.FileStatusAvailable,
+        "limit":  limit,
+        "offset": offset,
+    }
+
+    var total int64
+    if result := h.DB.Raw("SELECT COUNT(*) "+from, args).Scan(&total); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to search files"})
+        return
+    }
+
+    results := []SearchResult{}
+    if result := h.DB.Raw(`SELECT files.*, ts_rank_cd(d.document, q.query) AS rank,
+        ts_headline('simple', files.file_name, q.query, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true') AS name_highlight,
+        CASE WHEN d.content = '' THEN '' ELSE ts_headline('english', d.content, q.query,
+            'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=30, MinWords=10') END AS snippet
+        `+from+`
+        ORDER BY rank DESC, files.id
+        LIMIT @limit OFFSET @offset`, args).Scan(&results); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to search files"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "query":   q,
+        "total":   total,
+        "results": results,
+    })
+}
@@ -7,8 +7,6 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
@@ -30,7 +28,7 @@ type ShareResponse struct {
 }
 
 // CreateShareLink generates a new share link for a file
-func CreateShareLink(c *gin.Context) {
+func (h *Handler) CreateShareLink(c *gin.Context) {
     userID, exists := c.Get("userID")
     if !exists {
         c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
@@ -43,11 +41,11 @@ func CreateShareLink(c *gin.Context) {
         return
     }
 
-    db := utils.ConnectDB()
+    db := h.DB
 
     // Verify file ownership
     var file models.File
-    if result := db.Where("id = ? AND user_id = ?", req.FileID, userID).First(&file); result.Error != nil {
+    if result := db.Where("id = ? AND user_id = ? AND status = ?", req.FileID, userID, models.FileStatusAvailable).First(&file); result.Error != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "file not found or access denied"})
         return
     }
@@ -101,19 +99,30 @@ func CreateShareLink(c *gin.Context) {
 }
 
 // AccessSharedFile handles access to shared files
-func AccessSharedFile(c *gin.Context) {
+func (h *Handler) AccessSharedFile(c *gin.Context) {
     shareToken := c.Param("token")
 
-    db := utils.ConnectDB()
+    db := h.DB
     var share models.FileShare
 
     // Find active share link
-    if result := db.Preload("File").Where("share_token = ? AND is_active = ?",
+    if result := db.Preload("File.User").Where("share_token = ? AND is_active = ?",
         shareToken, true).First(&share); result.Error != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "invalid or expired share link"})
         return
     }
 
+    // The file may have been removed or not finished uploading, and the
+    // links of a disabled account stop working with it
+    if share.File.ID == 0 || share.File.Status != models.FileStatusAvailable || share.File.User.Disabled {
+        c.JSON(http.StatusNotFound, gin.H{"error": "invalid or expired share link"})
+        return
+    }
+    if err := scanBlocked(share.File.ScanStatus, share.File.ScanResult); err != nil {
+        scanError(c, err)
+        return
+    }
+
     // Check if share has expired
     if time.Now().After(share.ExpiresAt) {
         share.IsActive = false
@@ -126,15 +135,8 @@ func AccessSharedFile(c *gin.Context) {
     share.AccessCount++
     db.Save(&share)
 
-    // Generate temporary download URL
-    s3Client := utils.GetS3Client()
-    req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
-        Bucket: aws.String(utils.GetEnv("AWS_BUCKET_NAME")),
-        Key:    aws.String(share.File.CloudPath),
-    })
-
-    // Generate URL valid for 15 minutes
-    url, err := req.Presign(15 * time.Minute)
+    // Generate temporary download URL, valid for 15 minutes
+    url, err := h.Storage.PresignGet(share.File.CloudPath, 15*time.Minute)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate download url"})
         return
@@ -144,20 +146,22 @@ func AccessSharedFile(c *gin.Context) {
         "file_name":    share.File.FileName,
         "content_type": share.File.ContentType,
         "file_size":    share.File.FileSize,
+        "sha256":       share.File.SHA256,
+        "md5":          share.File.MD5,
         "download_url": url,
         "expires_in":   "15 minutes",
     })
 }
 
 // ListShares returns all active share links for a user's files
-func ListShares(c *gin.Context) {
+func (h *Handler) ListShares(c *gin.Context) {
     userID, exists := c.Get("userID")
     if !exists {
         c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
         return
     }
 
-    db := utils.ConnectDB()
+    db := h.DB
     var shares []models.FileShare
 
     if result := db.Preload("File").Where("created_by = ? AND is_active = ?",
@@ -170,7 +174,7 @@ func ListShares(c *gin.Context) {
 }
 
 // RevokeShare deactivates a share link
-func RevokeShare(c *gin.Context) {
+func (h *Handler) RevokeShare(c *gin.Context) {
     userID, exists := c.Get("userID")
     if !exists {
         c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
@@ -179,7 +183,7 @@ func RevokeShare(c *gin.Context) {
 
     shareToken := c.Param("token")
 
-    db := utils.ConnectDB()
+    db := h.DB
     var share models.FileShare
 
     // Verify ownership and update share status
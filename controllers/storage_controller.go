@@ -0,0 +1,85 @@
+package controllers
+
+import (
+    "CloudBox/storage"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "path"
+    "strconv"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+)
+
+// ServeLocalObject streams an object kept by the local storage backend.
+// It backs the signed URLs handed out by LocalStorage.PresignGet.
+func (h *Handler) ServeLocalObject(c *gin.Context) {
+    local, ok := h.Storage.(*storage.LocalStorage)
+    if !ok {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+        return
+    }
+
+    key := strings.TrimPrefix(c.Param("key"), "/")
+    if err := local.VerifySignature(http.MethodGet, key, c.Query("expires"), c.Query("signature")); err != nil {
+        c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+        return
+    }
+
+    info, err := local.Stat(key)
+    if errors.Is(err, storage.ErrNotFound) {
+        c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+        return
+    }
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read file"})
+        return
+    }
+
+    body, err := local.Get(key)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read file"})
+        return
+    }
+    defer body.Close()
+
+    // Uploaded content is never rendered inline on CloudBox's own origin,
+    // where a stored HTML page could run script as the user
+    c.Header("Content-Type", info.ContentType)
+    c.Header("Content-Length", strconv.FormatInt(info.Size, 10))
+    c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(key)))
+    c.Header("X-Content-Type-Options", "nosniff")
+    c.Status(http.StatusOK)
+    io.Copy(c.Writer, body)
+}
+
+
+// ReceiveLocalObject accepts an upload for the local storage backend. It
+// backs the signed URLs handed out by LocalStorage.PresignPut.
+func (h *Handler) ReceiveLocalObject(c *gin.Context) {
+    local, ok := h.Storage.(*storage.LocalStorage)
+    if !ok {
+        c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+        return
+    }
+
+    key := strings.TrimPrefix(c.Param("key"), "/")
+    if err := local.VerifySignature(http.MethodPut, key, c.Query("expires"), c.Query("signature")); err != nil {
+        c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+        return
+    }
+    if c.Request.ContentLength > MaxDirectUploadSize {
+        c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file too large"})
+        return
+    }
+
+    body := http.MaxBytesReader(c.Writer, c.Request.Body, MaxDirectUploadSize)
+    if err := local.Put(key, body, c.Request.ContentLength, c.ContentType()); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "failed to store file"})
+        return
+    }
+
+    c.Status(http.StatusOK)
+}
@@ -0,0 +1,302 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "fmt"
+    "net/http"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+const (
+    MaxTagsPerFile     = 50
+    MaxTagLength       = 64
+    MaxMetadataPerFile = 100
+    MaxMetadataKey     = 128
+    MaxMetadataValue   = 1024
+)
+
+type TagsRequest struct {
+    Tags []string `json:"tags" binding:"required,min=1"`
+}
+
+type MetadataRequest struct {
+    Metadata map[string]string `json:"metadata" binding:"required,min=1"`
+}
+
+type TagCount struct {
+    Name  string `json:"name"`
+    Count int64  `json:"count"`
+}
+
+// normalizeTag trims and lower-cases a tag, rejecting empty or overlong
+// ones.
+func normalizeTag(tag string) (string, error) {
+    tag = strings.ToLower(strings.TrimSpace(tag))
+    if tag == "" || len(tag) > MaxTagLength {
+        return "", fmt.Errorf("tags must be between 1 and %d characters", MaxTagLength)
+    }
+    return tag, nil
+}
+
+// tagAndMetadataFilters narrows db to files carrying every tag given as a
+// tag query parameter, and every metadata[key]=value pair. An empty value
+// only requires the key to be present.
+func tagAndMetadataFilters(c *gin.Context, db *gorm.DB) (*gorm.DB, error) {
+    for _, tag := range c.QueryArray("tag") {
+        name, err := normalizeTag(tag)
+        if err != nil {
+            return nil, err
+        }
+        db = db.Where("EXISTS (SELECT 1 FROM file_tags WHERE file_tags.file_id = files.id AND file_tags.name = ?)", name)
+    }
+    for key, value := range c.QueryMap("metadata") {
+        if value == "" {
+            db = db.Where("EXISTS (SELECT 1 FROM file_metadata WHERE file_metadata.file_id = files.id AND file_metadata.key = ?)", key)
+        } else {
+            db = db.Where("EXISTS (SELECT 1 FROM file_metadata WHERE file_metadata.file_id = files.id AND file_metadata.key = ? AND file_metadata.value = ?)", key, value)
+        }
+    }
+    return db, nil
+}
+
+// copyTagsAndMetadata gives a copied file the tags and metadata of the
+// file it was copied from.
+func (h *Handler) copyTagsAndMetadata(from, to *models.File) error {
+    return h.DB.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Exec(`INSERT INTO file_tags (created_at, updated_at, file_id, user_id, name)
+            SELECT NOW(), NOW(), ?, user_id, name FROM file_tags WHERE file_id = ?`, to.ID, from.ID).Error; err != nil {
+            return err
+        }
+        return tx.Exec(`INSERT INTO file_metadata (created_at, updated_at, file_id, key, value)
+            SELECT NOW(), NOW(), ?, key, value FROM file_metadata WHERE file_id = ?`, to.ID, from.ID).Error
+    })
+}
+
+// upsertMetadata stores metadata entries, replacing the values of keys
+// their files already have.
+func (h *Handler) upsertMetadata(entries []models.FileMetadata) error {
+    return h.DB.Clauses(clause.OnConflict{
+        Columns:   []clause.Column{{Name: "file_id"}, {Name: "key"}},
+        DoUpdates: clause.AssignmentColumns([]string{"value", "updated_at"}),
+    }).Create(&entries).Error
+}
+
+// GetFileTags returns the tags and metadata of a file
+func (h *Handler) GetFileTags(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    file, ok := h.findOwnedFile(c, userID)
+    if !ok {
+        return
+    }
+
+    var tags []string
+    if result := h.DB.Model(&models.FileTag{}).Where("file_id = ?", file.ID).Order("name").Pluck("name", &tags); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch tags"})
+        return
+    }
+    var entries []models.FileMetadata
+    if result := h.DB.Where("file_id = ?", file.ID).Order("key").Find(&entries); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch metadata"})
+        return
+    }
+    metadata := make(map[string]string, len(entries))
+    for _, entry := range entries {
+        metadata[entry.Key] = entry.Value
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "file_id":  file.ID,
+        "tags":     tags,
+        "metadata": metadata,
+    })
+}
+
+// AddFileTags adds tags to a file. Tags it already has are left alone.
+func (h *Handler) AddFileTags(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var req TagsRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    file, ok := h.findOwnedFile(c, userID)
+    if !ok {
+        return
+    }
+
+    tags := make([]models.FileTag, 0, len(req.Tags))
+    for _, tag := range req.Tags {
+        name, err := normalizeTag(tag)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        tags = append(tags, models.FileTag{FileID: file.ID, UserID: file.UserID, Name: name})
+    }
+
+    var count int64
+    h.DB.Model(&models.FileTag{}).Where("file_id = ?", file.ID).Count(&count)
+    if count+int64(len(tags)) > MaxTagsPerFile {
+        c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("a file can have at most %d tags", MaxTagsPerFile)})
+        return
+    }
+
+    if result := h.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&tags); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to add tags"})
+        return
+    }
+
+    h.refreshSearch(file.ID)
+    h.fileChanged(file, models.ChangeUpdate)
+
+    c.JSON(http.StatusOK, gin.H{"message": "tags added"})
+}
+
+// RemoveFileTag removes one tag from a file
+func (h *Handler) RemoveFileTag(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    file, ok := h.findOwnedFile(c, userID)
+    if !ok {
+        return
+    }
+    name, err := normalizeTag(c.Param("tag"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    result := h.DB.Unscoped().Where("file_id = ? AND name = ?", file.ID, name).Delete(&models.FileTag{})
+    if result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to remove tag"})
+        return
+    }
+    if result.RowsAffected == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"error": "tag not found"})
+        return
+    }
+    h.refreshSearch(file.ID)
+    h.fileChanged(file, models.ChangeUpdate)
+
+    c.JSON(http.StatusOK, gin.H{"message": "tag removed"})
+}
+
+// SetFileMetadata sets metadata keys on a file, replacing the values of
+// keys it already has
+func (h *Handler) SetFileMetadata(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var req MetadataRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    file, ok := h.findOwnedFile(c, userID)
+    if !ok {
+        return
+    }
+
+    entries := make([]models.FileMetadata, 0, len(req.Metadata))
+    keys := make([]string, 0, len(req.Metadata))
+    for key, value := range req.Metadata {
+        if key == "" || len(key) > MaxMetadataKey {
+            c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("metadata keys must be between 1 and %d characters", MaxMetadataKey)})
+            return
+        }
+        if len(value) > MaxMetadataValue {
+            c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("metadata values must be at most %d characters", MaxMetadataValue)})
+            return
+        }
+        entries = append(entries, models.FileMetadata{FileID: file.ID, Key: key, Value: value})
+        keys = append(keys, key)
+    }
+
+    // Only keys the file does not have yet count towards the limit
+    var count, existing int64
+    h.DB.Model(&models.FileMetadata{}).Where("file_id = ?", file.ID).Count(&count)
+    h.DB.Model(&models.FileMetadata{}).Where("file_id = ? AND key IN ?", file.ID, keys).Count(&existing)
+    if count-existing+int64(len(entries)) > MaxMetadataPerFile {
+        c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("a file can have at most %d metadata keys", MaxMetadataPerFile)})
+        return
+    }
+
+    if err := h.upsertMetadata(entries); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set metadata"})
+        return
+    }
+    h.fileChanged(file, models.ChangeUpdate)
+
+    c.JSON(http.StatusOK, gin.H{"message": "metadata updated"})
+}
+
+// DeleteFileMetadata removes one metadata key from a file
+func (h *Handler) DeleteFileMetadata(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    file, ok := h.findOwnedFile(c, userID)
+    if !ok {
+        return
+    }
+
+    result := h.DB.Unscoped().Where("file_id = ? AND key = ?", file.ID, c.Param("key")).Delete(&models.FileMetadata{})
+    if result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to remove metadata"})
+        return
+    }
+    if result.RowsAffected == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"error": "metadata key not found"})
+        return
+    }
+    h.fileChanged(file, models.ChangeUpdate)
+
+    c.JSON(http.StatusOK, gin.H{"message": "metadata removed"})
+}
+
+// ListTags returns every tag the caller uses with the number of available
+// files carrying it, most used first, for rendering a tag cloud
+func (h *Handler) ListTags(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var counts []TagCount
+    if result := h.DB.Model(&models.FileTag{}).
+        Select("file_tags.name, COUNT(*) AS count").
+        Joins("JOIN files ON files.id = file_tags.file_id").
+        Where("file_tags.user_id = ? AND files.status = ? AND files.deleted_at IS NULL", userID, models.FileStatusAvailable).
+        Group("file_tags.name").Order("count DESC, file_tags.name").
+        Scan(&counts); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch tags"})
+        return
+    }
+
+    c.JSON(http.StatusOK, counts)
+}
@@ -0,0 +1,220 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "CloudBox/storage"
+    "CloudBox/utils"
+    "bytes"
+    "errors"
+    "fmt"
+    "image"
+    _ "image/gif"
+    "image/jpeg"
+    "image/png"
+    "io"
+    "log"
+    "net/http"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+const (
+    DefaultThumbnailSize   = "small"
+    MaxThumbnailSourceSize = 50 << 20   // 50 MB
+    MaxThumbnailPixels     = 50_000_000 // refuse decompression bombs
+)
+
+// ThumbnailSizes maps each thumbnail size to the longest side, in pixels,
+// of the thumbnails generated for it.
+var ThumbnailSizes = map[string]int{
+    "small":  128,
+    "medium": 512,
+    "large":  1024,
+}
+
+var errThumbnailUnsupported = errors.New("image too large to thumbnail")
+
+// thumbnailSlots bounds how many images are decoded at once, since each
+// one is held in memory while it is resized.
+var thumbnailSlots = make(chan struct{}, 2)
+
+// thumbnailSupported reports whether thumbnails can be generated for
+// content of the given type.
+func thumbnailSupported(contentType string) bool {
+    switch mediaType(contentType) {
+    case "image/jpeg", "image/png", "image/gif":
+        return true
+    }
+    return false
+}
+
+// thumbnailKey returns where the thumbnail of the given size for the
+// object at cloudPath is stored, right next to the original.
+func thumbnailKey(cloudPath, size string) string {
+    return cloudPath + ".thumb-" + size
+}
+
+// deleteThumbnails removes every thumbnail generated for cloudPath.
+func (h *Handler) deleteThumbnails(cloudPath string) {
+    for size := range ThumbnailSizes {
+        h.Storage.Delete(thumbnailKey(cloudPath, size))
+    }
+}
+
+// generateThumbnails stores a thumbnail in every size for the image at
+// cloudPath. JPEG photos are thumbnailed as JPEG; PNG and GIF images as
+// PNG so transparency survives.
+func (h *Handler) generateThumbnails(cloudPath string) error {
+    thumbnailSlots <- struct{}{}
+    defer func() { <-thumbnailSlots }()
+
+    info, err := h.Storage.Stat(cloudPath)
+    if err != nil {
+        return err
+    }
+    if info.Size > MaxThumbnailSourceSize {
+        return errThumbnailUnsupported
+    }
+
+    body, err := h.Storage.Get(cloudPath)
+    if err != nil {
+        return err
+    }
+    data, err := io.ReadAll(body)
+    body.Close()
+    if err != nil {
+        return err
+    }
+
+    config, format, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil {
+        return err
+    }
+    if config.Width*config.Height > MaxThumbnailPixels {
+        return errThumbnailUnsupported
+    }
+    img, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+        return err
+    }
+
+    for size, side := range ThumbnailSizes {
+        var buf bytes.Buffer
+        contentType := "image/png"
+        thumb := utils.ResizeToFit(img, side)
+        if format == "jpeg" {
+            contentType = "image/jpeg"
+            err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80})
+        } else {
+            err = png.Encode(&buf, thumb)
+        }
+        if err != nil {
+            return err
+        }
+        if err := h.Storage.Put(thumbnailKey(cloudPath, size), &buf, int64(buf.Len()), contentType); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// markThumbnails records that file's thumbnails exist, unless its content
+// changed while they were being generated.
+func (h *Handler) markThumbnails(fileID uint, cloudPath string) {
+    h.DB.Model(&models.File{}).Where("id = ? AND cloud_path = ?", fileID, cloudPath).Update("has_thumbnail", true)
+}
+
+// queueThumbnails generates thumbnails for file's current content in the
+// background, if it is an image they can be made for.
+func (h *Handler) queueThumbnails(file *models.File) {
+    if !thumbnailSupported(file.ContentType) {
+        return
+    }
+    fileID, cloudPath := file.ID, file.CloudPath
+    go func() {
+        if err := h.generateThumbnails(cloudPath); err != nil {
+            log.Printf("Failed to generate thumbnails for file %d: %v", fileID, err)
+            return
+        }
+        h.markThumbnails(fileID, cloudPath)
+    }()
+}
+
+// thumbnailSize reads the requested thumbnail size from the query
+// parameter name, writing a 400 if it is not one of ThumbnailSizes.
+func thumbnailSize(c *gin.Context, name string) (string, bool) {
+    size := c.DefaultQuery(name, DefaultThumbnailSize)
+    if _, ok := ThumbnailSizes[size]; !ok {
+        c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown thumbnail size %q", size)})
+        return "", false
+    }
+    return size, true
+}
+
+// attachThumbnailURLs fills in ThumbnailURL for the files whose thumbnails
+// have been generated, unless their content is quarantined.
+func (h *Handler) attachThumbnailURLs(files []models.File, size string) {
+    for i := range files {
+        if !files[i].HasThumbnail || scanBlocked(files[i].ScanStatus, files[i].ScanResult) != nil {
+            continue
+        }
+        url, err := h.Storage.PresignGet(thumbnailKey(files[i].CloudPath, size), 15*time.Minute)
+        if err == nil {
+            files[i].ThumbnailURL = url
+        }
+    }
+}
+
+// GetThumbnail returns a URL for one of a file's thumbnails, generating
+// the thumbnails first if they do not exist yet
+func (h *Handler) GetThumbnail(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    size, ok := thumbnailSize(c, "size")
+    if !ok {
+        return
+    }
+    file, ok := h.findOwnedFile(c, userID)
+    if !ok {
+        return
+    }
+    if err := scanBlocked(file.ScanStatus, file.ScanResult); err != nil {
+        scanError(c, err)
+        return
+    }
+    if !thumbnailSupported(file.ContentType) {
+        c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "thumbnails are only available for JPEG, PNG and GIF images"})
+        return
+    }
+
+    key := thumbnailKey(file.CloudPath, size)
+    if _, err := h.Storage.Stat(key); errors.Is(err, storage.ErrNotFound) {
+        if err := h.generateThumbnails(file.CloudPath); err != nil {
+            log.Printf("Failed to generate thumbnails for file %d: %v", file.ID, err)
+            c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "failed to generate thumbnail"})
+            return
+        }
+        h.markThumbnails(file.ID, file.CloudPath)
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check thumbnail"})
+        return
+    }
+
+    url, err := h.Storage.PresignGet(key, 15*time.Minute)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate thumbnail url"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "thumbnail_url": url,
+        "size":          size,
+        "max_side":      ThumbnailSizes[size],
+        "expires_in":    "15 minutes",
+    })
+}
@@ -0,0 +1,217 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "CloudBox/utils"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// TrashRetention returns how long deleted files stay in the trash, taken
+// from TRASH_RETENTION_DAYS when set.
+func TrashRetention() time.Duration {
+    if days, err := strconv.Atoi(utils.GetEnv("TRASH_RETENTION_DAYS")); err == nil && days >= 0 {
+        return time.Duration(days) * 24 * time.Hour
+    }
+    return DefaultTrashRetention
+}
+
+// purgeFile permanently removes a file: its content and every previous
+// version are released, its share links are dropped and the row is
+// deleted. The space is credited back to the owner.
+func (h *Handler) purgeFile(file *models.File) error {
+    var versions []models.FileVersion
+    if err := h.DB.Where("file_id = ?", file.ID).Find(&versions).Error; err != nil {
+        return err
+    }
+    for _, version := range versions {
+        if err := h.releaseContent(version.BlobID, version.CloudPath); err != nil {
+            return err
+        }
+        h.DB.Unscoped().Delete(&version)
+        h.creditUsage(file.UserID, version.FileSize)
+    }
+
+    if err := h.releaseFileContent(file); err != nil {
+        return err
+    }
+    h.DB.Unscoped().Where("file_id = ?", file.ID).Delete(&models.FileShare{})
+    h.DB.Unscoped().Where("file_id = ?", file.ID).Delete(&models.FileTag{})
+    h.DB.Unscoped().Where("file_id = ?", file.ID).Delete(&models.FileMetadata{})
+    h.DB.Unscoped().Where("file_id = ?", file.ID).Delete(&models.FileSearchDocument{})
+    if err := h.DB.Unscoped().Delete(file).Error; err != nil {
+        return err
+    }
+    // Pending direct uploads were never charged for
+    if file.Status == models.FileStatusAvailable {
+        h.creditUsage(file.UserID, file.FileSize)
+    }
+    return nil
+}
+
+// PurgeExpiredTrash permanently removes files that have been in the trash
+// for longer than retention, returning how many were purged.
+func (h *Handler) PurgeExpiredTrash(retention time.Duration) (int, error) {
+    var expired []models.File
+    cutoff := time.Now().Add(-retention)
+    if err := h.DB.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff).Find(&expired).Error; err != nil {
+        return 0, err
+    }
+
+    purged := 0
+    for i := range expired {
+        if err := h.purgeFile(&expired[i]); err != nil {
+            log.Printf("Failed to purge file %d: %v", expired[i].ID, err)
+            continue
+        }
+        purged++
+    }
+    return purged, nil
+}
+
+// StartTrashPurge runs PurgeExpiredTrash every interval until the process
+// exits.
+func (h *Handler) StartTrashPurge(interval time.Duration) {
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for range ticker.C {
+            if purged, err := h.PurgeExpiredTrash(TrashRetention()); err != nil {
+                log.Printf("Failed to purge trash: %v", err)
+            } else if purged > 0 {
+                log.Printf("Purged %d files from the trash", purged)
+            }
+        }
+    }()
+}
+
+// DeleteFile moves a file to the trash
+func (h *Handler) DeleteFile(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    file, ok := h.findOwnedFile(c, userID)
+    if !ok {
+        return
+    }
+
+    if result := h.DB.Delete(file); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete file"})
+        return
+    }
+    h.fileChanged(file, models.ChangeDelete)
+
+    c.JSON(http.StatusOK, gin.H{
+        "message":     "file moved to trash",
+        "purge_after": time.Now().Add(TrashRetention()),
+    })
+}
+
+// ListTrash returns the caller's deleted files that have not been purged yet
+func (h *Handler) ListTrash(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var files []models.File
+    if result := h.DB.Unscoped().Where("user_id = ? AND deleted_at IS NOT NULL AND status = ?", userID, models.FileStatusAvailable).
+        Order("deleted_at DESC").Find(&files); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch trash"})
+        return
+    }
+
+    retention := TrashRetention()
+    items := make([]gin.H, 0, len(files))
+    for _, file := range files {
+        items = append(items, gin.H{
+            "file":        file,
+            "deleted_at":  file.DeletedAt.Time,
+            "purge_after": file.DeletedAt.Time.Add(retention),
+        })
+    }
+
+    c.JSON(http.StatusOK, items)
+}
+
+// RestoreFromTrash brings a deleted file back
+func (h *Handler) RestoreFromTrash(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var file models.File
+    if result := h.DB.Unscoped().Where("id = ? AND user_id = ? AND deleted_at IS NOT NULL AND status = ?",
+        c.Param("id"), userID, models.FileStatusAvailable).First(&file); result.Error != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "file not found in trash"})
+        return
+    }
+
+    // A file whose folder was deleted is restored to the root
+    folderID := h.liveFolder(file.UserID, file.FolderID)
+
+    // Uploads of the same name while this file was in the trash created a
+    // new file, so restoring would leave two files with one name
+    if existing, err := h.findFileByName(file.UserID, folderID, file.FileName); err == nil && existing != nil {
+        c.JSON(http.StatusConflict, gin.H{"error": "a file with this name already exists"})
+        return
+    }
+
+    if result := h.DB.Unscoped().Model(&file).Updates(map[string]interface{}{
+        "deleted_at": nil,
+        "folder_id":  folderID,
+    }); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to restore file"})
+        return
+    }
+    file.FolderID = folderID
+    h.fileChanged(&file, models.ChangeCreate)
+
+    c.JSON(http.StatusOK, gin.H{"message": "file restored", "file_id": file.ID})
+}
+
+// EmptyTrash permanently removes every file in the caller's trash
+func (h *Handler) EmptyTrash(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var files []models.File
+    if result := h.DB.Unscoped().Where("user_id = ? AND deleted_at IS NOT NULL AND status = ?", userID, models.FileStatusAvailable).Find(&files); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch trash"})
+        return
+    }
+
+    purged := 0
+    for i := range files {
+        if err := h.purgeFile(&files[i]); err != nil {
+            log.Printf("Failed to purge file %d: %v", files[i].ID, err)
+            continue
+        }
+        purged++
+    }
+
+    if purged < len(files) {
+        c.JSON(http.StatusInternalServerError, gin.H{
+            "error":  "some files could not be purged",
+            "purged": purged,
+        })
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "trash emptied", "purged": purged})
+}
@@ -0,0 +1,543 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "CloudBox/utils"
+    "crypto/md5"
+    "crypto/sha1"
+    "crypto/sha256"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "hash"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+const (
+    TusVersion          = "1.0.0"
+    TusExtensions       = "creation,termination,checksum"
+    TusChecksumAlgos    = "md5,sha1,sha256"
+    StatusChecksumError = 460 // tus checksum extension: checksum mismatch
+    TusUploadTTL        = 24 * time.Hour
+)
+
+// tusLocks serialises PATCH requests per upload so two connections cannot
+// append to the same staging file at once.
+var tusLocks sync.Map
+
+func tusLock(id uint) *sync.Mutex {
+    lock, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+    return lock.(*sync.Mutex)
+}
+
+// tusStagingPath returns where the bytes of a tus upload are kept until the
+// upload is complete.
+func tusStagingPath(id uint) string {
+    dir := utils.GetEnv("TUS_UPLOAD_DIR", filepath.Join(os.TempDir(), "cloudbox-tus"))
+    return filepath.Join(dir, strconv.FormatUint(uint64(id), 10))
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated
+// pairs of a key and an optional base64 encoded value.
+func parseTusMetadata(header string) (map[string]string, error) {
+    meta := map[string]string{}
+    for _, pair := range strings.Split(header, ",") {
+        pair = strings.TrimSpace(pair)
+        if pair == "" {
+            continue
+        }
+        key, encoded, _ := strings.Cut(pair, " ")
+        value, err := base64.StdEncoding.DecodeString(encoded)
+        if err != nil {
+            return nil, fmt.Errorf("invalid metadata value for %q", key)
+        }
+        meta[key] = string(value)
+    }
+    return meta, nil
+}
+
+// parseTusChecksum decodes an Upload-Checksum header into a hash to feed
+// the chunk through and the digest it must produce.
+func parseTusChecksum(header string) (hash.Hash, []byte, error) {
+    algo, encoded, ok := strings.Cut(header, " ")
+    if !ok {
+        return nil, nil, errors.New("invalid Upload-Checksum header")
+    }
+    digest, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil {
+        return nil, nil, errors.New("invalid Upload-Checksum header")
+    }
+    switch algo {
+    case "md5":
+        return md5.New(), digest, nil
+    case "sha1":
+        return sha1.New(), digest, nil
+    case "sha256":
+        return sha256.New(), digest, nil
+    }
+    return nil, nil, fmt.Errorf("unsupported checksum algorithm %q", algo)
+}
+
+// tusHeaders sets the headers every tus response carries and rejects
+// clients speaking another protocol version.
+func tusHeaders(c *gin.Context) bool {
+    c.Header("Tus-Resumable", TusVersion)
+    if c.GetHeader("Tus-Resumable") != TusVersion {
+        c.Header("Tus-Version", TusVersion)
+        c.AbortWithStatus(http.StatusPreconditionFailed)
+        return false
+    }
+    return true
+}
+
+func (h *Handler) findTusUpload(c *gin.Context, userID interface{}) (*models.TusUpload, bool) {
+    var upload models.TusUpload
+    if result := h.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&upload); result.Error != nil {
+        c.AbortWithStatus(http.StatusNotFound)
+        return nil, false
+    }
+    if upload.Status == models.UploadSessionAborted {
+        c.AbortWithStatus(http.StatusGone)
+        return nil, false
+    }
+    return &upload, true
+}
+
+// TusOptions advertises the protocol version and extensions supported
+func (h *Handler) TusOptions(c *gin.Context) {
+    c.Header("Tus-Resumable", TusVersion)
+    c.Header("Tus-Version", TusVersion)
+    c.Header("Tus-Extension", TusExtensions)
+    c.Header("Tus-Checksum-Algorithm", TusChecksumAlgos)
+    c.Status(http.StatusNoContent)
+}
+
+// TusCreate creates a new tus upload (creation extension)
+func (h *Handler) TusCreate(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.AbortWithStatus(http.StatusUnauthorized)
+        return
+    }
+    if !tusHeaders(c) {
+        return
+    }
+
+    length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+    if err != nil || length < 0 {
+        c.String(http.StatusBadRequest, "Upload-Length header required")
+        return
+    }
+
+    meta, err := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+    if err != nil {
+        c.String(http.StatusBadRequest, err.Error())
+        return
+    }
+    fileName := meta["filename"]
+    if fileName == "" {
+        fileName = meta["name"]
+    }
+    if fileName == "" {
+        c.String(http.StatusBadRequest, "filename metadata required")
+        return
+    }
+    contentType := meta["filetype"]
+    if contentType == "" {
+        contentType = "application/octet-stream"
+    }
+    // A file_id in the metadata makes the upload a new version of that file
+    if fileID := meta["file_id"]; fileID != "" {
+        if _, err := h.findTargetFile(userID.(uint), fileID); err != nil {
+            c.String(http.StatusNotFound, "file not found")
+            return
+        }
+    }
+
+    // Checksums in the metadata are verified once the content has arrived
+    if _, err := parseChecksums(meta["sha256"], meta["md5"]); err != nil {
+        c.String(http.StatusBadRequest, err.Error())
+        return
+    }
+
+    // The content is sniffed once it has all arrived, but a forbidden
+    // extension can be refused straight away
+    if err := checkUploadPolicy(fileName, ""); err != nil {
+        c.String(http.StatusUnsupportedMediaType, err.Error())
+        return
+    }
+
+    // A folder_id in the metadata picks the folder the file lands in
+    folderID, err := parseFolderID(meta["folder_id"])
+    if err == nil {
+        err = h.checkFolder(userID.(uint), folderID)
+    }
+    if err != nil {
+        c.String(http.StatusNotFound, "folder not found")
+        return
+    }
+
+    // Reserve the declared length; it is given back if the upload is terminated
+    if err := h.chargeUsage(userID.(uint), length); err != nil {
+        if errors.Is(err, ErrQuotaExceeded) {
+            c.String(http.StatusInsufficientStorage, err.Error())
+        } else {
+            c.String(http.StatusInternalServerError, "failed to check storage quota")
+        }
+        return
+    }
+
+    upload := models.TusUpload{
+        UserID:      userID.(uint),
+        FileName:    fileName,
+        ContentType: contentType,
+        Length:      length,
+        Metadata:    c.GetHeader("Upload-Metadata"),
+        Status:      models.UploadSessionActive,
+    }
+    if result := h.DB.Create(&upload); result.Error != nil {
+        h.creditUsage(userID.(uint), length)
+        c.String(http.StatusInternalServerError, "failed to create upload")
+        return
+    }
+
+    staging := tusStagingPath(upload.ID)
+    if err := os.MkdirAll(filepath.Dir(staging), 0o755); err != nil {
+        h.discardTusUpload(&upload)
+        c.String(http.StatusInternalServerError, "failed to create upload")
+        return
+    }
+    f, err := os.Create(staging)
+    if err != nil {
+        h.discardTusUpload(&upload)
+        c.String(http.StatusInternalServerError, "failed to create upload")
+        return
+    }
+    f.Close()
+
+    c.Header("Location", fmt.Sprintf("%s/%d", strings.TrimRight(c.Request.URL.Path, "/"), upload.ID))
+    c.Header("Upload-Offset", "0")
+
+    // An empty file is complete as soon as it is created
+    if length == 0 {
+        if err := h.finishTusUpload(&upload); err != nil {
+            tusFinishError(c, err)
+            return
+        }
+    }
+
+    c.Status(http.StatusCreated)
+}
+
+// TusHead reports how many bytes of an upload have been received
+func (h *Handler) TusHead(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.AbortWithStatus(http.StatusUnauthorized)
+        return
+    }
+    if !tusHeaders(c) {
+        return
+    }
+
+    upload, ok := h.findTusUpload(c, userID)
+    if !ok {
+        return
+    }
+
+    c.Header("Cache-Control", "no-store")
+    c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+    c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+    if upload.Metadata != "" {
+        c.Header("Upload-Metadata", upload.Metadata)
+    }
+    c.Status(http.StatusOK)
+}
+
+// TusPatch appends a chunk at the current offset. When the last byte has
+// arrived the upload is moved to storage and recorded as a File.
+func (h *Handler) TusPatch(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.AbortWithStatus(http.StatusUnauthorized)
+        return
+    }
+    if !tusHeaders(c) {
+        return
+    }
+    if c.ContentType() != "application/offset+octet-stream" {
+        c.String(http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+        return
+    }
+
+    offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+    if err != nil {
+        c.String(http.StatusBadRequest, "Upload-Offset header required")
+        return
+    }
+
+    var checksum hash.Hash
+    var expected []byte
+    if header := c.GetHeader("Upload-Checksum"); header != "" {
+        if checksum, expected, err = parseTusChecksum(header); err != nil {
+            c.String(http.StatusBadRequest, err.Error())
+            return
+        }
+    }
+
+    upload, ok := h.findTusUpload(c, userID)
+    if !ok {
+        return
+    }
+
+    lock := tusLock(upload.ID)
+    if !lock.TryLock() {
+        c.String(http.StatusLocked, "upload is being written by another request")
+        return
+    }
+    defer lock.Unlock()
+
+    // Reload under the lock, another request may have moved the offset
+    if result := h.DB.First(upload, upload.ID); result.Error != nil {
+        c.AbortWithStatus(http.StatusNotFound)
+        return
+    }
+    if upload.Status != models.UploadSessionActive || offset != upload.Offset {
+        c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+        c.String(http.StatusConflict, "Upload-Offset does not match")
+        return
+    }
+
+    staging := tusStagingPath(upload.ID)
+    f, err := os.OpenFile(staging, os.O_WRONLY, 0o644)
+    if err != nil {
+        c.String(http.StatusInternalServerError, "failed to open upload")
+        return
+    }
+    defer f.Close()
+    if _, err := f.Seek(offset, io.SeekStart); err != nil {
+        c.String(http.StatusInternalServerError, "failed to open upload")
+        return
+    }
+
+    var w io.Writer = f
+    if checksum != nil {
+        w = io.MultiWriter(f, checksum)
+    }
+    // Never accept more than the declared length
+    written, copyErr := io.Copy(w, io.LimitReader(c.Request.Body, upload.Length-offset))
+
+    if checksum != nil && copyErr == nil && string(checksum.Sum(nil)) != string(expected) {
+        f.Truncate(offset)
+        c.String(StatusChecksumError, "checksum mismatch")
+        return
+    }
+
+    // Keep whatever arrived before a dropped connection so the client can
+    // resume from there, unless the chunk had to be verified as a whole.
+    if copyErr != nil && checksum != nil {
+        f.Truncate(offset)
+        written = 0
+    }
+
+    upload.Offset = offset + written
+    if result := h.DB.Model(upload).Update("upload_offset", upload.Offset); result.Error != nil {
+        f.Truncate(offset)
+        c.String(http.StatusInternalServerError, "failed to record upload offset")
+        return
+    }
+    c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+
+    if copyErr != nil {
+        c.String(http.StatusBadRequest, "failed to read chunk")
+        return
+    }
+
+    if upload.Offset == upload.Length {
+        if err := h.finishTusUpload(upload); err != nil {
+            tusFinishError(c, err)
+            return
+        }
+    }
+
+    c.Status(http.StatusNoContent)
+}
+
+// TusDelete terminates an upload (termination extension)
+func (h *Handler) TusDelete(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.AbortWithStatus(http.StatusUnauthorized)
+        return
+    }
+    if !tusHeaders(c) {
+        return
+    }
+
+    upload, ok := h.findTusUpload(c, userID)
+    if !ok {
+        return
+    }
+
+    lock := tusLock(upload.ID)
+    if !lock.TryLock() {
+        c.String(http.StatusLocked, "upload is being written by another request")
+        return
+    }
+    defer lock.Unlock()
+
+    h.discardTusUpload(upload)
+
+    c.Status(http.StatusNoContent)
+}
+
+// discardTusUpload terminates an active upload, dropping its staged bytes
+// and giving back the space reserved for it. It reports false when the
+// upload had already finished or been terminated by someone else.
+func (h *Handler) discardTusUpload(upload *models.TusUpload) bool {
+    defer tusLocks.Delete(upload.ID)
+    result := h.DB.Model(&models.TusUpload{}).Where("id = ? AND status = ?", upload.ID, models.UploadSessionActive).
+        Update("status", models.UploadSessionAborted)
+    if result.Error != nil || result.RowsAffected != 1 {
+        return false
+    }
+    upload.Status = models.UploadSessionAborted
+    os.Remove(tusStagingPath(upload.ID))
+    h.creditUsage(upload.UserID, upload.Length)
+    return true
+}
+
+// tusFinishError writes the response for an upload that could not be
+// finished.
+func tusFinishError(c *gin.Context, err error) {
+    if errors.Is(err, ErrContentTypeRejected) {
+        c.String(http.StatusUnsupportedMediaType, err.Error())
+        return
+    }
+    if errors.Is(err, ErrChecksumMismatch) {
+        c.String(StatusChecksumError, err.Error())
+        return
+    }
+    c.String(http.StatusInternalServerError, "failed to store file")
+}
+
+// finishTusUpload moves a fully received upload into storage and records it
+// as a regular File. An upload that cannot be finished is terminated, as
+// every byte of it has arrived and there is nothing left to resume.
+func (h *Handler) finishTusUpload(upload *models.TusUpload) (err error) {
+    defer func() {
+        if err != nil {
+            h.discardTusUpload(upload)
+        }
+    }()
+
+    staging := tusStagingPath(upload.ID)
+    f, err := os.Open(staging)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    // Sniff the real type now that the content is known; a rejected upload
+    // is terminated
+    contentType, err := sniffReader(f, upload.FileName)
+    if err != nil {
+        return err
+    }
+    if err := checkUploadPolicy(upload.FileName, contentType); err != nil {
+        return err
+    }
+    upload.ContentType = contentType
+
+    // The metadata was validated on creation, but the target file may have
+    // gone since; the upload then lands as a file of its own, and in the
+    // root if its folder was deleted too
+    var target *models.File
+    var folderID *uint
+    var expected Checksums
+    if meta, err := parseTusMetadata(upload.Metadata); err == nil {
+        expected, _ = parseChecksums(meta["sha256"], meta["md5"])
+        if meta["file_id"] != "" {
+            target, _ = h.findTargetFile(upload.UserID, meta["file_id"])
+        }
+        folderID, _ = parseFolderID(meta["folder_id"])
+        folderID = h.liveFolder(upload.UserID, folderID)
+    }
+
+    blob, err := h.storeContent(f, upload.FileName, upload.ContentType, expected)
+    if err != nil {
+        return err
+    }
+
+    fileRecord, err := h.commitUpload(upload.UserID, target, folderID, upload.FileName, upload.ContentType, blob)
+    if err != nil {
+        h.releaseContent(&blob.ID, blob.CloudPath)
+        return err
+    }
+
+    upload.Status = models.UploadSessionCompleted
+    upload.FileID = &fileRecord.ID
+    h.DB.Save(upload)
+
+    os.Remove(staging)
+    tusLocks.Delete(upload.ID)
+    return nil
+}
+
+// CleanupStaleTusUploads terminates active uploads that have not received
+// any bytes within TusUploadTTL, removing their staged bytes and giving
+// back the space reserved for them. It returns how many were terminated.
+func (h *Handler) CleanupStaleTusUploads() (int, error) {
+    var stale []models.TusUpload
+    cutoff := time.Now().Add(-TusUploadTTL)
+    if result := h.DB.Where("status = ? AND updated_at < ?", models.UploadSessionActive, cutoff).Find(&stale); result.Error != nil {
+        return 0, result.Error
+    }
+
+    removed := 0
+    for i := range stale {
+        upload := &stale[i]
+        // An upload being written to right now is not stale after all
+        lock := tusLock(upload.ID)
+        if !lock.TryLock() {
+            continue
+        }
+        // It may also have received bytes, finished or been terminated
+        // between the query and taking the lock
+        var current models.TusUpload
+        if err := h.DB.Where("id = ? AND status = ? AND updated_at < ?", upload.ID, models.UploadSessionActive, cutoff).
+            First(&current).Error; err != nil {
+            lock.Unlock()
+            continue
+        }
+        if h.discardTusUpload(&current) {
+            removed++
+        }
+        lock.Unlock()
+    }
+    return removed, nil
+}
+
+// StartTusUploadCleanup runs CleanupStaleTusUploads every interval until
+// the process exits.
+func (h *Handler) StartTusUploadCleanup(interval time.Duration) {
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for range ticker.C {
+            if _, err := h.CleanupStaleTusUploads(); err != nil {
+                log.Printf("Failed to fetch stale tus uploads: %v", err)
+            }
+        }
+    }()
+}
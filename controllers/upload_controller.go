@@ -0,0 +1,565 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "CloudBox/storage"
+    "crypto/md5"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+const (
+    MaxPartNumber = 10000   // S3 limit on parts per upload
+    MaxPartSize   = 5 << 30 // 5 GB, S3 limit on a single part
+    MinPartSize   = 5 << 20 // 5 MB, S3 minimum for every part but the last
+
+    UploadSessionTTL = 7 * 24 * time.Hour // idle sessions are aborted after this
+)
+
+var (
+    ErrIncompleteUpload = errors.New("upload is incomplete")
+    ErrPartTooSmall     = errors.New("only the last part may be smaller than the minimum part size")
+    ErrUploadNotActive  = errors.New("upload session is no longer active")
+)
+
+type InitiateUploadRequest struct {
+    FileName    string `json:"file_name" binding:"required"`
+    ContentType string `json:"content_type"`
+    FileID      *uint  `json:"file_id"`   // upload a new version of this file
+    FolderID    *uint  `json:"folder_id"` // omit for the root
+    SHA256      string `json:"sha256"`    // verified against the assembled file
+    MD5         string `json:"md5"`
+}
+
+type UploadSessionResponse struct {
+    SessionID   uint   `json:"session_id"`
+    FileName    string `json:"file_name"`
+    ContentType string `json:"content_type"`
+    Status      string `json:"status"`
+    MinPartSize int64  `json:"min_part_size"`
+    MaxPartSize int64  `json:"max_part_size"`
+}
+
+// countingReader counts the bytes read through it, for request bodies sent
+// without a Content-Length.
+type countingReader struct {
+    r io.Reader
+    n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+    n, err := cr.r.Read(p)
+    cr.n += int64(n)
+    return n, err
+}
+
+// findUploadSession loads an active upload session owned by userID.
+func (h *Handler) findUploadSession(c *gin.Context, userID interface{}) (*models.UploadSession, bool) {
+    var session models.UploadSession
+    if result := h.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&session); result.Error != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "upload session not found"})
+        return nil, false
+    }
+    if session.Status != models.UploadSessionActive {
+        c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("upload session is %s", session.Status)})
+        return nil, false
+    }
+    return &session, true
+}
+
+// startUploadSession starts a multipart upload of fileName into folderID,
+// or of a new version of the file targetID when it is set.
+func (h *Handler) startUploadSession(userID uint, fileName, contentType string, targetID, folderID *uint, expected Checksums) (*models.UploadSession, error) {
+    cloudPath := newCloudPath(fileName)
+    uploadID, err := h.Storage.CreateMultipartUpload(cloudPath, contentType)
+    if err != nil {
+        return nil, err
+    }
+
+    session := models.UploadSession{
+        UserID:          userID,
+        FileName:        fileName,
+        ContentType:     contentType,
+        CloudPath:       cloudPath,
+        StorageUploadID: uploadID,
+        Status:          models.UploadSessionActive,
+        TargetFileID:    targetID,
+        FolderID:        folderID,
+        SHA256:          expected.SHA256,
+        MD5:             expected.MD5,
+    }
+    if err := h.DB.Create(&session).Error; err != nil {
+        h.Storage.AbortMultipartUpload(cloudPath, uploadID)
+        return nil, err
+    }
+    return &session, nil
+}
+
+// storeSessionPart stores size bytes of body as part partNumber of session,
+// replacing any part sent earlier with that number. A part that does not
+// match the checksums the client expected is not recorded.
+func (h *Handler) storeSessionPart(session *models.UploadSession, partNumber int, body io.Reader, size int64, expected Checksums) (*models.UploadPart, error) {
+    // Fail early rather than at completion when the parts cannot fit
+    var received int64
+    h.DB.Model(&models.UploadPart{}).Where("session_id = ? AND part_number <> ?", session.ID, partNumber).
+        Select("COALESCE(SUM(size), 0)").Scan(&received)
+    if err := h.checkQuota(session.UserID, received+size); err != nil {
+        return nil, err
+    }
+    if size >= 0 {
+        if err := h.checkPartSize(session.ID, partNumber, size); err != nil {
+            return nil, err
+        }
+    }
+
+    sha, sum := sha256.New(), md5.New()
+    if expected != (Checksums{}) {
+        body = io.TeeReader(body, io.MultiWriter(sha, sum))
+    }
+    counted := &countingReader{r: body}
+    etag, err := h.Storage.UploadPart(session.CloudPath, session.StorageUploadID, partNumber, counted, size)
+    if err != nil {
+        return nil, err
+    }
+    if size < 0 {
+        if err := h.checkPartSize(session.ID, partNumber, counted.n); err != nil {
+            return nil, err
+        }
+    }
+    if expected != (Checksums{}) {
+        actual := Checksums{SHA256: hex.EncodeToString(sha.Sum(nil)), MD5: hex.EncodeToString(sum.Sum(nil))}
+        if err := expected.verify(actual); err != nil {
+            return nil, err
+        }
+    }
+
+    part := models.UploadPart{
+        SessionID:  session.ID,
+        PartNumber: partNumber,
+        ETag:       etag,
+        Size:       counted.n,
+    }
+    err = h.DB.Clauses(clause.OnConflict{
+        Columns:   []clause.Column{{Name: "session_id"}, {Name: "part_number"}},
+        DoUpdates: clause.AssignmentColumns([]string{"e_tag", "size", "updated_at"}),
+    }).Create(&part).Error
+    if err != nil {
+        return nil, err
+    }
+    return &part, nil
+}
+
+// checkPartSize refuses a part of size bytes numbered partNumber when it
+// means some part other than the last is under MinPartSize: a small part
+// once a later one has arrived, or any part after a small one.
+func (h *Handler) checkPartSize(sessionID uint, partNumber int, size int64) error {
+    query := h.DB.Model(&models.UploadPart{}).Where("session_id = ? AND part_number < ? AND size < ?", sessionID, partNumber, MinPartSize)
+    if size < MinPartSize {
+        query = query.Or("session_id = ? AND part_number > ?", sessionID, partNumber)
+    }
+    var conflicting int64
+    if err := query.Count(&conflicting).Error; err != nil {
+        return err
+    }
+    if conflicting > 0 {
+        return fmt.Errorf("%w of %d bytes", ErrPartTooSmall, MinPartSize)
+    }
+    return nil
+}
+
+// sessionParts lists the parts of session for assembly, checking that none
+// is missing and that only the last is under MinPartSize.
+func (h *Handler) sessionParts(session *models.UploadSession) ([]storage.CompletedPart, error) {
+    var parts []models.UploadPart
+    if err := h.DB.Where("session_id = ?", session.ID).Order("part_number").Find(&parts).Error; err != nil {
+        return nil, err
+    }
+    if len(parts) == 0 {
+        return nil, fmt.Errorf("%w: no parts have been uploaded", ErrIncompleteUpload)
+    }
+
+    completed := make([]storage.CompletedPart, 0, len(parts))
+    for i, part := range parts {
+        if part.PartNumber != i+1 {
+            return nil, fmt.Errorf("%w: part %d is missing", ErrIncompleteUpload, i+1)
+        }
+        if i < len(parts)-1 && part.Size < MinPartSize {
+            return nil, fmt.Errorf("%w of %d bytes, but part %d has %d", ErrPartTooSmall, MinPartSize, part.PartNumber, part.Size)
+        }
+        completed = append(completed, storage.CompletedPart{PartNumber: part.PartNumber, ETag: part.ETag})
+    }
+    return completed, nil
+}
+
+// completeSession assembles the parts of session, checks the result
+// against the upload policy, the quota and the client's checksums, and
+// records it as a file. The session is claimed first, so it is completed
+// only once however many requests ask for it. Once assembled it cannot be
+// completed again: sessions whose content is refused are aborted, and
+// those that fail for any other reason are marked failed.
+func (h *Handler) completeSession(session *models.UploadSession) (*models.File, error) {
+    claim := h.DB.Model(&models.UploadSession{}).Where("id = ? AND status = ?", session.ID, models.UploadSessionActive).
+        Update("status", models.UploadSessionCompleting)
+    if claim.Error != nil {
+        return nil, claim.Error
+    }
+    if claim.RowsAffected == 0 {
+        return nil, ErrUploadNotActive
+    }
+    session.Status = models.UploadSessionCompleting
+
+    // Nothing has been assembled if this fails, so the client may fix the
+    // parts and try again
+    completed, err := h.sessionParts(session)
+    if err == nil {
+        err = h.Storage.CompleteMultipartUpload(session.CloudPath, session.StorageUploadID, completed)
+    }
+    if err != nil {
+        session.Status = models.UploadSessionActive
+        h.DB.Save(session)
+        return nil, err
+    }
+
+    info, err := h.Storage.Stat(session.CloudPath)
+    if err != nil {
+        h.endSession(session, err)
+        return nil, err
+    }
+
+    // Sniff the real type of the assembled object
+    contentType, err := h.sniffStoredObject(session.CloudPath, session.FileName)
+    if err == nil {
+        err = checkUploadPolicy(session.FileName, contentType)
+    }
+    if err != nil {
+        h.endSession(session, err)
+        return nil, err
+    }
+    session.ContentType = contentType
+    if err := h.chargeUsage(session.UserID, info.Size); err != nil {
+        h.endSession(session, err)
+        return nil, err
+    }
+
+    // Hash the assembled object, replacing it with an existing copy if the
+    // same content was uploaded before
+    blob, err := h.adoptStoredObject(session.CloudPath, session.ContentType,
+        Checksums{SHA256: session.SHA256, MD5: session.MD5})
+    if err != nil {
+        h.creditUsage(session.UserID, info.Size)
+        h.endSession(session, err)
+        return nil, err
+    }
+
+    // The target file may have gone since the session started; the upload
+    // then lands as a file of its own, and in the root if its folder was
+    // deleted too
+    var target *models.File
+    if session.TargetFileID != nil {
+        target, _ = h.findTargetFile(session.UserID, *session.TargetFileID)
+    }
+
+    fileRecord, err := h.commitUpload(session.UserID, target, h.liveFolder(session.UserID, session.FolderID), session.FileName, session.ContentType, blob)
+    if err != nil {
+        // Releasing the blob deletes the object when nothing else uses it
+        h.releaseContent(&blob.ID, blob.CloudPath)
+        h.creditUsage(session.UserID, info.Size)
+        session.Status = models.UploadSessionFailed
+        h.DB.Save(session)
+        return nil, err
+    }
+
+    session.Status = models.UploadSessionCompleted
+    session.FileID = &fileRecord.ID
+    h.DB.Save(session)
+    return fileRecord, nil
+}
+
+// endSession deletes the object session was assembled into and records
+// why it ended: aborted when its content was refused, failed otherwise.
+func (h *Handler) endSession(session *models.UploadSession, err error) {
+    h.Storage.Delete(session.CloudPath)
+    session.Status = models.UploadSessionFailed
+    if errors.Is(err, ErrContentTypeRejected) || errors.Is(err, ErrQuotaExceeded) || errors.Is(err, ErrChecksumMismatch) {
+        session.Status = models.UploadSessionAborted
+    }
+    h.DB.Save(session)
+}
+
+// abortSession discards the parts of session. The session is claimed
+// first, so one that is being completed is left alone.
+func (h *Handler) abortSession(session *models.UploadSession) error {
+    claim := h.DB.Model(&models.UploadSession{}).Where("id = ? AND status = ?", session.ID, models.UploadSessionActive).
+        Update("status", models.UploadSessionAborted)
+    if claim.Error != nil {
+        return claim.Error
+    }
+    if claim.RowsAffected == 0 {
+        return ErrUploadNotActive
+    }
+
+    if err := h.Storage.AbortMultipartUpload(session.CloudPath, session.StorageUploadID); err != nil {
+        // The parts are still there, so the client may try again
+        h.DB.Model(&models.UploadSession{}).Where("id = ? AND status = ?", session.ID, models.UploadSessionAborted).
+            Update("status", models.UploadSessionActive)
+        return err
+    }
+    session.Status = models.UploadSessionAborted
+    return nil
+}
+
+// CleanupStaleUploadSessions aborts active upload sessions that have not
+// received a part within UploadSessionTTL, discarding the parts stored for
+// them. It returns how many were aborted.
+func (h *Handler) CleanupStaleUploadSessions() (int, error) {
+    cutoff := time.Now().Add(-UploadSessionTTL)
+    stale := func() *gorm.DB {
+        return h.DB.Model(&models.UploadSession{}).
+            Where("status = ? AND updated_at < ?", models.UploadSessionActive, cutoff).
+            Where("NOT EXISTS (SELECT 1 FROM upload_parts WHERE upload_parts.session_id = upload_sessions.id AND upload_parts.updated_at >= ?)", cutoff)
+    }
+    var sessions []models.UploadSession
+    if err := stale().Find(&sessions).Error; err != nil {
+        return 0, err
+    }
+
+    aborted := 0
+    for i := range sessions {
+        session := &sessions[i]
+        // A part may have arrived, or the session been completed or
+        // aborted, since the query
+        claim := stale().Where("id = ?", session.ID).Update("status", models.UploadSessionAborted)
+        if claim.Error != nil {
+            log.Printf("Failed to abort upload session %d: %v", session.ID, claim.Error)
+            continue
+        }
+        if claim.RowsAffected == 0 {
+            continue
+        }
+        // The storage may already have expired the parts
+        if err := h.Storage.AbortMultipartUpload(session.CloudPath, session.StorageUploadID); err != nil {
+            log.Printf("Failed to discard the parts of upload session %d: %v", session.ID, err)
+        }
+        aborted++
+    }
+    return aborted, nil
+}
+
+// StartUploadSessionCleanup runs CleanupStaleUploadSessions every interval
+// until the process exits.
+func (h *Handler) StartUploadSessionCleanup(interval time.Duration) {
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for range ticker.C {
+            if _, err := h.CleanupStaleUploadSessions(); err != nil {
+                log.Printf("Failed to fetch stale upload sessions: %v", err)
+            }
+        }
+    }()
+}
+
+// completeError writes the response for a failed completeSession.
+func completeError(c *gin.Context, err error) {
+    switch {
+    case errors.Is(err, ErrIncompleteUpload), errors.Is(err, ErrPartTooSmall):
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+    case errors.Is(err, ErrUploadNotActive):
+        c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+    case errors.Is(err, ErrContentTypeRejected):
+        contentTypeError(c, err)
+    case errors.Is(err, ErrQuotaExceeded):
+        quotaError(c, err)
+    case errors.Is(err, ErrChecksumMismatch):
+        checksumError(c, err)
+    default:
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to complete upload"})
+    }
+}
+
+// InitiateUpload starts a resumable multipart upload session
+func (h *Handler) InitiateUpload(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var req InitiateUploadRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    if req.ContentType == "" {
+        req.ContentType = "application/octet-stream"
+    }
+    // The content is sniffed on completion, but a forbidden extension can
+    // be refused straight away
+    if err := checkUploadPolicy(req.FileName, ""); err != nil {
+        contentTypeError(c, err)
+        return
+    }
+    expected, err := parseChecksums(req.SHA256, req.MD5)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    if req.FileID != nil {
+        if _, err := h.findTargetFile(userID.(uint), *req.FileID); err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+            return
+        }
+    }
+    if err := h.checkFolder(userID.(uint), req.FolderID); err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+        return
+    }
+
+    session, err := h.startUploadSession(userID.(uint), req.FileName, req.ContentType, req.FileID, req.FolderID, expected)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start upload"})
+        return
+    }
+
+    c.JSON(http.StatusCreated, UploadSessionResponse{
+        SessionID:   session.ID,
+        FileName:    session.FileName,
+        ContentType: session.ContentType,
+        Status:      session.Status,
+        MinPartSize: MinPartSize,
+        MaxPartSize: MaxPartSize,
+    })
+}
+
+// UploadPart stores the raw request body as part N of an upload session.
+// Sending the same part number again replaces the earlier part, which is
+// how clients resume after a dropped connection.
+func (h *Handler) UploadPart(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    partNumber, err := strconv.Atoi(c.Param("number"))
+    if err != nil || partNumber < 1 || partNumber > MaxPartNumber {
+        c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("part number must be between 1 and %d", MaxPartNumber)})
+        return
+    }
+    if c.Request.ContentLength > MaxPartSize {
+        c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "part too large"})
+        return
+    }
+
+    session, ok := h.findUploadSession(c, userID)
+    if !ok {
+        return
+    }
+
+    body := http.MaxBytesReader(c.Writer, c.Request.Body, MaxPartSize)
+    part, err := h.storeSessionPart(session, partNumber, body, c.Request.ContentLength, Checksums{})
+    if err != nil {
+        if errors.Is(err, ErrQuotaExceeded) {
+            quotaError(c, err)
+            return
+        }
+        if errors.Is(err, ErrPartTooSmall) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to upload part"})
+        return
+    }
+
+    c.JSON(http.StatusOK, part)
+}
+
+// ListUploadParts returns the parts received so far, letting a client work
+// out which parts still need to be sent.
+func (h *Handler) ListUploadParts(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    session, ok := h.findUploadSession(c, userID)
+    if !ok {
+        return
+    }
+
+    var parts []models.UploadPart
+    if result := h.DB.Where("session_id = ?", session.ID).Order("part_number").Find(&parts); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch parts"})
+        return
+    }
+
+    var received int64
+    for _, part := range parts {
+        received += part.Size
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "session_id":     session.ID,
+        "parts":          parts,
+        "bytes_received": received,
+    })
+}
+
+// CompleteUpload assembles the received parts and records the resulting file
+func (h *Handler) CompleteUpload(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    session, ok := h.findUploadSession(c, userID)
+    if !ok {
+        return
+    }
+
+    fileRecord, err := h.completeSession(session)
+    if err != nil {
+        completeError(c, err)
+        return
+    }
+
+    c.JSON(http.StatusOK, newFileUploadResponse(fileRecord))
+}
+
+// AbortUpload cancels an upload session and discards its parts
+func (h *Handler) AbortUpload(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    session, ok := h.findUploadSession(c, userID)
+    if !ok {
+        return
+    }
+
+    if err := h.abortSession(session); err != nil {
+        if errors.Is(err, ErrUploadNotActive) {
+            c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+            return
+        }
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to abort upload"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "upload aborted"})
+}
@@ -0,0 +1,416 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "CloudBox/utils"
+    "errors"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+)
+
+type PruneVersionsRequest struct {
+    Keep          *int `json:"keep"`            // previous versions to keep
+    OlderThanDays *int `json:"older_than_days"` // drop previous versions older than this
+}
+
+// versionLimits returns the retention applied after every new version:
+// MAX_FILE_VERSIONS previous versions (-1, the default, keeps them all)
+// and FILE_VERSION_RETENTION_DAYS of age (0, the default, keeps them
+// forever).
+func versionLimits() (int, time.Duration) {
+    keep, err := strconv.Atoi(utils.GetEnv("MAX_FILE_VERSIONS"))
+    if err != nil || keep < 0 {
+        keep = -1
+    }
+    days, _ := strconv.Atoi(utils.GetEnv("FILE_VERSION_RETENTION_DAYS", "0"))
+    return keep, time.Duration(days) * 24 * time.Hour
+}
+
+// findFileByName returns userID's available file called fileName in
+// folderID (nil for the root), or nil when there is none.
+func (h *Handler) findFileByName(userID uint, folderID *uint, fileName string) (*models.File, error) {
+    var file models.File
+    err := inFolder(h.DB, "folder_id", folderID).Where("user_id = ? AND file_name = ? AND status = ?",
+        userID, fileName, models.FileStatusAvailable).First(&file).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &file, nil
+}
+
+// findTargetFile loads the available file of userID that an upload names
+// with a file_id, so the upload can become its next version.
+func (h *Handler) findTargetFile(userID uint, fileID interface{}) (*models.File, error) {
+    var file models.File
+    err := h.DB.Where("id = ? AND user_id = ? AND status = ?",
+        fileID, userID, models.FileStatusAvailable).First(&file).Error
+    if err != nil {
+        return nil, err
+    }
+    return &file, nil
+}
+
+// commitUpload records freshly stored content. The content becomes a new
+// version of target, or of the user's existing file with the same name in
+// folderID when target is nil; otherwise a new file is created there.
+func (h *Handler) commitUpload(userID uint, target *models.File, folderID *uint, fileName, contentType string, blob *models.Blob) (*models.File, error) {
+    if target == nil {
+        existing, err := h.findFileByName(userID, folderID, fileName)
+        if err != nil {
+            return nil, err
+        }
+        target = existing
+    }
+    if target != nil {
+        return target, h.addVersion(target, blob, contentType)
+    }
+
+    fileRecord := models.File{
+        UserID:      userID,
+        FolderID:    folderID,
+        FileName:    fileName,
+        FileSize:    blob.Size,
+        ContentType: contentType,
+        CloudPath:   blob.CloudPath,
+        BlobID:      &blob.ID,
+        SHA256:      blob.Hash,
+        MD5:         blob.MD5,
+        UploadDate:  time.Now(),
+        Version:     1,
+        ScanStatus:  newScanStatus(),
+    }
+    if result := h.DB.Create(&fileRecord); result.Error != nil {
+        return nil, result.Error
+    }
+    h.fileChanged(&fileRecord, models.ChangeCreate)
+    h.processContent(&fileRecord)
+    return &fileRecord, nil
+}
+
+// saveUpload stores content received in full the way a form upload is:
+// its type is sniffed and checked against the upload policy, the user is
+// charged for it, and it is committed as a new file in folderID or a new
+// version of target or of the file with the same name.
+func (h *Handler) saveUpload(userID uint, target *models.File, folderID *uint, fileName string, body io.ReadSeeker, size int64, expected Checksums) (*models.File, error) {
+    contentType, err := sniffReader(body, fileName)
+    if err == nil {
+        err = checkUploadPolicy(fileName, contentType)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    if err := h.chargeUsage(userID, size); err != nil {
+        return nil, err
+    }
+    blob, err := h.storeContent(body, fileName, contentType, expected)
+    if err != nil {
+        h.creditUsage(userID, size)
+        return nil, err
+    }
+    fileRecord, err := h.commitUpload(userID, target, h.liveFolder(userID, folderID), fileName, contentType, blob)
+    if err != nil {
+        h.releaseContent(&blob.ID, blob.CloudPath)
+        h.creditUsage(userID, size)
+        return nil, err
+    }
+    return fileRecord, nil
+}
+
+// addVersion moves file's current content into its history and makes blob
+// the current content, then applies the configured version retention.
+func (h *Handler) addVersion(file *models.File, blob *models.Blob, contentType string) error {
+    err := h.DB.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(file, file.ID).Error; err != nil {
+            return err
+        }
+
+        previous := models.FileVersion{
+            FileID:        file.ID,
+            VersionNumber: file.Version,
+            FileSize:      file.FileSize,
+            ContentType:   file.ContentType,
+            CloudPath:     file.CloudPath,
+            BlobID:        file.BlobID,
+            SHA256:        file.SHA256,
+            MD5:           file.MD5,
+            UploadDate:    file.UploadDate,
+            ScanStatus:    file.ScanStatus,
+            ScanResult:    file.ScanResult,
+        }
+        if err := tx.Create(&previous).Error; err != nil {
+            return err
+        }
+
+        file.Version++
+        file.FileSize = blob.Size
+        file.ContentType = contentType
+        file.CloudPath = blob.CloudPath
+        file.BlobID = &blob.ID
+        file.SHA256 = blob.Hash
+        file.MD5 = blob.MD5
+        file.UploadDate = time.Now()
+        file.HasThumbnail = false
+        file.ScanStatus, file.ScanResult, file.ScannedAt = newScanStatus(), "", nil
+        return tx.Save(file).Error
+    })
+    if err != nil {
+        return err
+    }
+    h.fileChanged(file, models.ChangeUpdate)
+    h.processContent(file)
+
+    keep, maxAge := versionLimits()
+    if keep >= 0 || maxAge > 0 {
+        if _, err := h.pruneVersions(file, keep, maxAge); err != nil {
+            log.Printf("Failed to prune versions of file %d: %v", file.ID, err)
+        }
+    }
+    return nil
+}
+
+// pruneVersions deletes previous versions of file beyond the newest keep,
+// and any older than maxAge. A negative keep or a zero maxAge disables
+// that limit.
+func (h *Handler) pruneVersions(file *models.File, keep int, maxAge time.Duration) (int, error) {
+    var versions []models.FileVersion
+    if err := h.DB.Where("file_id = ?", file.ID).Order("version_number DESC").Find(&versions).Error; err != nil {
+        return 0, err
+    }
+
+    pruned := 0
+    for i, version := range versions {
+        tooMany := keep >= 0 && i >= keep
+        tooOld := maxAge > 0 && time.Since(version.UploadDate) > maxAge
+        if !tooMany && !tooOld {
+            continue
+        }
+        if err := h.DB.Unscoped().Delete(&version).Error; err != nil {
+            return pruned, err
+        }
+        if err := h.releaseContent(version.BlobID, version.CloudPath); err != nil {
+            log.Printf("Failed to release content of file %d version %d: %v", file.ID, version.VersionNumber, err)
+        }
+        h.creditUsage(file.UserID, version.FileSize)
+        pruned++
+    }
+    return pruned, nil
+}
+
+// findOwnedFile loads the available file named by the :id parameter if it
+// belongs to userID, writing a 404 otherwise.
+func (h *Handler) findOwnedFile(c *gin.Context, userID interface{}) (*models.File, bool) {
+    var file models.File
+    if result := h.DB.Where("id = ? AND user_id = ? AND status = ?",
+        c.Param("id"), userID, models.FileStatusAvailable).First(&file); result.Error != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+        return nil, false
+    }
+    return &file, true
+}
+
+// findVersion loads the previous version named by the :version parameter.
+func (h *Handler) findVersion(c *gin.Context, file *models.File) (*models.FileVersion, bool) {
+    var version models.FileVersion
+    if result := h.DB.Where("file_id = ? AND version_number = ?",
+        file.ID, c.Param("version")).First(&version); result.Error != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "version not found"})
+        return nil, false
+    }
+    return &version, true
+}
+
+// ListFileVersions returns the current version of a file followed by its
+// history, newest first.
+func (h *Handler) ListFileVersions(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    file, ok := h.findOwnedFile(c, userID)
+    if !ok {
+        return
+    }
+
+    var history []models.FileVersion
+    if result := h.DB.Where("file_id = ?", file.ID).Order("version_number DESC").Find(&history); result.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch versions"})
+        return
+    }
+
+    versions := []gin.H{{
+        "version":      file.Version,
+        "file_size":    file.FileSize,
+        "content_type": file.ContentType,
+        "sha256":       file.SHA256,
+        "upload_date":  file.UploadDate,
+        "current":      true,
+    }}
+    for _, version := range history {
+        versions = append(versions, gin.H{
+            "version":      version.VersionNumber,
+            "file_size":    version.FileSize,
+            "content_type": version.ContentType,
+            "sha256":       version.SHA256,
+            "upload_date":  version.UploadDate,
+            "current":      false,
+        })
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "file_id":   file.ID,
+        "file_name": file.FileName,
+        "versions":  versions,
+    })
+}
+
+// DownloadFileVersion returns a download URL for a previous version
+func (h *Handler) DownloadFileVersion(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    file, ok := h.findOwnedFile(c, userID)
+    if !ok {
+        return
+    }
+    version, ok := h.findVersion(c, file)
+    if !ok {
+        return
+    }
+    if err := scanBlocked(version.ScanStatus, version.ScanResult); err != nil {
+        scanError(c, err)
+        return
+    }
+
+    url, err := h.Storage.PresignGet(version.CloudPath, 15*time.Minute)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate download url"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "download_url": url,
+        "file_name":    file.FileName,
+        "version":      version.VersionNumber,
+        "sha256":       version.SHA256,
+        "md5":          version.MD5,
+        "expires_in":   "15 minutes",
+    })
+}
+
+// RestoreFileVersion makes the content of a previous version current again.
+// The restore is itself recorded as a new version, so nothing is lost.
+func (h *Handler) RestoreFileVersion(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    file, ok := h.findOwnedFile(c, userID)
+    if !ok {
+        return
+    }
+    version, ok := h.findVersion(c, file)
+    if !ok {
+        return
+    }
+
+    // Restored content is scanned afresh, which would let content found
+    // infected be downloaded until the scan catches it again
+    if err := scanBlocked(version.ScanStatus, version.ScanResult); errors.Is(err, ErrFileInfected) {
+        scanError(c, err)
+        return
+    }
+
+    if err := h.chargeUsage(file.UserID, version.FileSize); err != nil {
+        quotaError(c, err)
+        return
+    }
+
+    if err := h.adoptLegacyContent(version, &version.BlobID, &version.CloudPath, version.ContentType); err != nil {
+        h.creditUsage(file.UserID, version.FileSize)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to restore version"})
+        return
+    }
+    blob, err := h.shareBlob(*version.BlobID)
+    if err != nil {
+        h.creditUsage(file.UserID, version.FileSize)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to restore version"})
+        return
+    }
+
+    restoredFrom := version.VersionNumber
+    if err := h.addVersion(file, blob, version.ContentType); err != nil {
+        h.releaseContent(&blob.ID, blob.CloudPath)
+        h.creditUsage(file.UserID, version.FileSize)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to restore version"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "file_id":       file.ID,
+        "version":       file.Version,
+        "restored_from": restoredFrom,
+    })
+}
+
+// PruneFileVersions deletes previous versions beyond a count or age. Limits
+// missing from the request fall back to the deployment's retention.
+func (h *Handler) PruneFileVersions(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var req PruneVersionsRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    keep, maxAge := versionLimits()
+    if req.Keep != nil {
+        keep = *req.Keep
+    }
+    if req.OlderThanDays != nil {
+        maxAge = time.Duration(*req.OlderThanDays) * 24 * time.Hour
+    }
+    if (req.Keep != nil && *req.Keep < 0) || maxAge < 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "keep and older_than_days must not be negative"})
+        return
+    }
+    if keep < 0 && maxAge == 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "keep or older_than_days is required"})
+        return
+    }
+
+    file, ok := h.findOwnedFile(c, userID)
+    if !ok {
+        return
+    }
+
+    pruned, err := h.pruneVersions(file, keep, maxAge)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to prune versions"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"file_id": file.ID, "pruned": pruned})
+}
@@ -0,0 +1,584 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "golang.org/x/net/webdav"
+    "gorm.io/gorm"
+)
+
+// DAVPrefix is where the WebDAV view of each user's drive is mounted.
+const DAVPrefix = "/dav"
+
+// DAVMethods are the HTTP methods the WebDAV endpoint answers.
+var DAVMethods = []string{
+    "OPTIONS", "GET", "HEAD", "POST", "PUT", "DELETE",
+    "PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+var errIsFolder = errors.New("is a folder")
+
+// davLocks holds a lock system per user, since lock paths are relative to
+// each user's drive. Locks live in memory, so they do not survive a
+// restart or span several instances.
+var davLocks = struct {
+    sync.Mutex
+    systems map[uint]webdav.LockSystem
+}{systems: make(map[uint]webdav.LockSystem)}
+
+func davLockSystem(userID uint) webdav.LockSystem {
+    davLocks.Lock()
+    defer davLocks.Unlock()
+    ls, ok := davLocks.systems[userID]
+    if !ok {
+        ls = webdav.NewMemLS()
+        davLocks.systems[userID] = ls
+    }
+    return ls
+}
+
+// DAVAuth authenticates WebDAV requests with HTTP Basic credentials, the
+// same username and password used to log in, since WebDAV clients cannot
+// obtain bearer tokens. Failed attempts count towards the account lockout.
+func (h *Handler) DAVAuth(c *gin.Context) {
+    username, password, ok := c.Request.BasicAuth()
+    if !ok {
+        c.Header("WWW-Authenticate", `Basic realm="CloudBox"`)
+        c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "authorization required"})
+        return
+    }
+
+    user, err := h.checkCredentials(username, password)
+    var locked *accountLockedError
+    if errors.As(err, &locked) {
+        c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+        return
+    }
+    if errors.Is(err, ErrAccountDisabled) {
+        c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+        return
+    }
+    if err != nil {
+        c.Header("WWW-Authenticate", `Basic realm="CloudBox"`)
+        c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+        return
+    }
+
+    c.Set("currentUser", *user)
+    c.Set("userID", user.ID)
+    c.Next()
+}
+
+// WebDAV serves the caller's folders and files over WebDAV, so the drive
+// can be mounted by file managers and office tools. It works on the same
+// records and storage as the REST API: uploads are deduplicated and
+// charged to the quota, overwriting a file adds a version, and deletes go
+// to the trash.
+func (h *Handler) WebDAV(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    // Refuse uploads that cannot succeed before their body is read
+    if c.Request.Method == http.MethodPut {
+        if err := checkUploadPolicy(path.Base(c.Request.URL.Path), ""); err != nil {
+            contentTypeError(c, err)
+            return
+        }
+        if c.Request.ContentLength > 0 {
+            if err := h.checkQuota(userID.(uint), c.Request.ContentLength); err != nil {
+                quotaError(c, err)
+                return
+            }
+        }
+
+        // The webdav package closes the file it writes even when copying
+        // the body failed, so the writer needs to know how the body went
+        body := &davBody{ReadCloser: c.Request.Body, length: c.Request.ContentLength}
+        c.Request.Body = body
+        c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), davBodyKey{}, body))
+    }
+
+    // Quarantined and infected files are listed but cannot be read. The
+    // check comes first because listings open files too
+    fs := &davFS{h: h, userID: userID.(uint)}
+    if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+        name, _ := strings.CutPrefix(c.Request.URL.Path, DAVPrefix)
+        if node, err := fs.resolve(name); err == nil && node.file != nil {
+            if err := scanBlocked(node.file.ScanStatus, node.file.ScanResult); err != nil {
+                scanError(c, err)
+                return
+            }
+        }
+    }
+
+    handler := &webdav.Handler{
+        Prefix:     DAVPrefix,
+        FileSystem: fs,
+        LockSystem: davLockSystem(userID.(uint)),
+        Logger: func(r *http.Request, err error) {
+            if err != nil && !errors.Is(err, os.ErrNotExist) {
+                log.Printf("WebDAV %s %s: %v", r.Method, r.URL.Path, err)
+            }
+        },
+    }
+    handler.ServeHTTP(c.Writer, c.Request)
+}
+
+// davFS presents one user's drive as a webdav.FileSystem. Paths name
+// folders by their names from the root, ending in a folder or file name;
+// where a folder and a file share a name, the folder wins.
+type davFS struct {
+    h      *Handler
+    userID uint
+}
+
+// davNode is what a path resolved to: a folder, a file, or the root when
+// both are nil.
+type davNode struct {
+    folder *models.Folder
+    file   *models.File
+}
+
+// parent resolves the folder holding name and returns it with the last
+// segment of name.
+func (fs *davFS) parent(name string) (*uint, string, error) {
+    segments := splitPath(name)
+    if len(segments) == 0 {
+        return nil, "", os.ErrPermission // the root has no parent
+    }
+    folderID, err := fs.h.resolveFolder(fs.userID, segments[:len(segments)-1])
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        return nil, "", os.ErrNotExist
+    }
+    if err != nil {
+        return nil, "", err
+    }
+    return folderID, segments[len(segments)-1], nil
+}
+
+// resolve finds what name refers to, failing with os.ErrNotExist.
+func (fs *davFS) resolve(name string) (*davNode, error) {
+    if len(splitPath(name)) == 0 {
+        return &davNode{}, nil
+    }
+    parentID, base, err := fs.parent(name)
+    if err != nil {
+        return nil, err
+    }
+
+    var folder models.Folder
+    err = inFolder(fs.h.DB, "parent_id", parentID).Where("user_id = ? AND name = ?", fs.userID, base).First(&folder).Error
+    if err == nil {
+        return &davNode{folder: &folder}, nil
+    }
+    if !errors.Is(err, gorm.ErrRecordNotFound) {
+        return nil, err
+    }
+
+    file, err := fs.h.findFileByName(fs.userID, parentID, base)
+    if err != nil {
+        return nil, err
+    }
+    if file == nil {
+        return nil, os.ErrNotExist
+    }
+    return &davNode{file: file}, nil
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+    parentID, base, err := fs.parent(name)
+    if err != nil {
+        return err
+    }
+    if err := validateName(base); err != nil {
+        return err
+    }
+    if _, err := fs.resolve(name); err == nil {
+        return os.ErrExist
+    } else if !errors.Is(err, os.ErrNotExist) {
+        return err
+    }
+
+    folder := models.Folder{UserID: fs.userID, Name: base, ParentID: parentID}
+    if err := fs.h.DB.Create(&folder).Error; err != nil {
+        return err
+    }
+    fs.h.folderChanged(&folder, models.ChangeCreate)
+    return nil
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+    writing := flag&(os.O_WRONLY|os.O_RDWR) != 0
+
+    node, err := fs.resolve(name)
+    if errors.Is(err, os.ErrNotExist) && flag&os.O_CREATE != 0 {
+        parentID, base, err := fs.parent(name)
+        if err != nil {
+            return nil, err
+        }
+        if err := validateName(base); err != nil {
+            return nil, err
+        }
+        return fs.newWriter(ctx, parentID, base, nil)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+        return nil, os.ErrExist
+    }
+
+    switch {
+    case node.file == nil && writing:
+        return nil, errIsFolder
+    case node.file == nil:
+        return &davDir{fs: fs, node: node}, nil
+    case writing:
+        return fs.newWriter(ctx, node.file.FolderID, node.file.FileName, node.file)
+    }
+    return davReader{&fileReader{h: fs.h, file: node.file}}, nil
+}
+
+// RemoveAll moves a file to the trash, or deletes a folder and trashes
+// the files below it.
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+    node, err := fs.resolve(name)
+    if errors.Is(err, os.ErrNotExist) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    switch {
+    case node.file != nil:
+        if err := fs.h.DB.Delete(node.file).Error; err != nil {
+            return err
+        }
+        fs.h.fileChanged(node.file, models.ChangeDelete)
+        return nil
+    case node.folder != nil:
+        _, _, err := fs.h.deleteFolderTree(node.folder)
+        return err
+    }
+    return os.ErrPermission
+}
+
+// Rename moves and renames files and folders. The destination must not
+// exist; the webdav handler removes it first when overwriting.
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+    node, err := fs.resolve(oldName)
+    if err != nil {
+        return err
+    }
+    if node.file == nil && node.folder == nil {
+        return os.ErrPermission
+    }
+    parentID, base, err := fs.parent(newName)
+    if err != nil {
+        return err
+    }
+    if err := validateName(base); err != nil {
+        return err
+    }
+    if _, err := fs.resolve(newName); err == nil {
+        return os.ErrExist
+    } else if !errors.Is(err, os.ErrNotExist) {
+        return err
+    }
+
+    if node.file != nil {
+        if err := fs.h.DB.Model(node.file).Updates(map[string]interface{}{
+            "file_name": base,
+            "folder_id": parentID,
+        }).Error; err != nil {
+            return err
+        }
+        node.file.FileName, node.file.FolderID = base, parentID
+        fs.h.refreshSearch(node.file.ID)
+        fs.h.fileChanged(node.file, models.ChangeMove)
+        return nil
+    }
+
+    // A folder cannot be moved into itself or one of its descendants
+    if parentID != nil {
+        subtree, err := fs.h.folderSubtree(fs.userID, node.folder.ID)
+        if err != nil {
+            return err
+        }
+        for _, id := range subtree {
+            if id == *parentID {
+                return os.ErrInvalid
+            }
+        }
+    }
+    if err := fs.h.DB.Model(node.folder).Updates(map[string]interface{}{
+        "name":      base,
+        "parent_id": parentID,
+    }).Error; err != nil {
+        return err
+    }
+    node.folder.Name, node.folder.ParentID = base, parentID
+    fs.h.folderChanged(node.folder, models.ChangeMove)
+    return nil
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+    node, err := fs.resolve(name)
+    if err != nil {
+        return nil, err
+    }
+    return node.info(), nil
+}
+
+func (n *davNode) info() *davInfo {
+    switch {
+    case n.file != nil:
+        return &davInfo{
+            name:        n.file.FileName,
+            size:        n.file.FileSize,
+            modTime:     n.file.UploadDate,
+            contentType: n.file.ContentType,
+            etag:        n.file.SHA256,
+        }
+    case n.folder != nil:
+        return &davInfo{name: n.folder.Name, modTime: n.folder.UpdatedAt, dir: true}
+    }
+    return &davInfo{name: "/", modTime: time.Now(), dir: true}
+}
+
+// davInfo describes a folder or file. It reports the stored content type
+// and checksum so that listings need not read the content.
+type davInfo struct {
+    name        string
+    size        int64
+    modTime     time.Time
+    dir         bool
+    contentType string
+    etag        string
+}
+
+func (fi *davInfo) Name() string       { return fi.name }
+func (fi *davInfo) Size() int64        { return fi.size }
+func (fi *davInfo) ModTime() time.Time { return fi.modTime }
+func (fi *davInfo) IsDir() bool        { return fi.dir }
+func (fi *davInfo) Sys() interface{}   { return nil }
+
+func (fi *davInfo) Mode() os.FileMode {
+    if fi.dir {
+        return os.ModeDir | 0755
+    }
+    return 0644
+}
+
+func (fi *davInfo) ContentType(ctx context.Context) (string, error) {
+    if fi.contentType == "" {
+        return "", webdav.ErrNotImplemented
+    }
+    return fi.contentType, nil
+}
+
+func (fi *davInfo) ETag(ctx context.Context) (string, error) {
+    if fi.etag == "" {
+        return "", webdav.ErrNotImplemented
+    }
+    return `"` + fi.etag + `"`, nil
+}
+
+// davUnsupported provides the operations a kind of webdav.File does not
+// support.
+type davUnsupported struct{}
+
+func (davUnsupported) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (davUnsupported) Write(p []byte) (int, error)                  { return 0, os.ErrInvalid }
+func (davUnsupported) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
+func (davUnsupported) Readdir(count int) ([]os.FileInfo, error)     { return nil, os.ErrInvalid }
+
+// davDir lists a folder, or the root.
+type davDir struct {
+    davUnsupported
+    fs      *davFS
+    node    *davNode
+    entries []os.FileInfo
+    loaded  bool
+}
+
+func (d *davDir) Stat() (os.FileInfo, error) { return d.node.info(), nil }
+func (d *davDir) Close() error               { return nil }
+
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+    if !d.loaded {
+        if err := d.load(); err != nil {
+            return nil, err
+        }
+        d.loaded = true
+    }
+    if count <= 0 {
+        entries := d.entries
+        d.entries = nil
+        return entries, nil
+    }
+    if len(d.entries) == 0 {
+        return nil, io.EOF
+    }
+    if count > len(d.entries) {
+        count = len(d.entries)
+    }
+    entries := d.entries[:count]
+    d.entries = d.entries[count:]
+    return entries, nil
+}
+
+// load reads the folders and available files inside the directory. Files
+// hidden behind a folder of the same name are left out.
+func (d *davDir) load() error {
+    var folderID *uint
+    if d.node.folder != nil {
+        folderID = &d.node.folder.ID
+    }
+
+    var folders []models.Folder
+    if err := inFolder(d.fs.h.DB, "parent_id", folderID).Where("user_id = ?", d.fs.userID).
+        Order("name").Find(&folders).Error; err != nil {
+        return err
+    }
+    var files []models.File
+    if err := inFolder(d.fs.h.DB, "folder_id", folderID).Where("user_id = ? AND status = ?",
+        d.fs.userID, models.FileStatusAvailable).Order("file_name").Find(&files).Error; err != nil {
+        return err
+    }
+
+    names := make(map[string]bool, len(folders))
+    for i := range folders {
+        names[folders[i].Name] = true
+        d.entries = append(d.entries, (&davNode{folder: &folders[i]}).info())
+    }
+    for i := range files {
+        if !names[files[i].FileName] {
+            d.entries = append(d.entries, (&davNode{file: &files[i]}).info())
+        }
+    }
+    return nil
+}
+
+// davReader reads a file's current content.
+type davReader struct {
+    *fileReader
+}
+
+func (r davReader) Stat() (os.FileInfo, error)                { return (&davNode{file: r.file}).info(), nil }
+func (r davReader) Write(p []byte) (int, error)              { return 0, os.ErrInvalid }
+func (r davReader) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+
+// davWriter spools new content to a temporary file and stores it on Close
+// through the same checks as any other upload. Writing past the user's
+// remaining quota fails early, before the content is stored.
+type davWriter struct {
+    davUnsupported
+    fs        *davFS
+    folderID  *uint
+    name      string
+    target    *models.File // file the content becomes a version of, if any
+    tmp       *os.File
+    size      int64
+    remaining int64
+    body      *davBody // the PUT body being written, if any
+    err       error    // first failed write
+}
+
+// davBodyKey is the context key of the body of a WebDAV PUT.
+type davBodyKey struct{}
+
+// davBody wraps a PUT body to remember how reading it ended, since a
+// client that disconnects shows up only as a read error.
+type davBody struct {
+    io.ReadCloser
+    length int64 // the declared Content-Length, -1 when unknown
+    err    error
+}
+
+func (b *davBody) Read(p []byte) (int, error) {
+    n, err := b.ReadCloser.Read(p)
+    if err != nil && !errors.Is(err, io.EOF) && b.err == nil {
+        b.err = err
+    }
+    return n, err
+}
+
+func (fs *davFS) newWriter(ctx context.Context, folderID *uint, name string, target *models.File) (*davWriter, error) {
+    var user models.User
+    if err := fs.h.DB.First(&user, fs.userID).Error; err != nil {
+        return nil, err
+    }
+    body, _ := ctx.Value(davBodyKey{}).(*davBody)
+    tmp, err := os.CreateTemp("", "cloudbox-dav-*")
+    if err != nil {
+        return nil, err
+    }
+    return &davWriter{
+        fs:        fs,
+        folderID:  folderID,
+        name:      name,
+        target:    target,
+        tmp:       tmp,
+        remaining: effectiveQuota(&user) - user.UsedBytes,
+        body:      body,
+    }, nil
+}
+
+func (w *davWriter) Write(p []byte) (int, error) {
+    if w.err != nil {
+        return 0, w.err
+    }
+    if w.size+int64(len(p)) > w.remaining {
+        w.err = ErrQuotaExceeded
+        return 0, w.err
+    }
+    n, err := w.tmp.Write(p)
+    w.size += int64(n)
+    w.err = err
+    return n, err
+}
+
+func (w *davWriter) Stat() (os.FileInfo, error) {
+    return &davInfo{name: w.name, size: w.size, modTime: time.Now()}, nil
+}
+
+// Close stores what was written, unless the upload was cut short: a write
+// failed, reading the body failed or fewer bytes came than declared. The
+// staged content is thrown away either way.
+func (w *davWriter) Close() error {
+    defer os.Remove(w.tmp.Name())
+    defer w.tmp.Close()
+    if w.err != nil {
+        return w.err
+    }
+    if w.body != nil {
+        if w.body.err != nil {
+            return w.body.err
+        }
+        if w.body.length >= 0 && w.size != w.body.length {
+            return fmt.Errorf("received %d of %d bytes: %w", w.size, w.body.length, io.ErrUnexpectedEOF)
+        }
+    }
+    if _, err := w.tmp.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+    _, err := w.fs.h.saveUpload(w.fs.userID, w.target, w.folderID, w.name, w.tmp, w.size, Checksums{})
+    return err
+}
@@ -0,0 +1,226 @@
+package controllers
+
+import (
+    "CloudBox/models"
+    "archive/zip"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "path"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+)
+
+const MaxZipFiles = 10000
+
+type ZipDownloadRequest struct {
+    FileIDs  []uint `json:"file_ids"`
+    FolderID *uint  `json:"folder_id"` // archive this folder and everything below it
+}
+
+// zipEntry is one file to be written to an archive under name.
+type zipEntry struct {
+    name string
+    file models.File
+}
+
+// uniqueName returns name, or name with a " (n)" suffix before its
+// extension if the archive already holds an entry by that name.
+func uniqueName(name string, used map[string]bool) string {
+    ext := path.Ext(name)
+    base := strings.TrimSuffix(name, ext)
+    candidate := name
+    for n := 2; used[strings.ToLower(candidate)]; n++ {
+        candidate = fmt.Sprintf("%s (%d)%s", base, n, ext)
+    }
+    used[strings.ToLower(candidate)] = true
+    return candidate
+}
+
+// zipFolderEntries lists every available file below rootID, named by its
+// path relative to the folder's parent, so the folder itself is the top
+// directory of the archive.
+func (h *Handler) zipFolderEntries(userID, rootID uint) (string, []zipEntry, error) {
+    subtree, err := h.folderSubtree(userID, rootID)
+    if err != nil {
+        return "", nil, err
+    }
+    var folders []models.Folder
+    if err := h.DB.Where("id IN ?", subtree).Find(&folders).Error; err != nil {
+        return "", nil, err
+    }
+    byID := make(map[uint]models.Folder, len(folders))
+    for _, folder := range folders {
+        byID[folder.ID] = folder
+    }
+    var dirPath func(id uint) string
+    dirPath = func(id uint) string {
+        folder := byID[id]
+        if id == rootID || folder.ParentID == nil {
+            return folder.Name
+        }
+        return dirPath(*folder.ParentID) + "/" + folder.Name
+    }
+
+    var files []models.File
+    if err := h.DB.Where("user_id = ? AND folder_id IN ? AND status = ?",
+        userID, subtree, models.FileStatusAvailable).Order("folder_id, file_name").Find(&files).Error; err != nil {
+        return "", nil, err
+    }
+    entries := make([]zipEntry, 0, len(files))
+    for _, file := range files {
+        entries = append(entries, zipEntry{name: dirPath(*file.FolderID) + "/" + file.FileName, file: file})
+    }
+    return byID[rootID].Name, entries, nil
+}
+
+// zipFileEntries lists the requested files, named by their full path in
+// the user's drive.
+func (h *Handler) zipFileEntries(userID uint, fileIDs []uint) ([]zipEntry, error) {
+    var files []models.File
+    if err := h.DB.Where("id IN ? AND user_id = ? AND status = ?",
+        fileIDs, userID, models.FileStatusAvailable).Find(&files).Error; err != nil {
+        return nil, err
+    }
+    if len(files) != len(fileIDs) {
+        return nil, fmt.Errorf("%d of %d files not found", len(fileIDs)-len(files), len(fileIDs))
+    }
+
+    // Keep the order the files were requested in
+    byID := make(map[uint]models.File, len(files))
+    for _, file := range files {
+        byID[file.ID] = file
+    }
+
+    paths := make(map[uint]string)
+    entries := make([]zipEntry, 0, len(files))
+    for _, id := range fileIDs {
+        file := byID[id]
+        dir := ""
+        if file.FolderID != nil {
+            if _, ok := paths[*file.FolderID]; !ok {
+                p, err := h.folderPath(file.FolderID)
+                if err != nil {
+                    return nil, err
+                }
+                paths[*file.FolderID] = strings.TrimPrefix(p, "/") + "/"
+            }
+            dir = paths[*file.FolderID]
+        }
+        entries = append(entries, zipEntry{name: dir + file.FileName, file: file})
+    }
+    return entries, nil
+}
+
+// DownloadZip streams a ZIP archive of several files, or of a whole folder,
+// straight from storage to the client. Nothing is staged on disk, so the
+// response has no Content-Length and a failure part way through can only
+// end the stream early.
+func (h *Handler) DownloadZip(c *gin.Context) {
+    userID, exists := c.Get("userID")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+        return
+    }
+
+    var req ZipDownloadRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    if (len(req.FileIDs) == 0) == (req.FolderID == nil) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "either file_ids or folder_id is required"})
+        return
+    }
+
+    archiveName := "files"
+    var entries []zipEntry
+    var err error
+    if req.FolderID != nil {
+        if err := h.checkFolder(userID.(uint), req.FolderID); err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "folder not found"})
+            return
+        }
+        archiveName, entries, err = h.zipFolderEntries(userID.(uint), *req.FolderID)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list folder"})
+            return
+        }
+    } else {
+        if len(req.FileIDs) > MaxZipFiles {
+            c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d files can be archived at once", MaxZipFiles)})
+            return
+        }
+        entries, err = h.zipFileEntries(userID.(uint), dedupeIDs(req.FileIDs))
+        if err != nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+            return
+        }
+    }
+
+    // Quarantined and infected files are left out of a folder's archive,
+    // but asking for one by ID fails the whole request
+    allowed := entries[:0]
+    for _, entry := range entries {
+        if err := scanBlocked(entry.file.ScanStatus, entry.file.ScanResult); err != nil {
+            if req.FolderID == nil {
+                scanError(c, fmt.Errorf("%s: %w", entry.file.FileName, err))
+                return
+            }
+            continue
+        }
+        allowed = append(allowed, entry)
+    }
+    entries = allowed
+
+    c.Header("Content-Type", "application/zip")
+    c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", archiveName+".zip"))
+    c.Status(http.StatusOK)
+
+    zw := zip.NewWriter(c.Writer)
+    used := make(map[string]bool)
+    for _, entry := range entries {
+        if err := h.writeZipEntry(zw, uniqueName(entry.name, used), &entry.file); err != nil {
+            log.Printf("Failed to add file %d to zip: %v", entry.file.ID, err)
+            return
+        }
+    }
+    if err := zw.Close(); err != nil {
+        log.Printf("Failed to finish zip: %v", err)
+    }
+}
+
+// writeZipEntry copies one file from storage into the archive.
+func (h *Handler) writeZipEntry(zw *zip.Writer, name string, file *models.File) error {
+    body, err := h.Storage.Get(file.CloudPath)
+    if err != nil {
+        return err
+    }
+    defer body.Close()
+
+    w, err := zw.CreateHeader(&zip.FileHeader{
+        Name:     name,
+        Method:   zip.Deflate,
+        Modified: file.UploadDate,
+    })
+    if err != nil {
+        return err
+    }
+    _, err = io.Copy(w, body)
+    return err
+}
+
+// dedupeIDs drops repeated IDs, keeping the first occurrence of each.
+func dedupeIDs(ids []uint) []uint {
+    seen := make(map[uint]bool, len(ids))
+    unique := ids[:0:0]
+    for _, id := range ids {
+        if !seen[id] {
+            seen[id] = true
+            unique = append(unique, id)
+        }
+    }
+    return unique
+}
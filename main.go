@@ -6,6 +6,7 @@ import (
     "CloudBox/controllers"
     "CloudBox/middlewares"
     "CloudBox/utils"
+    "log"
     "time"
 )
 
@@ -13,14 +14,30 @@ func main() {
     // Load env variables
     utils.LoadEnv()
 
+    // Application-scoped handles shared by every request
+    db := utils.ConnectDB()
+    store, err := utils.NewStorage()
+    if err != nil {
+        log.Fatalf("Failed to initialise storage: %v", err)
+    }
+    h := controllers.NewHandler(db, store)
+    h.StartPendingUploadCleanup(10 * time.Minute)
+    h.StartTusUploadCleanup(time.Hour)
+    h.StartUploadSessionCleanup(time.Hour)
+    h.StartTrashPurge(time.Hour)
+    h.StartChangePrune(24 * time.Hour)
+    h.StartPendingScans(5 * time.Minute)
+
     r := gin.Default()
 
     // CORS
     r.Use(cors.New(cors.Config{
         AllowOrigins:     []string{"*"},
         AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
-        AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Authorization", "Refresh-Token"},
-        ExposeHeaders:    []string{"Content-Length"},
+        AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Authorization", "Refresh-Token",
+            "Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset", "Upload-Checksum"},
+        ExposeHeaders:    []string{"Content-Length", "Location", "Tus-Resumable", "Tus-Version", "Tus-Extension",
+            "Tus-Checksum-Algorithm", "Upload-Length", "Upload-Metadata", "Upload-Offset"},
         AllowCredentials: true,
         MaxAge:          12 * time.Hour,
     }))
@@ -28,21 +45,113 @@ func main() {
     // Public routes
     auth := r.Group("/auth")
     {
-        auth.POST("/register", controllers.CreateUser)
-        auth.POST("/login", controllers.Login)
-        auth.POST("/refresh", controllers.RefreshToken)
+        auth.POST("/register", h.CreateUser)
+        auth.POST("/login", h.Login)
+        auth.POST("/refresh", h.RefreshToken)
+    }
+
+    // Signed downloads and uploads for the local storage backend
+    r.GET("/storage/*key", h.ServeLocalObject)
+    r.PUT("/storage/*key", h.ReceiveLocalObject)
+
+    // tus discovery requests carry no credentials
+    r.OPTIONS("/api/files/tus", h.TusOptions)
+
+    // Public share links
+    r.GET("/share/:token", h.AccessSharedFile)
+
+    // WebDAV, for mounting the drive in file managers and office tools
+    dav := r.Group(controllers.DAVPrefix)
+    dav.Use(h.DAVAuth)
+    for _, method := range controllers.DAVMethods {
+        dav.Handle(method, "", h.WebDAV)
+        dav.Handle(method, "/*path", h.WebDAV)
     }
 
     // Protected routes
     protected := r.Group("/api")
-    protected.Use(middlewares.CheckAuth())
+    protected.Use(middlewares.CheckAuth(db))
     {
-        protected.GET("/profile", controllers.GetUserProfile)
+        protected.GET("/profile", h.GetUserProfile)
+
 
+        protected.POST("/files/upload", h.UploadFile)
+        protected.GET("/files/list", h.ListFiles)
+        protected.GET("/files/resolve", h.ResolvePath)
+        protected.POST("/files/zip", h.DownloadZip)
+        protected.GET("/files/download/:id", h.DownloadFile)
+        protected.DELETE("/files/:id", h.DeleteFile)
+        protected.PATCH("/files/:id", h.RenameFile)
+        protected.POST("/files/:id/move", h.MoveFile)
+        protected.POST("/files/:id/copy", h.CopyFile)
+        protected.GET("/files/:id/thumbnail", h.GetThumbnail)
+        protected.POST("/files/:id/verify", h.VerifyFile)
+        protected.GET("/files/:id/tags", h.GetFileTags)
+        protected.POST("/files/:id/tags", h.AddFileTags)
+        protected.DELETE("/files/:id/tags/:tag", h.RemoveFileTag)
+        protected.PUT("/files/:id/metadata", h.SetFileMetadata)
+        protected.DELETE("/files/:id/metadata/:key", h.DeleteFileMetadata)
+        protected.GET("/tags", h.ListTags)
+        protected.GET("/search", h.SearchFiles)
+        protected.GET("/changes", h.ListChanges)
+        protected.POST("/files/presign", h.PresignUpload)
+        protected.POST("/files/:id/confirm", h.ConfirmUpload)
+        protected.GET("/files/:id/versions", h.ListFileVersions)
+        protected.GET("/files/:id/versions/:version/download", h.DownloadFileVersion)
+        protected.POST("/files/:id/versions/:version/restore", h.RestoreFileVersion)
+        protected.POST("/files/:id/versions/prune", h.PruneFileVersions)
+
+        protected.POST("/files/tus", h.TusCreate)
+        protected.HEAD("/files/tus/:id", h.TusHead)
+        protected.PATCH("/files/tus/:id", h.TusPatch)
+        protected.DELETE("/files/tus/:id", h.TusDelete)
+
+        protected.POST("/uploads", h.InitiateUpload)
+        protected.PUT("/uploads/:id/parts/:number", h.UploadPart)
+        protected.GET("/uploads/:id/parts", h.ListUploadParts)
+        protected.POST("/uploads/:id/complete", h.CompleteUpload)
+        protected.DELETE("/uploads/:id", h.AbortUpload)
+
+        protected.POST("/folders", h.CreateFolder)
+        protected.GET("/folders", h.ListFolder)
+        protected.GET("/folders/:id", h.ListFolder)
+        protected.PATCH("/folders/:id", h.RenameFolder)
+        protected.POST("/folders/:id/move", h.MoveFolder)
+        protected.DELETE("/folders/:id", h.DeleteFolder)
+
+        protected.GET("/trash", h.ListTrash)
+        protected.POST("/trash/:id/restore", h.RestoreFromTrash)
+        protected.DELETE("/trash", h.EmptyTrash)
+
+        protected.POST("/shares", h.CreateShareLink)
+        protected.GET("/shares", h.ListShares)
+        protected.DELETE("/shares/:token", h.RevokeShare)
+
+        protected.POST("/access-keys", h.CreateAccessKey)
+        protected.GET("/access-keys", h.ListAccessKeys)
+        protected.DELETE("/access-keys/:id", h.DeleteAccessKey)
+    }
 
-        protected.POST("/files/upload", controllers.UploadFile)
-        protected.GET("/files/list", controllers.ListFiles)
-        protected.GET("/files/download/:id", controllers.DownloadFile)
+    // S3-compatible gateway on its own listener, with path-style buckets
+    // named after each user
+    if addr := utils.GetEnv("S3_GATEWAY_ADDR"); addr != "" {
+        gateway := gin.Default()
+        gateway.Use(h.S3Auth)
+        gateway.GET("/", h.S3ListBuckets)
+        gateway.HEAD("/:bucket", h.S3HeadBucket)
+        gateway.PUT("/:bucket", h.S3CreateBucket)
+        gateway.GET("/:bucket", h.S3GetBucket)
+        gateway.POST("/:bucket", h.S3DeleteObjects)
+        gateway.HEAD("/:bucket/*key", h.S3GetObject)
+        gateway.GET("/:bucket/*key", h.S3GetObject)
+        gateway.PUT("/:bucket/*key", h.S3PutObject)
+        gateway.POST("/:bucket/*key", h.S3PostObject)
+        gateway.DELETE("/:bucket/*key", h.S3DeleteObject)
+        go func() {
+            if err := gateway.Run(addr); err != nil {
+                log.Fatalf("S3 gateway stopped: %v", err)
+            }
+        }()
     }
 
     r.Run()
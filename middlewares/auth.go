@@ -2,7 +2,6 @@ package middlewares
 
 import (
 	"CloudBox/models"
-	"CloudBox/utils"
 	"fmt"
 	"net/http"
 	"os"
@@ -10,11 +9,12 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
 )
 
-func CheckAuth() gin.HandlerFunc {
-    utils.LoadEnv()
-    db := utils.ConnectDB()
+// CheckAuth validates the bearer access token and loads the user it was
+// issued for, using the application's shared database handle.
+func CheckAuth(db *gorm.DB) gin.HandlerFunc {
     return func(c *gin.Context) {
         authHeader := c.GetHeader("Authorization")
         if authHeader == "" {
@@ -52,8 +52,13 @@ func CheckAuth() gin.HandlerFunc {
                 c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
                 return
             }
+            if user.Disabled {
+                c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "account is disabled"})
+                return
+            }
 
             c.Set("currentUser", user)
+            c.Set("userID", user.ID)
             c.Next()
         } else {
             c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token claims"})
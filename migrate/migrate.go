@@ -9,14 +9,65 @@ import (
 
 func init() {
 	initializers.LoadEnvs()
-	initializers.ConnectDB()
 
 }
 
 func main() {
     db := utils.ConnectDB()
-    err := db.AutoMigrate(&models.User{})
+    err := db.AutoMigrate(
+        &models.User{},
+        &models.Folder{},
+        &models.Blob{},
+        &models.File{},
+        &models.FileVersion{},
+        &models.FileShare{},
+        &models.FileTag{},
+        &models.FileMetadata{},
+        &models.FileSearchDocument{},
+        &models.UploadSession{},
+        &models.UploadPart{},
+        &models.TusUpload{},
+        &models.AccessKey{},
+        &models.Change{},
+    )
     if err != nil {
         log.Fatal(err)
     }
+
+    // Recompute storage usage from the files (including those in the trash)
+    // and older versions each user holds, so accounts created before quotas
+    // were tracked start from the right figure
+    err = db.Exec(`UPDATE users SET used_bytes = (
+        SELECT COALESCE(SUM(file_size), 0) FROM files
+        WHERE files.user_id = users.id AND files.status = ?
+    ) + (
+        SELECT COALESCE(SUM(file_versions.file_size), 0) FROM file_versions
+        JOIN files ON files.id = file_versions.file_id
+        WHERE files.user_id = users.id AND file_versions.deleted_at IS NULL
+    )`, models.FileStatusAvailable).Error
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    // Files and versions stored since deduplication already have their
+    // SHA-256 as the blob hash; older content gets it on verification
+    for _, table := range []string{"files", "file_versions"} {
+        err = db.Exec(`UPDATE ` + table + ` SET sha256 = blobs.hash, md5 = blobs.md5
+            FROM blobs WHERE ` + table + `.blob_id = blobs.id AND COALESCE(` + table + `.sha256, '') = ''`).Error
+        if err != nil {
+            log.Fatal(err)
+        }
+    }
+
+    // Files uploaded before search existed are indexed on their names and
+    // tags; their content is indexed when it next changes
+    err = db.Exec(`INSERT INTO file_search_documents (created_at, updated_at, file_id, content)
+        SELECT NOW(), NOW(), files.id, '' FROM files
+        WHERE NOT EXISTS (SELECT 1 FROM file_search_documents d WHERE d.file_id = files.id)`).Error
+    if err != nil {
+        log.Fatal(err)
+    }
+    if err = models.RefreshSearchDocuments(db); err != nil {
+        log.Fatal(err)
+    }
 }
\ No newline at end of file
@@ -0,0 +1,19 @@
+package models
+
+import (
+    "time"
+    "gorm.io/gorm"
+)
+
+// AccessKey is an S3-style credential pair for the S3 gateway. The secret
+// is kept as issued, since SigV4 verification needs it to recompute
+// signatures; it is only shown to the user when the key is created.
+type AccessKey struct {
+    gorm.Model
+    UserID      uint       `json:"user_id" gorm:"index"`
+    Name        string     `json:"name"`
+    AccessKeyID string     `json:"access_key_id" gorm:"uniqueIndex;size:32"`
+    SecretKey   string     `json:"-"`
+    LastUsedAt  *time.Time `json:"last_used_at"`
+    User        User       `json:"-" gorm:"foreignKey:UserID"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+    "gorm.io/gorm"
+)
+
+// Blob is a stored object identified by the SHA-256 of its content. Files
+// with identical bytes point at the same Blob, and the object is only
+// removed from storage once RefCount drops to zero.
+type Blob struct {
+    gorm.Model
+    Hash        string `json:"hash" gorm:"size:64;uniqueIndex"`
+    MD5         string `json:"md5" gorm:"size:32"`
+    CloudPath   string `json:"-"`
+    Size        int64  `json:"size"`
+    ContentType string `json:"content_type"`
+    RefCount    int    `json:"ref_count" gorm:"default:0"`
+}
@@ -0,0 +1,60 @@
+package models
+
+import (
+    "time"
+
+    "gorm.io/gorm"
+)
+
+const (
+    ChangeCreate = "create"
+    ChangeUpdate = "update"
+    ChangeMove   = "move"
+    ChangeDelete = "delete"
+
+    ChangeEntryFile   = "file"
+    ChangeEntryFolder = "folder"
+)
+
+// Change is one entry of a user's change journal: a file or folder that
+// was created, updated, moved or renamed (both recorded as a move), or
+// deleted. Seq numbers each user's changes in order and is what sync
+// clients use as their cursor. Name, FolderID, FileSize and Version
+// describe the entry as the change left it.
+type Change struct {
+    ID        uint      `json:"-" gorm:"primarykey"`
+    CreatedAt time.Time `json:"created_at" gorm:"index"`
+    UserID    uint      `json:"-" gorm:"uniqueIndex:idx_change_user_seq"`
+    Seq       int64     `json:"seq" gorm:"uniqueIndex:idx_change_user_seq"`
+    Action    string    `json:"action" gorm:"size:16"`
+    EntryType string    `json:"entry_type" gorm:"size:16"`
+    EntryID   uint      `json:"entry_id"`
+    Name      string    `json:"name"`
+    FolderID  *uint     `json:"folder_id"`
+    FileSize  int64     `json:"file_size,omitempty"`
+    Version   int       `json:"version,omitempty"`
+}
+
+// RecordChanges appends changes to userID's journal. Sequence numbers are
+// taken from the user's row, which stays locked until the changes are
+// committed, so they become visible in sequence order and a reader that
+// has seen one change has seen every earlier one.
+func RecordChanges(db *gorm.DB, userID uint, changes []Change) error {
+    if len(changes) == 0 {
+        return nil
+    }
+    return db.Transaction(func(tx *gorm.DB) error {
+        var seq int64
+        err := tx.Raw("UPDATE users SET change_seq = change_seq + ? WHERE id = ? RETURNING change_seq",
+            len(changes), userID).Scan(&seq).Error
+        if err != nil {
+            return err
+        }
+        first := seq - int64(len(changes))
+        for i := range changes {
+            changes[i].UserID = userID
+            changes[i].Seq = first + int64(i) + 1
+        }
+        return tx.Create(&changes).Error
+    })
+}
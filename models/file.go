@@ -5,13 +5,43 @@ import (
     "gorm.io/gorm"
 )
 
+const (
+    FileStatusPending    = "pending"
+    FileStatusConfirming = "confirming" // claimed by a confirmation in progress
+    FileStatusAvailable  = "available"
+)
+
+// Virus scan statuses of stored content. Content cannot be downloaded or
+// shared while pending or failed, nor once found infected.
+const (
+    ScanStatusUnscanned = "unscanned" // stored while scanning was off
+    ScanStatusPending   = "pending"
+    ScanStatusClean     = "clean"
+    ScanStatusInfected  = "infected"
+    ScanStatusFailed    = "failed" // the scanner could not scan the content
+)
+
 type File struct {
     gorm.Model
-    UserID      uint      `json:"user_id"`
-    FileName    string    `json:"file_name"`
-    FileSize    int64     `json:"file_size"`
-    ContentType string    `json:"content_type"`
-    CloudPath   string    `json:"cloud_path"`
-    UploadDate  time.Time `json:"upload_date"`
-    User        User      `gorm:"foreignKey:UserID"`
+    UserID       uint           `json:"user_id"`
+    FolderID     *uint          `json:"folder_id" gorm:"index"`
+    FileName     string         `json:"file_name"`
+    FileSize     int64          `json:"file_size"`
+    ContentType  string         `json:"content_type"`
+    CloudPath    string         `json:"cloud_path"`
+    UploadDate   time.Time      `json:"upload_date"`
+    Status       string         `json:"status" gorm:"default:available;index"`
+    Version      int            `json:"version" gorm:"default:1"`
+    BlobID       *uint          `json:"blob_id,omitempty" gorm:"index"`
+    SHA256       string         `json:"sha256" gorm:"size:64"`
+    MD5          string         `json:"md5" gorm:"size:32"`
+    HasThumbnail bool           `json:"has_thumbnail"`
+    ScanStatus   string         `json:"scan_status" gorm:"default:unscanned;index"`
+    ScanResult   string         `json:"scan_result,omitempty"` // the signature found, or why the scan failed
+    ScannedAt    *time.Time     `json:"scanned_at,omitempty"`
+    ThumbnailURL string         `json:"thumbnail_url,omitempty" gorm:"-"`
+    Tags         []FileTag      `json:"tags,omitempty" gorm:"foreignKey:FileID"`
+    Metadata     []FileMetadata `json:"metadata,omitempty" gorm:"foreignKey:FileID"`
+    Blob         *Blob          `json:"-" gorm:"foreignKey:BlobID"`
+    User         User           `gorm:"foreignKey:UserID"`
 }
\ No newline at end of file
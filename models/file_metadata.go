@@ -0,0 +1,17 @@
+package models
+
+import (
+    "gorm.io/gorm"
+)
+
+// FileMetadata is one user-defined key/value pair on a File.
+type FileMetadata struct {
+    gorm.Model
+    FileID uint   `json:"-" gorm:"uniqueIndex:idx_file_metadata_key"`
+    Key    string `json:"key" gorm:"size:128;uniqueIndex:idx_file_metadata_key;index"`
+    Value  string `json:"value" gorm:"size:1024"`
+}
+
+func (FileMetadata) TableName() string {
+    return "file_metadata"
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+    "gorm.io/gorm"
+)
+
+// FileSearchDocument holds what full-text search matches a File on: its
+// name, its tags and, for text-like uploads, the extracted text. Document
+// is the tsvector built from them by RefreshSearchDocuments.
+type FileSearchDocument struct {
+    gorm.Model
+    FileID   uint   `json:"file_id" gorm:"uniqueIndex"`
+    Content  string `json:"-" gorm:"type:text"`
+    Document string `json:"-" gorm:"type:tsvector;->;index:idx_file_search_document,type:gin"`
+}
+
+// RefreshSearchDocuments rebuilds the tsvector of the given files, or of
+// every file when none are given. Names weigh most, then tags, then
+// content. Names are indexed both whole and split at punctuation, so
+// "report" finds "q3-report.pdf"; names and tags are not stemmed.
+func RefreshSearchDocuments(db *gorm.DB, fileIDs ...uint) error {
+    query := `UPDATE file_search_documents d SET updated_at = NOW(), document =
+        setweight(to_tsvector('simple', f.file_name || ' ' ||
+            regexp_replace(f.file_name, '[^[:alnum:]]+', ' ', 'g')), 'A') ||
+        setweight(to_tsvector('simple', COALESCE((
+            SELECT string_agg(t.name, ' ') FROM file_tags t WHERE t.file_id = f.id
+        ), '')), 'B') ||
+        setweight(to_tsvector('english', d.content), 'C')
+        FROM files f WHERE f.id = d.file_id`
+    if len(fileIDs) == 0 {
+        return db.Exec(query).Error
+    }
+    return db.Exec(query+" AND f.id IN ?", fileIDs).Error
+}
@@ -0,0 +1,14 @@
+package models
+
+import (
+    "gorm.io/gorm"
+)
+
+// FileTag attaches a user-defined tag to a File. Tags are stored lower
+// case, so "Acme" and "acme" are the same tag.
+type FileTag struct {
+    gorm.Model
+    FileID uint   `json:"-" gorm:"uniqueIndex:idx_file_tag"`
+    UserID uint   `json:"-" gorm:"index"`
+    Name   string `json:"name" gorm:"size:64;uniqueIndex:idx_file_tag;index"`
+}
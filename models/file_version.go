@@ -0,0 +1,23 @@
+package models
+
+import (
+    "time"
+    "gorm.io/gorm"
+)
+
+// FileVersion keeps the content of a File as it was before a newer
+// version replaced it. The current content always lives on the File row.
+type FileVersion struct {
+    gorm.Model
+    FileID        uint      `json:"file_id" gorm:"uniqueIndex:idx_file_version"`
+    VersionNumber int       `json:"version" gorm:"uniqueIndex:idx_file_version"`
+    FileSize      int64     `json:"file_size"`
+    ContentType   string    `json:"content_type"`
+    CloudPath     string    `json:"-"`
+    BlobID        *uint     `json:"-" gorm:"index"`
+    SHA256        string    `json:"sha256" gorm:"size:64"`
+    MD5           string    `json:"md5" gorm:"size:32"`
+    UploadDate    time.Time `json:"upload_date"`
+    ScanStatus    string    `json:"scan_status" gorm:"default:unscanned;index"`
+    ScanResult    string    `json:"scan_result,omitempty"`
+}
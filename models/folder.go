@@ -0,0 +1,17 @@
+package models
+
+import (
+    "gorm.io/gorm"
+)
+
+// Folder groups files into a per-user tree. A nil ParentID places the
+// folder at the root of the user's drive.
+type Folder struct {
+    gorm.Model
+    UserID   uint     `json:"user_id" gorm:"index"`
+    Name     string   `json:"name"`
+    ParentID *uint    `json:"parent_id" gorm:"index"`
+    Parent   *Folder  `json:"-" gorm:"foreignKey:ParentID"`
+    Children []Folder `json:"-" gorm:"foreignKey:ParentID"`
+    User     User     `json:"-" gorm:"foreignKey:UserID"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+    "gorm.io/gorm"
+)
+
+// TusUpload tracks an upload made through the tus resumable upload
+// protocol. Bytes are staged on local disk until Offset reaches Length,
+// at which point the upload is stored and recorded as a File.
+type TusUpload struct {
+    gorm.Model
+    UserID      uint   `json:"user_id"`
+    FileName    string `json:"file_name"`
+    ContentType string `json:"content_type"`
+    Length      int64  `json:"length"`
+    Offset      int64  `json:"offset" gorm:"column:upload_offset"`
+    Metadata    string `json:"metadata"`
+    Status      string `json:"status" gorm:"default:active"`
+    FileID      *uint  `json:"file_id,omitempty"`
+    User        User   `json:"-" gorm:"foreignKey:UserID"`
+}
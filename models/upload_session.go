@@ -0,0 +1,41 @@
+package models
+
+import (
+    "gorm.io/gorm"
+)
+
+const (
+    UploadSessionActive     = "active"
+    UploadSessionCompleting = "completing" // claimed by a completion in progress
+    UploadSessionCompleted  = "completed"
+    UploadSessionAborted    = "aborted"
+    UploadSessionFailed     = "failed" // assembled, but could not be stored
+)
+
+// UploadSession tracks a resumable multipart upload until it is completed
+// into a File or aborted.
+type UploadSession struct {
+    gorm.Model
+    UserID          uint         `json:"user_id"`
+    FileName        string       `json:"file_name"`
+    ContentType     string       `json:"content_type"`
+    CloudPath       string       `json:"-"`
+    StorageUploadID string       `json:"-"`
+    Status          string       `json:"status" gorm:"default:active"`
+    TargetFileID    *uint        `json:"target_file_id,omitempty"`
+    FolderID        *uint        `json:"folder_id,omitempty"`
+    SHA256          string       `json:"sha256,omitempty"` // expected by the client
+    MD5             string       `json:"md5,omitempty"`
+    FileID          *uint        `json:"file_id,omitempty"`
+    Parts           []UploadPart `json:"parts,omitempty" gorm:"foreignKey:SessionID"`
+    User            User         `json:"-" gorm:"foreignKey:UserID"`
+}
+
+// UploadPart records one part received for an UploadSession.
+type UploadPart struct {
+    gorm.Model
+    SessionID  uint   `json:"-" gorm:"uniqueIndex:idx_session_part"`
+    PartNumber int    `json:"part_number" gorm:"uniqueIndex:idx_session_part"`
+    ETag       string `json:"etag"`
+    Size       int64  `json:"size"`
+}
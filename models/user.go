@@ -13,4 +13,8 @@ type User struct {
     LoginAttempts int       `json:"login_attempts" gorm:"default:0"`
     LockedUntil   time.Time `json:"locked_until"`
     LastLogin     time.Time `json:"last_login"`
+    Disabled      bool      `json:"disabled" gorm:"default:false"` // refused everywhere, data kept
+    QuotaBytes    int64     `json:"quota_bytes" gorm:"default:0"` // 0 means the deployment default
+    UsedBytes     int64     `json:"used_bytes" gorm:"default:0"`
+    ChangeSeq     int64     `json:"-" gorm:"default:0"` // last sequence number of the change journal
 }
\ No newline at end of file
@@ -0,0 +1,382 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidSignature = errors.New("invalid or expired signature")
+
+// LocalStorage keeps objects on the local filesystem. Object bodies live
+// under <root>/objects and their metadata under <root>/meta. Downloads are
+// served and accepted by CloudBox itself through URLs signed with secret.
+type LocalStorage struct {
+	root    string
+	baseURL string
+	secret  []byte
+}
+
+type localMeta struct {
+	ContentType string `json:"content_type"`
+	ETag        string `json:"etag"`
+}
+
+func NewLocal(root, baseURL, secret string) (*LocalStorage, error) {
+	if secret == "" {
+		return nil, errors.New("local storage needs a secret to sign download urls")
+	}
+	for _, dir := range []string{"objects", "meta"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &LocalStorage{
+		root:    root,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		secret:  []byte(secret),
+	}, nil
+}
+
+// paths returns the object and metadata paths for key, refusing keys that
+// would escape the storage root.
+func (l *LocalStorage) paths(key string) (string, string, error) {
+	// Cleaning the key as an absolute path drops any ".." segments that
+	// would otherwise climb out of the root.
+	clean := path.Clean("/" + key)
+	if clean == "/" {
+		return "", "", fmt.Errorf("invalid object key %q", key)
+	}
+	rel := filepath.FromSlash(strings.TrimPrefix(clean, "/"))
+	return filepath.Join(l.root, "objects", rel), filepath.Join(l.root, "meta", rel+".json"), nil
+}
+
+func (l *LocalStorage) Put(key string, body io.Reader, size int64, contentType string) error {
+	objPath, metaPath, err := l.paths(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(objPath), 0o755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(metaPath), 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see a partial object.
+	tmp, err := os.CreateTemp(filepath.Dir(objPath), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := md5.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hash), body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("expected %d bytes, got %d", size, written)
+	}
+
+	meta, err := json.Marshal(localMeta{
+		ContentType: contentType,
+		ETag:        hex.EncodeToString(hash.Sum(nil)),
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(metaPath, meta, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), objPath)
+}
+
+func (l *LocalStorage) Get(key string) (io.ReadCloser, error) {
+	objPath, _, err := l.paths(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(objPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (l *LocalStorage) Stat(key string) (ObjectInfo, error) {
+	objPath, metaPath, err := l.paths(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fi, err := os.Stat(objPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info := ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		LastModified: fi.ModTime(),
+	}
+	var meta localMeta
+	if raw, err := os.ReadFile(metaPath); err == nil && json.Unmarshal(raw, &meta) == nil {
+		info.ContentType = meta.ContentType
+		info.ETag = meta.ETag
+	}
+	if info.ContentType == "" {
+		info.ContentType = mime.TypeByExtension(filepath.Ext(key))
+	}
+	return info, nil
+}
+
+func (l *LocalStorage) Delete(key string) error {
+	objPath, metaPath, err := l.paths(key)
+	if err != nil {
+		return err
+	}
+	for _, p := range []string{objPath, metaPath} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy hard links the object to dstKey when the filesystem allows it, and
+// falls back to copying the bytes otherwise. Objects are replaced rather
+// than written in place, so the two keys never affect each other.
+func (l *LocalStorage) Copy(srcKey, dstKey string) error {
+	srcObj, srcMeta, err := l.paths(srcKey)
+	if err != nil {
+		return err
+	}
+	dstObj, dstMeta, err := l.paths(dstKey)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(srcObj); errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err := os.MkdirAll(filepath.Dir(dstObj), 0o755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dstMeta), 0o755); err != nil {
+		return err
+	}
+
+	if raw, err := os.ReadFile(srcMeta); err == nil {
+		if err := os.WriteFile(dstMeta, raw, 0o644); err != nil {
+			return err
+		}
+	}
+	if err := os.Link(srcObj, dstObj); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(srcObj)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dstObj), ".copy-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dstObj)
+}
+
+// PresignGet returns a URL pointing at CloudBox's own /storage route. The
+// route checks the signature with VerifySignature before serving the file.
+func (l *LocalStorage) PresignGet(key string, expires time.Duration) (string, error) {
+	return l.presign("GET", key, expires)
+}
+
+// PresignPut returns a URL the /storage route accepts uploads on.
+func (l *LocalStorage) PresignPut(key, contentType string, expires time.Duration) (string, error) {
+	return l.presign("PUT", key, expires)
+}
+
+func (l *LocalStorage) presign(method, key string, expires time.Duration) (string, error) {
+	if _, _, err := l.paths(key); err != nil {
+		return "", err
+	}
+	exp := strconv.FormatInt(time.Now().Add(expires).Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", exp)
+	query.Set("signature", l.sign(method, key, exp))
+	escaped := (&url.URL{Path: key}).EscapedPath()
+	return fmt.Sprintf("%s/storage/%s?%s", l.baseURL, escaped, query.Encode()), nil
+}
+
+// VerifySignature checks a signature produced by PresignGet or PresignPut
+// for the given HTTP method.
+func (l *LocalStorage) VerifySignature(method, key, expires, signature string) error {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(l.sign(method, key, expires)), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (l *LocalStorage) sign(method, key, expires string) string {
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(method + "\n" + key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (l *LocalStorage) List(prefix string) ([]ObjectInfo, error) {
+	objectsRoot := filepath.Join(l.root, "objects")
+	var objects []ObjectInfo
+	err := filepath.WalkDir(objectsRoot, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") || strings.HasPrefix(d.Name(), ".copy-") {
+			return nil
+		}
+		rel, err := filepath.Rel(objectsRoot, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := l.Stat(key)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, info)
+		return nil
+	})
+	return objects, err
+}
+
+// uploadDir returns the directory holding the parts of a multipart upload.
+func (l *LocalStorage) uploadDir(uploadID string) (string, error) {
+	if _, err := hex.DecodeString(uploadID); err != nil || uploadID == "" {
+		return "", fmt.Errorf("invalid upload id %q", uploadID)
+	}
+	return filepath.Join(l.root, "multipart", uploadID), nil
+}
+
+func (l *LocalStorage) CreateMultipartUpload(key, contentType string) (string, error) {
+	if _, _, err := l.paths(key); err != nil {
+		return "", err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	uploadID := hex.EncodeToString(id)
+	dir, _ := l.uploadDir(uploadID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "content-type"), []byte(contentType), 0o644); err != nil {
+		return "", err
+	}
+	return uploadID, nil
+}
+
+func (l *LocalStorage) UploadPart(key, uploadID string, partNumber int, body io.Reader, size int64) (string, error) {
+	dir, err := l.uploadDir(uploadID)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return "", ErrNotFound
+	}
+
+	tmp, err := os.CreateTemp(dir, ".part-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := md5.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hash), body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if size >= 0 && written != size {
+		return "", fmt.Errorf("expected %d bytes, got %d", size, written)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, strconv.Itoa(partNumber))); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (l *LocalStorage) CompleteMultipartUpload(key, uploadID string, parts []CompletedPart) error {
+	dir, err := l.uploadDir(uploadID)
+	if err != nil {
+		return err
+	}
+	contentType, err := os.ReadFile(filepath.Join(dir, "content-type"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	readers := make([]io.Reader, 0, len(parts))
+	for _, part := range parts {
+		f, err := os.Open(filepath.Join(dir, strconv.Itoa(part.PartNumber)))
+		if err != nil {
+			return fmt.Errorf("part %d: %w", part.PartNumber, err)
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	if err := l.Put(key, io.MultiReader(readers...), -1, string(contentType)); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (l *LocalStorage) AbortMultipartUpload(key, uploadID string) error {
+	dir, err := l.uploadDir(uploadID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
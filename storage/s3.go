@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Storage keeps objects in a single S3 bucket.
+type S3Storage struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+}
+
+func NewS3(client *s3.S3, bucket string) *S3Storage {
+	return &S3Storage{
+		client:   client,
+		uploader: s3manager.NewUploaderWithClient(client),
+		bucket:   bucket,
+	}
+}
+
+func (s *S3Storage) Put(key string, body io.Reader, size int64, contentType string) error {
+	// The uploader accepts plain readers and switches to a multipart
+	// upload on its own once the body outgrows a single part.
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func (s *S3Storage) Get(key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, translateS3Error(err)
+	}
+	return out.Body, nil
+}
+
+func (s *S3Storage) Stat(key string) (ObjectInfo, error) {
+	out, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, translateS3Error(err)
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(out.ContentLength),
+		ContentType:  aws.StringValue(out.ContentType),
+		ETag:         strings.Trim(aws.StringValue(out.ETag), `"`),
+		LastModified: aws.TimeValue(out.LastModified),
+	}, nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *S3Storage) PresignGet(key string, expires time.Duration) (string, error) {
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return req.Presign(expires)
+}
+
+func (s *S3Storage) PresignPut(key, contentType string, expires time.Duration) (string, error) {
+	req, _ := s.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	return req.Presign(expires)
+}
+
+func (s *S3Storage) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.StringValue(obj.Key),
+				Size:         aws.Int64Value(obj.Size),
+				ETag:         strings.Trim(aws.StringValue(obj.ETag), `"`),
+				LastModified: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	})
+	return objects, err
+}
+
+// maxCopyObjectSize is the largest object a single CopyObject call can copy.
+const maxCopyObjectSize = 5 << 30
+
+// copyPartSize is the size of each part when larger objects are copied
+// with UploadPartCopy.
+const copyPartSize = 512 << 20
+
+// Copy copies the object to dstKey within the bucket, with CopyObject or,
+// above maxCopyObjectSize, with UploadPartCopy.
+func (s *S3Storage) Copy(srcKey, dstKey string) error {
+	info, err := s.Stat(srcKey)
+	if err != nil {
+		return err
+	}
+	source := url.PathEscape(s.bucket) + "/" + (&url.URL{Path: srcKey}).EscapedPath()
+
+	if info.Size <= maxCopyObjectSize {
+		_, err := s.client.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(s.bucket),
+			Key:        aws.String(dstKey),
+			CopySource: aws.String(source),
+		})
+		return translateS3Error(err)
+	}
+
+	// Objects over 5 GB have to be copied part by part
+	uploadID, err := s.CreateMultipartUpload(dstKey, info.ContentType)
+	if err != nil {
+		return err
+	}
+	var parts []CompletedPart
+	for start, n := int64(0), 1; start < info.Size; start, n = start+copyPartSize, n+1 {
+		end := start + copyPartSize - 1
+		if end >= info.Size {
+			end = info.Size - 1
+		}
+		out, err := s.client.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(dstKey),
+			UploadId:        aws.String(uploadID),
+			PartNumber:      aws.Int64(int64(n)),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		})
+		if err != nil {
+			s.AbortMultipartUpload(dstKey, uploadID)
+			return translateS3Error(err)
+		}
+		parts = append(parts, CompletedPart{
+			PartNumber: n,
+			ETag:       strings.Trim(aws.StringValue(out.CopyPartResult.ETag), `"`),
+		})
+	}
+	if err := s.CompleteMultipartUpload(dstKey, uploadID, parts); err != nil {
+		s.AbortMultipartUpload(dstKey, uploadID)
+		return err
+	}
+	return nil
+}
+
+// translateS3Error maps S3's "no such key" responses onto ErrNotFound.
+func translateS3Error(err error) error {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound {
+		return ErrNotFound
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *S3Storage) CreateMultipartUpload(key, contentType string) (string, error) {
+	out, err := s.client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.UploadId), nil
+}
+
+func (s *S3Storage) UploadPart(key, uploadID string, partNumber int, body io.Reader, size int64) (string, error) {
+	// UploadPart signs the payload, so the body has to be seekable. Spool
+	// plain readers such as request bodies to a temporary file first.
+	seeker, ok := body.(io.ReadSeeker)
+	if !ok {
+		tmp, err := os.CreateTemp("", "cloudbox-part-*")
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		if size, err = io.Copy(tmp, body); err != nil {
+			return "", err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		seeker = tmp
+	}
+
+	out, err := s.client.UploadPart(&s3.UploadPartInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		UploadId:      aws.String(uploadID),
+		PartNumber:    aws.Int64(int64(partNumber)),
+		Body:          seeker,
+		ContentLength: aws.Int64(size),
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(aws.StringValue(out.ETag), `"`), nil
+}
+
+func (s *S3Storage) CompleteMultipartUpload(key, uploadID string, parts []CompletedPart) error {
+	completed := make([]*s3.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completed = append(completed, &s3.CompletedPart{
+			PartNumber: aws.Int64(int64(part.PartNumber)),
+			ETag:       aws.String(`"` + part.ETag + `"`),
+		})
+	}
+	_, err := s.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
+
+func (s *S3Storage) AbortMultipartUpload(key, uploadID string) error {
+	_, err := s.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	return err
+}
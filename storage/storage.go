@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned when the requested object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes an object held by a storage backend.
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// CompletedPart identifies one uploaded part of a multipart upload.
+type CompletedPart struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+// Storage is implemented by every backend CloudBox can keep file contents in.
+type Storage interface {
+	// Put stores size bytes read from body under key.
+	Put(key string, body io.Reader, size int64, contentType string) error
+	// Get opens the object stored under key. The caller must close it.
+	Get(key string) (io.ReadCloser, error)
+	// Stat returns metadata for the object stored under key.
+	Stat(key string) (ObjectInfo, error)
+	// Delete removes the object stored under key. Deleting a missing
+	// object is not an error.
+	Delete(key string) error
+	// PresignGet returns a URL the object can be downloaded from without
+	// further authentication until expires has elapsed.
+	PresignGet(key string, expires time.Duration) (string, error)
+	// PresignPut returns a URL the object can be uploaded to with a PUT
+	// request carrying contentType until expires has elapsed.
+	PresignPut(key, contentType string, expires time.Duration) (string, error)
+	// Copy duplicates the object stored under srcKey to dstKey inside the
+	// backend, without the bytes passing through CloudBox.
+	Copy(srcKey, dstKey string) error
+	// List returns every object whose key starts with prefix.
+	List(prefix string) ([]ObjectInfo, error)
+
+	// CreateMultipartUpload starts an upload whose parts are sent
+	// separately and assembled into key by CompleteMultipartUpload.
+	CreateMultipartUpload(key, contentType string) (string, error)
+	// UploadPart stores one part of a multipart upload and returns its ETag.
+	UploadPart(key, uploadID string, partNumber int, body io.Reader, size int64) (string, error)
+	// CompleteMultipartUpload assembles the given parts, in order, into key.
+	CompleteMultipartUpload(key, uploadID string, parts []CompletedPart) error
+	// AbortMultipartUpload discards an upload and any parts sent so far.
+	AbortMultipartUpload(key, uploadID string) error
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strings"
+    "time"
+)
+
+// clamdChunkSize is how much content goes into each INSTREAM chunk. clamd
+// refuses chunks larger than its StreamMaxLength, which defaults to 25 MB.
+const clamdChunkSize = 64 << 10
+
+// ClamdError is a scan clamd itself refused, such as a stream over its
+// size limit. Trying the same content again gives the same answer.
+type ClamdError struct {
+    Reply string
+}
+
+func (e *ClamdError) Error() string {
+    return "clamd: " + e.Reply
+}
+
+// Clamd scans content with a clamd daemon, or anything speaking its
+// protocol, over TCP or a Unix socket.
+type Clamd struct {
+    Network string // "tcp" or "unix"
+    Address string
+    Timeout time.Duration // for the whole scan
+}
+
+// NewClamd returns a client for the scanner at CLAMD_ADDR, either
+// "host:port", "tcp://host:port" or "unix:///path/to/clamd.sock", and nil
+// when it is not set.
+func NewClamd() *Clamd {
+    addr := GetEnv("CLAMD_ADDR")
+    if addr == "" {
+        return nil
+    }
+    timeout, err := time.ParseDuration(GetEnv("CLAMD_TIMEOUT", "5m"))
+    if err != nil || timeout <= 0 {
+        timeout = 5 * time.Minute
+    }
+
+    switch {
+    case strings.HasPrefix(addr, "unix://"):
+        return &Clamd{Network: "unix", Address: strings.TrimPrefix(addr, "unix://"), Timeout: timeout}
+    case strings.HasPrefix(addr, "/"):
+        return &Clamd{Network: "unix", Address: addr, Timeout: timeout}
+    }
+    return &Clamd{Network: "tcp", Address: strings.TrimPrefix(addr, "tcp://"), Timeout: timeout}
+}
+
+// Scan streams r to clamd with the INSTREAM command. It returns the name
+// of the signature found, or "" when the content is clean. A *ClamdError
+// means clamd answered but could not scan the content; any other error
+// means it could not be reached or the connection failed.
+func (c *Clamd) Scan(r io.Reader) (string, error) {
+    conn, err := net.DialTimeout(c.Network, c.Address, 10*time.Second)
+    if err != nil {
+        return "", err
+    }
+    defer conn.Close()
+    if c.Timeout > 0 {
+        conn.SetDeadline(time.Now().Add(c.Timeout))
+    }
+
+    // The z prefix terminates commands and replies with a NUL byte
+    if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+        return "", err
+    }
+    buf := make([]byte, 4+clamdChunkSize)
+    for {
+        n, readErr := io.ReadFull(r, buf[4:])
+        if n > 0 {
+            binary.BigEndian.PutUint32(buf[:4], uint32(n))
+            if _, err := conn.Write(buf[:4+n]); err != nil {
+                // clamd closes the stream early when it is over its limit,
+                // and says so in its reply
+                if reply, replyErr := readClamdReply(conn); replyErr == nil {
+                    return parseClamdReply(reply)
+                }
+                return "", err
+            }
+        }
+        if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+            break
+        }
+        if readErr != nil {
+            return "", readErr
+        }
+    }
+    if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+        return "", err
+    }
+
+    reply, err := readClamdReply(conn)
+    if err != nil {
+        return "", err
+    }
+    return parseClamdReply(reply)
+}
+
+func readClamdReply(conn net.Conn) (string, error) {
+    reply, err := bufio.NewReader(conn).ReadString(0)
+    if err != nil && reply == "" {
+        return "", err
+    }
+    return strings.TrimRight(reply, "\x00\r\n"), nil
+}
+
+// parseClamdReply reads an INSTREAM reply: "stream: OK", "stream: <name>
+// FOUND" or "<message> ERROR".
+func parseClamdReply(reply string) (string, error) {
+    reply = strings.TrimPrefix(reply, "stream: ")
+    switch {
+    case reply == "OK":
+        return "", nil
+    case strings.HasSuffix(reply, " FOUND"):
+        return strings.TrimSuffix(reply, " FOUND"), nil
+    case strings.HasSuffix(reply, " ERROR"):
+        return "", &ClamdError{Reply: strings.TrimSuffix(reply, " ERROR")}
+    }
+    return "", fmt.Errorf("clamd: unexpected reply %q", reply)
+}
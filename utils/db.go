@@ -4,14 +4,14 @@ import (
     "log"
     "os"
     "time"
-    "net"
     "gorm.io/driver/postgres"
     "gorm.io/gorm"
     "gorm.io/gorm/logger"
 )
 
+// ConnectDB opens the application's database pool. It is meant to be called
+// once at startup; the returned handle is safe for concurrent use.
 func ConnectDB() *gorm.DB {
-    // Add retry logic for DNS resolution
     maxRetries := 3
     var db *gorm.DB
     var err error
@@ -27,17 +27,9 @@ func ConnectDB() *gorm.DB {
         PrepareStmt: true,
     }
 
-    // Retry loop for connection
+    // Retry loop for connection, so a database that is still waking up
+    // does not abort startup
     for i := 0; i < maxRetries; i++ {
-        // Try to resolve the host first
-        host := "ep-crimson-truth-a5ttv8vs.us-east-2.aws.neon.tech"
-        _, err := net.LookupHost(host)
-        if err != nil {
-            log.Printf("Attempt %d: DNS resolution failed: %v", i+1, err)
-            time.Sleep(2 * time.Second) // Wait before retrying
-            continue
-        }
-
         db, err = gorm.Open(postgres.Open(dsn), config)
         if err == nil {
             break
@@ -69,4 +61,4 @@ func ConnectDB() *gorm.DB {
 
     log.Println("Successfully connected to database!")
     return db
-}
\ No newline at end of file
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+    "image"
+    "image/color"
+    "image/draw"
+)
+
+// ResizeToFit scales img down so that neither side exceeds maxSide,
+// keeping its aspect ratio. Each output pixel is the average of the source
+// pixels it covers, which keeps downscaled photos free of aliasing. Images
+// already small enough are returned unscaled.
+func ResizeToFit(img image.Image, maxSide int) *image.RGBA {
+    b := img.Bounds()
+    w, h := b.Dx(), b.Dy()
+
+    tw, th := w, h
+    if w > maxSide || h > maxSide {
+        if w >= h {
+            tw, th = maxSide, h*maxSide/w
+        } else {
+            tw, th = w*maxSide/h, maxSide
+        }
+        if tw < 1 {
+            tw = 1
+        }
+        if th < 1 {
+            th = 1
+        }
+    }
+
+    dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+    if tw == w && th == h {
+        draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+        return dst
+    }
+
+    for y := 0; y < th; y++ {
+        y0 := b.Min.Y + y*h/th
+        y1 := b.Min.Y + (y+1)*h/th
+        if y1 == y0 {
+            y1++
+        }
+        for x := 0; x < tw; x++ {
+            x0 := b.Min.X + x*w/tw
+            x1 := b.Min.X + (x+1)*w/tw
+            if x1 == x0 {
+                x1++
+            }
+
+            // RGBA returns alpha-premultiplied values, so a plain
+            // average blends transparent edges correctly
+            var r, g, bl, a, n uint64
+            for sy := y0; sy < y1; sy++ {
+                for sx := x0; sx < x1; sx++ {
+                    cr, cg, cb, ca := img.At(sx, sy).RGBA()
+                    r += uint64(cr)
+                    g += uint64(cg)
+                    bl += uint64(cb)
+                    a += uint64(ca)
+                    n++
+                }
+            }
+            dst.Set(x, y, color.RGBA64{
+                R: uint16(r / n),
+                G: uint16(g / n),
+                B: uint16(bl / n),
+                A: uint16(a / n),
+            })
+        }
+    }
+    return dst
+}
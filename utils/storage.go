@@ -0,0 +1,26 @@
+package utils
+
+import (
+    "errors"
+
+    "CloudBox/storage"
+)
+
+// NewStorage builds the storage backend selected by STORAGE_BACKEND
+// ("s3" by default, or "local" to keep files under LOCAL_STORAGE_PATH).
+func NewStorage() (storage.Storage, error) {
+    switch GetEnv("STORAGE_BACKEND", "s3") {
+    case "local":
+        return storage.NewLocal(
+            GetEnv("LOCAL_STORAGE_PATH", "./data"),
+            GetEnv("APP_BASE_URL"),
+            GetEnv("SECRET"),
+        )
+    default:
+        client := GetS3Client()
+        if client == nil {
+            return nil, errors.New("failed to create S3 client")
+        }
+        return storage.NewS3(client, GetEnv("AWS_BUCKET_NAME")), nil
+    }
+}